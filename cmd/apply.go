@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+
+	"github.com/jesselang/dox/internal"
+)
+
+var applyCmd = &cobra.Command{
+	Use:   "apply PLAN",
+	Short: "Make the changes in a saved plan",
+	Long: `Make exactly the changes in a plan saved by dox plan --output. Nothing is
+changed if any of the pages in the plan have changed since it was made.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		plan, err := dox.ReadPlan(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			os.Exit(1)
+		}
+
+		restore, err := usePlan(plan)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			os.Exit(1)
+		}
+		defer restore()
+
+		fs, err := sourcesFs()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			os.Exit(1)
+		}
+		err = dox.ApplyPlan(fs, plan, repoRoot, verbose)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(applyCmd)
+}
+
+// usePlan overlays the config of the project and target the plan was made
+// for.
+func usePlan(plan *dox.Plan) (func(), error) {
+	s := selection{target: plan.Target}
+
+	if plan.Project != "" {
+		all, err := dox.FindProjects(afero.NewOsFs(), repoRoot)
+		if err != nil {
+			return nil, err
+		}
+		dir := filepath.Join(repoRoot, filepath.FromSlash(plan.Project))
+		s.project, err = dox.ProjectOf(all, dir)
+		if err != nil {
+			return nil, err
+		}
+		if s.project.Dir != dir {
+			return nil, fmt.Errorf("the plan is for the project in %s, which has no config", plan.Project)
+		}
+	}
+
+	return s.use()
+}
@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/jesselang/dox/internal"
+)
+
+var checkExternal bool
+
+var checkCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Check relative links, images and anchors",
+	Long: `Check that every relative link and image in the sources refers to a file
+that exists, that linked sources are not ignored, and that links to anchors
+match a heading in the linked source. No network calls are made unless
+--external is given, which also requests every absolute link.
+
+Problems are printed as file:line diagnostics, and dox exits non-zero if any
+are found.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		restore, err := useTarget()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			os.Exit(1)
+		}
+		defer restore()
+
+		fs, err := sourcesFs()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			os.Exit(1)
+		}
+		files, err := dox.FindAll(fs, repoRoot)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			os.Exit(1)
+		}
+
+		diagnostics, err := dox.Check(fs, files, repoRoot)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			os.Exit(1)
+		}
+
+		if checkExternal {
+			external, err := dox.CheckExternal(fs, files, repoRoot, externalOpts())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error: %s\n", err)
+				os.Exit(1)
+			}
+			diagnostics = append(diagnostics, external...)
+		}
+
+		for _, d := range diagnostics {
+			fmt.Println(d)
+		}
+
+		if len(diagnostics) > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	viper.SetDefault("check.external.concurrency", 8)
+	viper.SetDefault("check.external.host_interval", 250*time.Millisecond)
+	viper.SetDefault("check.external.timeout", 10*time.Second)
+	viper.SetDefault("check.external.cache_ttl", 24*time.Hour)
+
+	checkCmd.Flags().BoolVar(&checkExternal, "external", false, "Also check absolute links over the network")
+	RootCmd.AddCommand(checkCmd)
+}
+
+func externalOpts() dox.ExternalOpts {
+	cacheFile := viper.GetString("check.external.cache_file")
+	if cacheFile == "" {
+		if dir, err := os.UserCacheDir(); err == nil {
+			cacheFile = filepath.Join(dir, "dox", "links.json")
+		}
+	}
+
+	return dox.ExternalOpts{
+		Concurrency:  viper.GetInt("check.external.concurrency"),
+		HostInterval: viper.GetDuration("check.external.host_interval"),
+		Timeout:      viper.GetDuration("check.external.timeout"),
+		CacheFile:    cacheFile,
+		CacheTTL:     viper.GetDuration("check.external.cache_ttl"),
+		Allow:        viper.GetStringSlice("check.external.allow"),
+		Deny:         viper.GetStringSlice("check.external.deny"),
+	}
+}
@@ -0,0 +1,1131 @@
+//go:build !windows
+// +build !windows
+
+package cmd_test
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jesselang/dox/cmd"
+	"github.com/jesselang/dox/internal/fakeconfluence"
+)
+
+// The test binary runs the dox command in place of the tests when
+// DOX_E2E_RUN is set, so the tests can run dox exactly as a user would.
+func TestMain(m *testing.M) {
+	if os.Getenv("DOX_E2E_RUN") != "" {
+		cmd.Execute()
+		os.Exit(0)
+	}
+
+	os.Exit(m.Run())
+}
+
+// newRepo creates a repo from a fixture in testdata, configured to publish
+// to srv, and returns its path.
+//
+// Fixtures hold every file of a repo, each following a "-- path --" line, so
+// their markdown is not mistaken for docs of this repo. A .dox.yaml in a
+// fixture is added to the config of the repo.
+func newRepo(t *testing.T, fixture string, srv *fakeconfluence.Server) string {
+	f, err := os.Open(filepath.Join("testdata", fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	dir, err := ioutil.TempDir("", "dox-e2e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// resolve symlinks so paths match those dox finds, as on macOS
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]*strings.Builder{}
+	var current *strings.Builder
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Text()
+		if strings.HasPrefix(line, "-- ") && strings.HasSuffix(line, " --") {
+			current = &strings.Builder{}
+			files[strings.TrimSuffix(strings.TrimPrefix(line, "-- "), " --")] = current
+			continue
+		}
+		if current != nil {
+			current.WriteString(line + "\n")
+		}
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &strings.Builder{}
+	fmt.Fprintf(config, "uri: %s\napi: v1\nspace: DOX\ntitle: Docs\nbrowse_url_base: https://git.example.com/docs/blob/main\n", srv.URL)
+	if extra, ok := files[".dox.yaml"]; ok {
+		config.WriteString(extra.String())
+	}
+	files[".dox.yaml"] = config
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		// configs of nested projects refer to the server as $URL
+		content := strings.Replace(content.String(), "$URL", srv.URL, -1)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, ".git"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+// run runs the dox command in repo, and returns its output.
+func run(repo string, args ...string) (string, error) {
+	return runEnv(repo, nil, args...)
+}
+
+// runEnv runs the dox command in repo with env added to its environment, and
+// returns its output.
+func runEnv(repo string, env []string, args ...string) (string, error) {
+	c := exec.Command(os.Args[0], args...)
+	c.Dir = repo
+	c.Env = append(os.Environ(),
+		"DOX_E2E_RUN=1",
+		"DOX_USERNAME=user",
+		"DOX_PASSWORD=password",
+	)
+	c.Env = append(c.Env, env...)
+
+	out, err := c.CombinedOutput()
+
+	return string(out), err
+}
+
+// dox runs the dox command in repo, failing the test if it fails, and
+// returns its output.
+func dox(t *testing.T, repo string, args ...string) string {
+	out, err := run(repo, args...)
+	if err != nil {
+		t.Fatalf("dox %s: %s\n%s", strings.Join(args, " "), err, out)
+	}
+
+	return out
+}
+
+// sourceID returns the page ID in the dox header of a source.
+func sourceID(t *testing.T, path string) string {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	line := strings.SplitN(string(buf), "\n", 2)[0]
+	if !strings.HasPrefix(line, "<!-- dox: ") {
+		t.Fatalf("%s has no dox header: %q", path, line)
+	}
+
+	return strings.Split(strings.TrimSuffix(strings.TrimPrefix(line, "<!-- dox: "), " -->"), ", ")[0]
+}
+
+func sorted(list []string) []string {
+	list = append([]string(nil), list...)
+	sort.Strings(list)
+
+	return list
+}
+
+func titles(pages []*fakeconfluence.Page) []string {
+	var titles []string
+	for _, p := range pages {
+		titles = append(titles, p.Title)
+	}
+
+	return titles
+}
+
+func TestPublishDefaultRoot(t *testing.T) {
+	srv := fakeconfluence.New()
+	defer srv.Close()
+	repo := newRepo(t, "basic.txt", srv)
+	defer os.RemoveAll(repo)
+
+	dox(t, repo)
+
+	// the root page is created from config, and its ID saved there
+	config, err := ioutil.ReadFile(filepath.Join(repo, ".dox.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := srv.Children("")
+	if len(roots) != 1 || roots[0].Title != "Docs" {
+		t.Fatalf("top level pages are %v, want [Docs]", titles(roots))
+	}
+	root := roots[0]
+	if !strings.Contains(string(config), root.ID) {
+		t.Errorf("root page ID %s is not in config:\n%s", root.ID, config)
+	}
+
+	children := srv.Children(root.ID)
+	if got := strings.Join(titles(children), ", "); got != "Install, Readme" {
+		t.Fatalf("children of root are %s, want Install, Readme", got)
+	}
+
+	installID := sourceID(t, filepath.Join(repo, "docs/install.md"))
+	readmeID := sourceID(t, filepath.Join(repo, "README.md"))
+	if installID != children[0].ID || readmeID != children[1].ID {
+		t.Errorf("source IDs are %s and %s, want %s and %s", installID, readmeID, children[0].ID, children[1].ID)
+	}
+
+	readme := srv.Page(readmeID)
+	for _, want := range []string{
+		// a heading in another source links to the anchor Confluence makes
+		fmt.Sprintf(`href="%s/pages/viewpage.action?pageId=%s#Install-Requirements"`, srv.URL, installID),
+		// files that are not sources link to the repo
+		`href="https://git.example.com/docs/blob/main/LICENSE"`,
+		// images are attached
+		fmt.Sprintf(`src="%s/download/attachments/%s/logo.png"`, srv.URL, readmeID),
+		// the notice links to the source
+		`href="https://git.example.com/docs/blob/main/README.md"`,
+	} {
+		if !strings.Contains(readme.Body, want) {
+			t.Errorf("README page does not contain %s:\n%s", want, readme.Body)
+		}
+	}
+	if got := string(readme.Attachments["logo.png"]); got != "not really a png\n" {
+		t.Errorf("logo.png attachment is %q", got)
+	}
+
+	// nothing changed, so publishing again leaves every page as it was
+	versions := map[string]int{}
+	for _, p := range srv.Pages() {
+		versions[p.ID] = p.Version
+	}
+	dox(t, repo)
+	for _, p := range srv.Pages() {
+		if p.Version != versions[p.ID] {
+			t.Errorf("%s was updated to version %d by publishing again", p.Title, p.Version)
+		}
+	}
+	if len(srv.Pages()) != len(versions) {
+		t.Errorf("publishing again made %d pages, want %d", len(srv.Pages()), len(versions))
+	}
+}
+
+func TestPublishRootPage(t *testing.T) {
+	srv := fakeconfluence.New()
+	defer srv.Close()
+	repo := newRepo(t, "rooted.txt", srv)
+	defer os.RemoveAll(repo)
+
+	dox(t, repo)
+
+	roots := srv.Children("")
+	if len(roots) != 1 || roots[0].Title != "Handbook" {
+		t.Fatalf("top level pages are %v, want [Handbook]", titles(roots))
+	}
+	if id := sourceID(t, filepath.Join(repo, "ROOT.md")); id != roots[0].ID {
+		t.Errorf("ROOT.md has ID %s, want %s", id, roots[0].ID)
+	}
+
+	children := srv.Children(roots[0].ID)
+	if len(children) != 1 || children[0].Title != "Guide" {
+		t.Fatalf("children of root are %v, want [Guide]", titles(children))
+	}
+	want := fmt.Sprintf(`href="%s/pages/viewpage.action?pageId=%s"`, srv.URL, roots[0].ID)
+	if !strings.Contains(children[0].Body, want) {
+		t.Errorf("guide page does not link to the root page with %s:\n%s", want, children[0].Body)
+	}
+}
+
+func TestPublishDryRun(t *testing.T) {
+	srv := fakeconfluence.New()
+	defer srv.Close()
+	repo := newRepo(t, "rooted.txt", srv)
+	defer os.RemoveAll(repo)
+
+	out := dox(t, repo, "--dry-run")
+	if !strings.Contains(out, `create "Guide" ({pending:2}) under "Handbook" from guide.md`) {
+		t.Errorf("dry run did not print the plan:\n%s", out)
+	}
+
+	if pages := srv.Pages(); len(pages) != 0 {
+		t.Errorf("dry run created pages %v", titles(pages))
+	}
+
+	buf, err := ioutil.ReadFile(filepath.Join(repo, "guide.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(buf), "dox:") {
+		t.Errorf("dry run added a dox header to guide.md:\n%s", buf)
+	}
+}
+
+func TestPlanAndApply(t *testing.T) {
+	srv := fakeconfluence.New()
+	defer srv.Close()
+	repo := newRepo(t, "rooted.txt", srv)
+	defer os.RemoveAll(repo)
+
+	plan := filepath.Join(repo, "plan.json")
+	dox(t, repo, "plan", "-o", plan)
+	if pages := srv.Pages(); len(pages) != 0 {
+		t.Fatalf("planning created pages %v", titles(pages))
+	}
+
+	dox(t, repo, "apply", plan)
+	roots := srv.Children("")
+	if len(roots) != 1 || len(srv.Children(roots[0].ID)) != 1 {
+		t.Fatalf("applying the plan made pages %v", titles(srv.Pages()))
+	}
+
+	// the pages in the plan exist now
+	if out, err := run(repo, "apply", plan); err == nil {
+		t.Errorf("applying a plan twice succeeded:\n%s", out)
+	}
+}
+
+func TestApplyRefusesStalePlan(t *testing.T) {
+	srv := fakeconfluence.New()
+	defer srv.Close()
+	repo := newRepo(t, "rooted.txt", srv)
+	defer os.RemoveAll(repo)
+
+	dox(t, repo)
+
+	guidePath := filepath.Join(repo, "guide.md")
+	buf, err := ioutil.ReadFile(guidePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(guidePath, append(buf, []byte("\nMore to read.\n")...), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	plan := filepath.Join(repo, "plan.json")
+	out := dox(t, repo, "plan", "-o", plan)
+	if !strings.Contains(out, `update "Guide"`) {
+		t.Fatalf("plan does not update the guide:\n%s", out)
+	}
+
+	// someone edits the page after the plan is made
+	guideID := sourceID(t, guidePath)
+	srv.EditPage(guideID, "<p>edited by hand</p>")
+
+	out, err = run(repo, "apply", plan)
+	if err == nil || !strings.Contains(out, "pages changed since the plan was made") {
+		t.Fatalf("applying a stale plan did not fail as expected: %v\n%s", err, out)
+	}
+	if body := srv.Page(guideID).Body; body != "<p>edited by hand</p>" {
+		t.Errorf("applying a stale plan changed the page:\n%s", body)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	srv := fakeconfluence.New()
+	defer srv.Close()
+	repo := newRepo(t, "rooted.txt", srv)
+	defer os.RemoveAll(repo)
+	// a page without the notice is told apart from pages added by hand too
+	notesPath := filepath.Join(repo, "notes.md")
+	if err := ioutil.WriteFile(notesPath, []byte("<!-- dox: omit-notice -->\n# Notes\n\nJotted down.\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dox(t, repo)
+
+	rootID := sourceID(t, filepath.Join(repo, "ROOT.md"))
+	guideID := sourceID(t, filepath.Join(repo, "guide.md"))
+	notesID := sourceID(t, notesPath)
+	manualID := srv.AddPage("DOX", "Added by hand", "<p>not from dox</p>", rootID)
+	if body := srv.Page(notesID).Body; strings.Contains(body, "published by dox") {
+		t.Fatalf("notes were published with the notice:\n%s", body)
+	}
+
+	for _, path := range []string{filepath.Join(repo, "guide.md"), notesPath} {
+		if err := os.Remove(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// pages are only pruned when asked
+	dox(t, repo)
+	if srv.Page(guideID) == nil {
+		t.Fatal("guide was pruned without --prune")
+	}
+
+	out := dox(t, repo, "plan", "--prune")
+	if !strings.Contains(out, fmt.Sprintf(`prune "Guide" (%s)`, guideID)) {
+		t.Errorf("plan does not prune the guide:\n%s", out)
+	}
+
+	dox(t, repo, "--prune")
+	if srv.Page(guideID) != nil {
+		t.Error("guide was not pruned")
+	}
+	if srv.Page(notesID) != nil {
+		t.Error("notes published without the notice were not pruned")
+	}
+	if srv.Page(manualID) == nil {
+		t.Error("a page not published by dox was pruned")
+	}
+}
+
+func TestLabels(t *testing.T) {
+	srv := fakeconfluence.New()
+	defer srv.Close()
+	repo := newRepo(t, "labeled.txt", srv)
+	defer os.RemoveAll(repo)
+
+	dox(t, repo)
+
+	rootID := sourceID(t, filepath.Join(repo, "ROOT.md"))
+	restartPath := filepath.Join(repo, "runbooks/restart.md")
+	restartID := sourceID(t, restartPath)
+
+	for id, want := range map[string]string{
+		rootID:    "dox-managed, handbook, team-docs",
+		restartID: "dox-managed, ops, runbook",
+	} {
+		page := srv.Page(id)
+		if got := strings.Join(sorted(page.Labels), ", "); got != want {
+			t.Errorf("%s is labeled %s, want %s", page.Title, got, want)
+		}
+	}
+	if body := srv.Page(restartID).Body; strings.Contains(body, "labels") {
+		t.Errorf("front matter was published:\n%s", body)
+	}
+
+	// labels added by hand are kept, and labels dox no longer wants removed
+	srv.AddLabel(restartID, "reviewed")
+	buf, err := ioutil.ReadFile(restartPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(restartPath, []byte(strings.Replace(string(buf), "  - ops\n", "", 1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := dox(t, repo, "plan")
+	if !strings.Contains(out, fmt.Sprintf(`label "Restart" (%s) with dox-managed, runbook, removing ops`, restartID)) {
+		t.Errorf("plan does not relabel the runbook:\n%s", out)
+	}
+
+	dox(t, repo)
+	if got := strings.Join(sorted(srv.Page(restartID).Labels), ", "); got != "dox-managed, reviewed, runbook" {
+		t.Errorf("runbook is labeled %s, want dox-managed, reviewed, runbook", got)
+	}
+
+	if out := dox(t, repo, "plan"); !strings.Contains(out, "no changes") {
+		t.Errorf("labels changed after publishing:\n%s", out)
+	}
+}
+
+// git runs git in repo, failing the test if it fails, and returns its output.
+func git(t *testing.T, repo string, args ...string) string {
+	c := exec.Command("git", append([]string{
+		"-c", "user.name=dox",
+		"-c", "user.email=dox@example.com",
+		"-c", "commit.gpgsign=false",
+	}, args...)...)
+	c.Dir = repo
+	out, err := c.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %s\n%s", strings.Join(args, " "), err, out)
+	}
+
+	return strings.TrimSpace(string(out))
+}
+
+// gitInit makes repo a git repo, with every file committed.
+func gitInit(t *testing.T, repo string) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	if err := os.Remove(filepath.Join(repo, ".git")); err != nil {
+		t.Fatal(err)
+	}
+
+	git(t, repo, "init", "-q")
+	git(t, repo, "add", ".")
+	git(t, repo, "commit", "-q", "-m", "initial")
+}
+
+func TestPublishSince(t *testing.T) {
+	srv := fakeconfluence.New()
+	defer srv.Close()
+	repo := newRepo(t, "rooted.txt", srv)
+	defer os.RemoveAll(repo)
+	gitInit(t, repo)
+
+	// nothing was published before, so everything is
+	dox(t, repo, "--since-last")
+	rootID := sourceID(t, filepath.Join(repo, "ROOT.md"))
+	guidePath := filepath.Join(repo, "guide.md")
+	guideID := sourceID(t, guidePath)
+	if srv.Page(guideID) == nil {
+		t.Fatal("guide was not published")
+	}
+	head := git(t, repo, "rev-parse", "HEAD")
+	if got := string(srv.Page(rootID).Properties["dox-commit"]); !strings.Contains(got, head) {
+		t.Errorf("root page records commit %s, want %s", got, head)
+	}
+
+	// publishing records the commit it published, before the dox headers
+	// of new pages are committed
+	git(t, repo, "commit", "-q", "-am", "add dox headers")
+	dox(t, repo, "--since-last")
+
+	// the root page is edited by hand, but its source has not changed since
+	// the last publish, so it is left alone
+	srv.EditPage(rootID, "<p>edited by hand</p>")
+	buf, err := ioutil.ReadFile(guidePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(guidePath, append(buf, []byte("\nMore to read.\n")...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	git(t, repo, "commit", "-q", "-am", "more guide")
+
+	dox(t, repo, "--since-last")
+	if body := srv.Page(guideID).Body; !strings.Contains(body, "More to read.") {
+		t.Errorf("guide was not republished:\n%s", body)
+	}
+	if body := srv.Page(rootID).Body; body != "<p>edited by hand</p>" {
+		t.Errorf("root page was republished:\n%s", body)
+	}
+	head = git(t, repo, "rev-parse", "HEAD")
+	if got := string(srv.Page(rootID).Properties["dox-commit"]); !strings.Contains(got, head) {
+		t.Errorf("root page records commit %s, want %s", got, head)
+	}
+
+	// changes since an older ref, given either way
+	for _, args := range [][]string{{"--since=HEAD~2"}, {"--since", "HEAD~2"}} {
+		out := dox(t, repo, append(args, "--dry-run")...)
+		if !strings.Contains(out, `update "Handbook"`) {
+			t.Errorf("plan with %s does not update the root page:\n%s", strings.Join(args, " "), out)
+		}
+	}
+	if out, err := run(repo, "--since", "HEAD~2", "--since-last"); err == nil {
+		t.Errorf("--since with --since-last succeeded:\n%s", out)
+	}
+
+	// changes not committed are published, and recorded to be published
+	// again in case they are reverted rather than committed
+	if err := ioutil.WriteFile(guidePath, append(buf, []byte("\nNot committed.\n")...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := dox(t, repo, "--since-last")
+	if !strings.Contains(out, "warning: published changes not committed") {
+		t.Errorf("publishing changes not committed did not warn:\n%s", out)
+	}
+	if body := srv.Page(guideID).Body; !strings.Contains(body, "Not committed.") {
+		t.Errorf("guide was not republished:\n%s", body)
+	}
+	if got := string(srv.Page(rootID).Properties["dox-commit"]); !strings.Contains(got, `"uncommitted":["guide.md"]`) {
+		t.Errorf("root page records %s, want guide.md as not committed", got)
+	}
+	git(t, repo, "checkout", "-q", "guide.md")
+	dox(t, repo, "--since-last")
+	if body := srv.Page(guideID).Body; strings.Contains(body, "Not committed.") {
+		t.Errorf("reverted change was not republished:\n%s", body)
+	}
+}
+
+func TestPublishRef(t *testing.T) {
+	srv := fakeconfluence.New()
+	defer srv.Close()
+	repo := newRepo(t, "rooted.txt", srv)
+	defer os.RemoveAll(repo)
+	gitInit(t, repo)
+
+	dox(t, repo, "--ref", "HEAD")
+	git(t, repo, "commit", "-q", "-am", "add dox headers")
+	guidePath := filepath.Join(repo, "guide.md")
+	guideID := sourceID(t, guidePath)
+
+	appendTo := func(line string) {
+		f, err := os.OpenFile(guidePath, os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteString("\n" + line + "\n"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	appendTo("Committed.")
+	git(t, repo, "commit", "-q", "-am", "more guide")
+	appendTo("Staged.")
+	git(t, repo, "add", "guide.md")
+	appendTo("Not staged.")
+
+	for _, tc := range []struct {
+		args    []string
+		want    []string
+		notWant []string
+	}{
+		{[]string{"--ref", "HEAD"}, []string{"Committed."}, []string{"Staged.", "Not staged."}},
+		// a ref that is not checked out
+		{[]string{"--ref", "HEAD~1"}, nil, []string{"Committed.", "Staged.", "Not staged."}},
+		{[]string{"--discover", "git"}, []string{"Committed.", "Staged."}, []string{"Not staged."}},
+	} {
+		dox(t, repo, tc.args...)
+		body := srv.Page(guideID).Body
+		for _, s := range tc.want {
+			if !strings.Contains(body, s) {
+				t.Errorf("publishing with %s left out %q:\n%s", strings.Join(tc.args, " "), s, body)
+			}
+		}
+		for _, s := range tc.notWant {
+			if strings.Contains(body, s) {
+				t.Errorf("publishing with %s published %q:\n%s", strings.Join(tc.args, " "), s, body)
+			}
+		}
+	}
+	if buf, err := ioutil.ReadFile(guidePath); err != nil || !strings.Contains(string(buf), "Not staged.") {
+		t.Errorf("guide.md in the working tree was changed: %s", buf)
+	}
+}
+
+func TestCommitMetadata(t *testing.T) {
+	srv := fakeconfluence.New()
+	defer srv.Close()
+	repo := newRepo(t, "rooted.txt", srv)
+	defer os.RemoveAll(repo)
+
+	config, err := os.OpenFile(filepath.Join(repo, ".dox.yaml"), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = config.WriteString("commit_footer: true\n")
+	config.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gitInit(t, repo)
+
+	dox(t, repo)
+	git(t, repo, "commit", "-q", "-am", "add dox headers")
+
+	guidePath := filepath.Join(repo, "guide.md")
+	buf, err := ioutil.ReadFile(guidePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(guidePath, append(buf, []byte("\nMore to read.\n")...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	git(t, repo, "commit", "-q", "-am", "Explain <more>")
+	short := git(t, repo, "rev-parse", "--short", "HEAD")
+	full := git(t, repo, "rev-parse", "HEAD")
+
+	dox(t, repo)
+
+	guide := srv.Page(sourceID(t, guidePath))
+	if want := "dox: " + short + " Explain <more>"; guide.Message != want {
+		t.Errorf("version message is %q, want %q", guide.Message, want)
+	}
+	want := fmt.Sprintf(`by dox on %s in <a href="https://git.example.com/docs/commit/%s">%s</a>: Explain &lt;more&gt;`,
+		time.Now().Format("2006-01-02"), full, short)
+	if !strings.Contains(guide.Body, want) {
+		t.Errorf("guide footer does not contain %s:\n%s", want, guide.Body)
+	}
+}
+
+func TestTargets(t *testing.T) {
+	srv := fakeconfluence.New()
+	defer srv.Close()
+	repo := newRepo(t, "targets.txt", srv)
+	defer os.RemoveAll(repo)
+
+	dox(t, repo)
+
+	roots := map[string]*fakeconfluence.Page{}
+	for _, p := range srv.Children("") {
+		roots[p.Space] = p
+	}
+	if len(roots) != 2 || roots["DOX"] == nil || roots["PUB"] == nil {
+		t.Fatalf("top level pages are %v, want a root in DOX and PUB", titles(srv.Children("")))
+	}
+	if roots["PUB"].Title != "Public Docs" {
+		t.Errorf("root page of public is %s, want Public Docs", roots["PUB"].Title)
+	}
+
+	if got := strings.Join(titles(srv.Children(roots["DOX"].ID)), ", "); got != "FAQ, Guide" {
+		t.Errorf("children of the team root are %s, want FAQ, Guide", got)
+	}
+	public := srv.Children(roots["PUB"].ID)
+	if got := strings.Join(titles(public), ", "); got != "FAQ" {
+		t.Fatalf("children of the public root are %s, want FAQ", got)
+	}
+
+	// each source has an ID for each target it is published to
+	buf, err := ioutil.ReadFile(filepath.Join(repo, "public/faq.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	faq := srv.Children(roots["DOX"].ID)[0]
+	header := fmt.Sprintf("<!-- dox: team:%s, public:%s -->\n", faq.ID, public[0].ID)
+	if !strings.HasPrefix(string(buf), header) {
+		t.Errorf("public/faq.md does not start with %q:\n%s", header, buf)
+	}
+
+	// the root page ID of each target is saved with the target
+	config, err := ioutil.ReadFile(filepath.Join(repo, ".dox.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		fmt.Sprintf("- name: team\n  root_id: \"%s\"\n", roots["DOX"].ID),
+		fmt.Sprintf("  root_id: \"%s\"\n", roots["PUB"].ID),
+	} {
+		if !strings.Contains(string(config), want) {
+			t.Errorf("config does not contain %q:\n%s", want, config)
+		}
+	}
+
+	// a single target can be chosen, and publishing again changes nothing
+	if out := dox(t, repo, "plan", "--target", "public"); !strings.Contains(out, "no changes") || strings.Contains(out, "target team") {
+		t.Errorf("plan for public:\n%s", out)
+	}
+	pages := len(srv.Pages())
+	dox(t, repo)
+	if len(srv.Pages()) != pages {
+		t.Errorf("publishing again made %d pages, want %d", len(srv.Pages()), pages)
+	}
+
+	if out, err := run(repo, "--target", "private"); err == nil || !strings.Contains(out, "no target named private") {
+		t.Errorf("publishing to an unknown target did not fail:\n%s", out)
+	}
+}
+
+func TestStaticTarget(t *testing.T) {
+	srv := fakeconfluence.New()
+	defer srv.Close()
+	repo := newRepo(t, "static.txt", srv)
+	defer os.RemoveAll(repo)
+
+	dox(t, repo)
+
+	roots := srv.Children("")
+	if len(roots) != 1 {
+		t.Fatalf("top level pages are %v, want one root", titles(roots))
+	}
+	if got := strings.Join(titles(srv.Children(roots[0].ID)), ", "); got != "Guide" {
+		t.Errorf("children of the root are %s, want Guide", got)
+	}
+	for _, name := range []string{"index.html", "guide.html", ".dox-static"} {
+		if _, err := os.Stat(filepath.Join(repo, "site", name)); err != nil {
+			t.Errorf("site was not rendered: %s", err)
+		}
+	}
+
+	// the site is in the repo, but is not a source of either target
+	writeFile := func(name string, content string) {
+		if err := ioutil.WriteFile(filepath.Join(repo, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile("site/notes.md", "# Notes\n")
+	if out := dox(t, repo, "status"); !strings.Contains(out, "target site\npublished  guide.md\n") ||
+		!strings.Contains(out, "static site rendered by dox") || strings.Contains(out, "notes.md") {
+		t.Errorf("status:\n%s", out)
+	}
+	out := dox(t, repo, "plan")
+	if !strings.Contains(out, "no changes") || !strings.Contains(out, "render the site to site") {
+		t.Errorf("plan:\n%s", out)
+	}
+
+	// a directory dox did not render is never written to
+	if err := os.Mkdir(filepath.Join(repo, "public"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile("public/index.html", "mine")
+	if out, err := run(repo, "static", "-o", "public"); err == nil || !strings.Contains(out, "not a site rendered by dox") {
+		t.Errorf("rendering over another directory did not fail:\n%s", out)
+	}
+}
+
+func TestTargetsAdded(t *testing.T) {
+	srv := fakeconfluence.New()
+	defer srv.Close()
+	repo := newRepo(t, "targets.txt", srv)
+	defer os.RemoveAll(repo)
+
+	// publish before targets are added
+	configPath := filepath.Join(repo, ".dox.yaml")
+	config, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := strings.Index(string(config), "targets:")
+	targets := string(config[i:])
+	if err := ioutil.WriteFile(configPath, config[:i], 0644); err != nil {
+		t.Fatal(err)
+	}
+	dox(t, repo)
+	guideID := sourceID(t, filepath.Join(repo, "docs/guide.md"))
+	pages := len(srv.Pages())
+
+	config, err = ioutil.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(configPath, append(config, targets...), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first target keeps the pages already published, and only the
+	// public target gets new ones
+	out := dox(t, repo, "plan", "--target", "team")
+	if !strings.Contains(out, "no changes") {
+		t.Errorf("plan for the first target after adding targets:\n%s", out)
+	}
+	dox(t, repo)
+	if got, want := len(srv.Pages()), pages+2; got != want {
+		t.Errorf("publishing to the targets added made %d pages, want %d", got-pages, want-pages)
+	}
+	if got := sourceID(t, filepath.Join(repo, "docs/guide.md")); got != guideID {
+		t.Errorf("guide has ID %s, want %s", got, guideID)
+	}
+}
+
+func TestProjects(t *testing.T) {
+	srv := fakeconfluence.New()
+	defer srv.Close()
+	repo := newRepo(t, "projects.txt", srv)
+	defer os.RemoveAll(repo)
+
+	out := dox(t, repo)
+	for _, want := range []string{"project .\n", "project services/billing\n"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output does not contain %q:\n%s", want, out)
+		}
+	}
+
+	roots := map[string]*fakeconfluence.Page{}
+	for _, p := range srv.Children("") {
+		roots[p.Space] = p
+	}
+	if len(roots) != 2 || roots["DOX"] == nil || roots["BILL"] == nil {
+		t.Fatalf("top level pages are %v, want a root in DOX and BILL", titles(srv.Children("")))
+	}
+
+	// each project publishes only its own sources, under its own root page
+	for space, want := range map[string]string{
+		"DOX":  "Handbook: Guide",
+		"BILL": "Billing: Billing Runbook",
+	} {
+		root := roots[space]
+		if got := root.Title + ": " + strings.Join(titles(srv.Children(root.ID)), ", "); got != want {
+			t.Errorf("pages in %s are %s, want %s", space, got, want)
+		}
+	}
+
+	out = dox(t, repo, "status")
+	if !strings.Contains(out, "excluded   services/billing/: has its own .dox.yaml") {
+		t.Errorf("status does not exclude the nested project from its parent:\n%s", out)
+	}
+
+	// a project is selected by a path in it
+	out = dox(t, repo, "plan", "--project", "services/billing/runbook.md")
+	if !strings.Contains(out, "no changes") || strings.Contains(out, "project") {
+		t.Errorf("plan for billing:\n%s", out)
+	}
+
+	planFile := filepath.Join(repo, "plan.json")
+	if out, err := run(repo, "plan", "-o", planFile); err == nil {
+		t.Errorf("saving a plan for every project did not fail:\n%s", out)
+	}
+
+	runbookPath := filepath.Join(repo, "services/billing/runbook.md")
+	buf, err := ioutil.ReadFile(runbookPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(runbookPath, []byte(strings.Replace(string(buf), "Turn it off and on again.", "Call the vendor.", 1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dox(t, repo, "plan", "--project", "services/billing", "-o", planFile)
+	dox(t, repo, "apply", planFile)
+	runbook := srv.Children(roots["BILL"].ID)[0]
+	if !strings.Contains(runbook.Body, "Call the vendor.") {
+		t.Errorf("applying the billing plan did not update the runbook:\n%s", runbook.Body)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	srv := fakeconfluence.New()
+	defer srv.Close()
+	top := srv.AddPage("DOX", "Engineering Docs", "<p>Start here.</p>", "")
+	landingID := srv.AddPage("DOX", "Services", "<p>Every service we run.</p>", top)
+
+	api := newRepo(t, "api.txt", srv)
+	defer os.RemoveAll(api)
+	web := newRepo(t, "web.txt", srv)
+	defer os.RemoveAll(web)
+
+	dox(t, api)
+	dox(t, web)
+
+	// each repo publishes its root page under the landing page
+	if got := strings.Join(titles(srv.Children(landingID)), ", "); got != "API, Web" {
+		t.Fatalf("children of the landing page are %s, want API, Web", got)
+	}
+	apiID := sourceID(t, filepath.Join(api, "ROOT.md"))
+	webID := sourceID(t, filepath.Join(web, "ROOT.md"))
+
+	// repos indexing at the same time are both listed
+	errs := make(chan error, 2)
+	for _, repo := range []string{api, web} {
+		go func(repo string) {
+			out, err := run(repo, "index")
+			if err != nil {
+				err = fmt.Errorf("%s\n%s", err, out)
+			}
+			errs <- err
+		}(repo)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("dox index: %s", err)
+		}
+	}
+
+	landing := srv.Page(landingID)
+	for _, want := range []string{
+		"<p>Every service we run.</p>",
+		// the repo links to the site of browse_url_base unless index.url is set
+		fmt.Sprintf(`<tr><td><a href="https://git.example.com/docs">api</a></td><td><a href="%s/pages/viewpage.action?pageId=%s">API</a></td></tr>`, srv.URL, apiID),
+		fmt.Sprintf(`<tr><td><a href="https://git.example.com/web">web</a></td><td><a href="%s/pages/viewpage.action?pageId=%s">Web</a></td></tr>`, srv.URL, webID),
+	} {
+		if !strings.Contains(landing.Body, want) {
+			t.Errorf("landing page does not contain %s:\n%s", want, landing.Body)
+		}
+	}
+
+	// indexing again changes nothing
+	version := landing.Version
+	dox(t, api, "index")
+	if v := srv.Page(landingID).Version; v != version {
+		t.Errorf("indexing again updated the landing page to version %d", v)
+	}
+
+	dox(t, web, "index", "--remove")
+	landing = srv.Page(landingID)
+	if strings.Contains(landing.Body, "web") || !strings.Contains(landing.Body, ">API<") {
+		t.Errorf("web was not removed from the landing page:\n%s", landing.Body)
+	}
+	if strings.Count(landing.Body, `ac:name="anchor"`) != 1 {
+		t.Errorf("landing page has more than one index:\n%s", landing.Body)
+	}
+}
+
+func TestLock(t *testing.T) {
+	srv := fakeconfluence.New()
+	defer srv.Close()
+	repo := newRepo(t, "rooted.txt", srv)
+	defer os.RemoveAll(repo)
+
+	dox(t, repo)
+	rootID := sourceID(t, filepath.Join(repo, "ROOT.md"))
+	guidePath := filepath.Join(repo, "guide.md")
+	guideID := sourceID(t, guidePath)
+	buf, err := ioutil.ReadFile(guidePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(guidePath, append(buf, []byte("\nMore to read.\n")...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	version := srv.Page(guideID).Version
+
+	lock := func(owner string, expires time.Time) {
+		srv.SetProperty(rootID, "dox-lock", fmt.Sprintf(
+			`{"owner":%q,"acquired":%q,"ttl":"10m0s","expires":%q}`,
+			owner,
+			time.Now().UTC().Format(time.RFC3339),
+			expires.UTC().Format(time.RFC3339),
+		))
+	}
+
+	// another run holds the lock, so nothing is published
+	lock("ci job 1", time.Now().Add(time.Hour))
+	out, err := run(repo)
+	if err == nil {
+		t.Fatalf("dox published while the root page was locked:\n%s", out)
+	}
+	if !strings.Contains(out, "locked by ci job 1") {
+		t.Errorf("error does not name the holder of the lock:\n%s", out)
+	}
+	if v := srv.Page(guideID).Version; v != version {
+		t.Errorf("guide was updated to version %d while locked", v)
+	}
+
+	// planning does not need the lock
+	dox(t, repo, "--dry-run")
+
+	// the lock expires while waiting for it
+	lock("ci job 2", time.Now().Add(2*time.Second))
+	out = dox(t, repo, "--lock-wait=1m")
+	if !strings.Contains(out, "waiting for the lock held by ci job 2") {
+		t.Errorf("dox did not wait for the lock:\n%s", out)
+	}
+	if body := srv.Page(guideID).Body; !strings.Contains(body, "More to read.") {
+		t.Errorf("guide was not published after waiting for the lock:\n%s", body)
+	}
+
+	// the lock is released once published
+	var held struct {
+		Owner   string    `json:"owner"`
+		Expires time.Time `json:"expires"`
+	}
+	if err := json.Unmarshal(srv.Page(rootID).Properties["dox-lock"], &held); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(held.Owner, "pid") {
+		t.Errorf("lock is owned by %q, want this run", held.Owner)
+	}
+	if held.Expires.After(time.Now()) {
+		t.Errorf("lock is held until %s after publishing", held.Expires)
+	}
+	dox(t, repo)
+}
+
+func TestCredentialHelper(t *testing.T) {
+	srv := fakeconfluence.New()
+	defer srv.Close()
+	repo := newRepo(t, "basic.txt", srv)
+	defer os.RemoveAll(repo)
+
+	dir, err := ioutil.TempDir("", "dox-helper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the helper records each request, and prints the response of the test
+	helper := filepath.Join(dir, "helper")
+	script := "#!/bin/sh\ncat >> \"$(dirname \"$0\")/requests\"\n. \"$(dirname \"$0\")/response\"\n"
+	if err := ioutil.WriteFile(helper, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	netrc := filepath.Join(dir, "netrc")
+	if err := ioutil.WriteFile(netrc, []byte("default login netrc-user password netrc-password\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		response string
+		netrc    string
+		auth     string
+		err      string
+	}{
+		{
+			name: "credentials",
+			// values may have an "=", and what follows a blank line is
+			// not read
+			response: `printf 'protocol=http\nusername=helper-user\npassword=pass=word\nunknown=ignored\n\nusername=other\n'`,
+			auth:     basic("helper-user", "pass=word"),
+		},
+		{
+			name:     "no credentials",
+			response: "",
+			err:      "DOX_USERNAME, auth.username, credential_helper or a netrc login must be set",
+		},
+		{
+			name:     "no credentials with netrc",
+			response: "",
+			netrc:    netrc,
+			auth:     basic("netrc-user", "netrc-password"),
+		},
+		{
+			name:     "partial credentials with netrc",
+			response: "echo username=helper-user",
+			netrc:    netrc,
+			auth:     basic("helper-user", "netrc-password"),
+		},
+		{
+			name:     "quit",
+			response: `printf 'quit=true\n'`,
+			netrc:    netrc,
+			err:      "credential helper quit without credentials for " + u.Host,
+		},
+		{
+			name:     "failure",
+			response: "echo 'no vault' >&2; exit 3",
+			netrc:    netrc,
+			err:      "credential helper failed: exit status 3",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			os.Remove(filepath.Join(dir, "requests"))
+			if err := ioutil.WriteFile(filepath.Join(dir, "response"), []byte(tc.response+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			netrc := tc.netrc
+			if netrc == "" {
+				netrc = filepath.Join(dir, "missing")
+			}
+
+			out, err := runEnv(repo, []string{
+				"DOX_USERNAME=",
+				"DOX_PASSWORD=",
+				"DOX_CREDENTIAL_HELPER=" + helper,
+				"NETRC=" + netrc,
+			})
+			if tc.err != "" {
+				if err == nil || !strings.Contains(out, tc.err) {
+					t.Fatalf("dox returned %v, want %s:\n%s", err, tc.err, out)
+				}
+			} else if err != nil {
+				t.Fatalf("dox: %s\n%s", err, out)
+			} else if got := srv.Authorization(); got != tc.auth {
+				t.Errorf("authorization is %q, want %q", got, tc.auth)
+			}
+			if tc.name == "failure" && !strings.Contains(out, "no vault") {
+				t.Errorf("the error of the helper is not shown:\n%s", out)
+			}
+
+			// the helper is asked once per run, for the host with its port
+			requests, err := ioutil.ReadFile(filepath.Join(dir, "requests"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := fmt.Sprintf("protocol=http\nhost=%s\n\n", u.Host); string(requests) != want {
+				t.Errorf("helper was asked %q, want %q", requests, want)
+			}
+		})
+	}
+}
+
+func basic(username string, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
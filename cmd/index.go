@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jesselang/dox/internal"
+)
+
+var indexRemove bool
+
+var indexCmd = &cobra.Command{
+	Use:   "index",
+	Short: "List the repo on the landing page shared with other repos",
+	Long: `List the repo, with a link to its root page, on the landing page, which is
+the parent page set in config. Every repo publishing under the same parent can
+run dox index, at the same time if need be; changes made by other repos in the
+meantime are kept. With --remove, take the repo off the list.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		err := forEachTarget(func() error {
+			if dox.IsStatic() {
+				// a static site has no landing page to be listed on
+				return nil
+			}
+
+			fs, err := sourcesFs()
+			if err != nil {
+				return err
+			}
+			files, err := dox.FindAll(fs, repoRoot)
+			if err != nil {
+				return err
+			}
+
+			return dox.Index(fs, files, repoRoot, indexRemove, verbose, dryRun)
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	indexCmd.Flags().BoolVar(&indexRemove, "remove", false, "Take the repo off the list")
+	RootCmd.AddCommand(indexCmd)
+}
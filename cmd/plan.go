@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jesselang/dox/internal"
+)
+
+var planOutput string
+
+var planCmd = &cobra.Command{
+	Use:   "plan",
+	Short: "Show the changes publishing would make",
+	Long: `Work out every change publishing would make to the wiki, and print them
+without changing anything. Save the plan with --output to make exactly those
+changes later with dox apply.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if planOutput != "" {
+			selections, err := selections()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error: %s\n", err)
+				os.Exit(1)
+			}
+			if len(selections) > 1 {
+				fmt.Fprintln(os.Stderr, "error: a plan is saved for one target; choose it with --project and --target")
+				os.Exit(1)
+			}
+		}
+
+		err := forEachTarget(func() error {
+			fs, err := sourcesFs()
+			if err != nil {
+				return err
+			}
+			files, err := dox.FindAll(fs, repoRoot)
+			if err != nil {
+				return err
+			}
+
+			if dox.IsStatic() && planOutput == "" {
+				// a static site is rendered anew each time, with no
+				// plan to save
+				return dox.Publish(fs, files, repoRoot, verbose, true)
+			}
+
+			plan, err := dox.MakePlan(fs, files, repoRoot)
+			if err != nil {
+				return err
+			}
+
+			fmt.Print(plan)
+
+			if planOutput != "" {
+				return plan.Write(planOutput)
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	planCmd.Flags().StringVarP(&planOutput, "output", "o", "", "File to save the plan to")
+	RootCmd.AddCommand(planCmd)
+}
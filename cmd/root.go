@@ -14,6 +14,8 @@ import (
 var dryRun bool
 var cfgFile string
 var repoRoot string
+var since string
+var sinceLast bool
 var verbose bool
 
 // RootCmd represents the base command when called without any subcommands
@@ -29,14 +31,26 @@ to quickly create a Cobra application.`,
 	// Uncomment the following line if your bare application
 	// has an action associated with it:
 	Run: func(cmd *cobra.Command, args []string) {
-		fs := afero.NewOsFs()
-		files, err := dox.FindAll(fs, repoRoot)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		if since != "" && sinceLast {
+			fmt.Fprintln(os.Stderr, "error: --since and --since-last cannot be used together")
 			os.Exit(1)
 		}
 
-		err = dox.Publish(files, repoRoot, verbose, dryRun)
+		err := forEachTarget(func() error {
+			fs, err := sourcesFs()
+			if err != nil {
+				return err
+			}
+			files, err := dox.FindAll(fs, repoRoot)
+			if err != nil {
+				return err
+			}
+
+			if since != "" || sinceLast {
+				return dox.PublishSince(fs, files, since, repoRoot, verbose, dryRun)
+			}
+			return dox.Publish(fs, files, repoRoot, verbose, dryRun)
+		})
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "error: %s\n", err)
 			os.Exit(1)
@@ -73,9 +87,27 @@ func init() {
 	RootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.dox.yaml)")
 	RootCmd.PersistentFlags().BoolVarP(&dryRun, "dry-run", "n", false, "Dry-run mode")
 	RootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "Be verbose")
+	RootCmd.PersistentFlags().Bool("prune", false, "Delete pages under the root that were published by dox but have no source")
+	viper.BindPFlag("prune", RootCmd.PersistentFlags().Lookup("prune"))
+	RootCmd.PersistentFlags().String("discover", "walk", "How to find sources: walk the working tree, or list the files tracked by git")
+	viper.BindPFlag("discover", RootCmd.PersistentFlags().Lookup("discover"))
+	RootCmd.PersistentFlags().String("ref", "", "Publish the sources as committed to a git ref, rather than as in the working tree")
+	viper.BindPFlag("ref", RootCmd.PersistentFlags().Lookup("ref"))
+	RootCmd.PersistentFlags().Duration("lock-wait", 0, "How long to wait for another run publishing to the same pages to finish")
+	viper.BindPFlag("lock.wait", RootCmd.PersistentFlags().Lookup("lock-wait"))
+	RootCmd.PersistentFlags().StringVar(&project, "project", "", "Publish the project holding this path (default all projects)")
+	RootCmd.PersistentFlags().StringVar(&target, "target", "", "Publish to the named target in config (default all targets)")
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
 	RootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	RootCmd.Flags().StringVar(&since, "since", "", "Publish only the sources affected by changes since a git ref")
+	RootCmd.Flags().BoolVar(&sinceLast, "since-last", false, "Publish only the sources affected by changes since the last commit published")
+}
+
+// sourcesFs returns the filesystem to read the sources from, which is git
+// rather than the working tree when discovering sources from git.
+func sourcesFs() (afero.Fs, error) {
+	return dox.SourcesFs(afero.NewOsFs(), repoRoot)
 }
 
 // initConfig reads in config file and ENV variables if set.
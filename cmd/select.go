@@ -0,0 +1,167 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/afero"
+
+	"github.com/jesselang/dox/internal"
+)
+
+var project string
+var target string
+
+// selection is a project, and one of its targets, to work with.
+type selection struct {
+	project dox.Project
+	target  string
+	// label names the selection, when there is more than one
+	label string
+}
+
+// projects returns the project selected with --project, or every project in
+// the repo. A config given with --config is used as the only project.
+func projects() ([]dox.Project, error) {
+	if cfgFile != "" {
+		if project != "" {
+			return nil, errors.New("--project cannot be used with --config")
+		}
+		return []dox.Project{{}}, nil
+	}
+
+	all, err := dox.FindProjects(afero.NewOsFs(), repoRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(all) == 0 {
+		if project != "" {
+			return nil, errors.New("no projects in repo")
+		}
+		return []dox.Project{{}}, nil
+	}
+
+	if project == "" {
+		return all, nil
+	}
+
+	p, err := dox.ProjectOf(all, project)
+	if err != nil {
+		return nil, err
+	}
+
+	return []dox.Project{p}, nil
+}
+
+// selections returns every target of every project selected with --project
+// and --target.
+func selections() ([]selection, error) {
+	projects, err := projects()
+	if err != nil {
+		return nil, err
+	}
+
+	var selections []selection
+	for _, p := range projects {
+		restore, err := dox.UseProject(p)
+		if err != nil {
+			return nil, err
+		}
+		names, err := dox.Targets(target)
+		restore()
+		if err != nil {
+			if len(projects) > 1 {
+				return nil, fmt.Errorf("project %s: %s", p.Path, err)
+			}
+			return nil, err
+		}
+
+		for _, name := range names {
+			var label []string
+			if len(projects) > 1 {
+				label = append(label, "project "+p.Path)
+			}
+			if len(names) > 1 {
+				label = append(label, "target "+name)
+			}
+			selections = append(selections, selection{
+				project: p,
+				target:  name,
+				label:   strings.Join(label, ", "),
+			})
+		}
+	}
+
+	return selections, nil
+}
+
+// use overlays the config of the selection on the config in use, until the
+// returned function is called.
+func (s selection) use() (func(), error) {
+	restoreProject, err := dox.UseProject(s.project)
+	if err != nil {
+		return nil, err
+	}
+
+	restoreTarget, err := dox.UseTarget(s.target)
+	if err != nil {
+		restoreProject()
+		return nil, err
+	}
+
+	return func() {
+		restoreTarget()
+		restoreProject()
+	}, nil
+}
+
+// forEachTarget calls fn with the config of each target of each project
+// selected in turn, stopping at the first error.
+func forEachTarget(fn func() error) error {
+	selections, err := selections()
+	if err != nil {
+		return err
+	}
+
+	for _, s := range selections {
+		if s.label != "" {
+			fmt.Println(s.label)
+		}
+
+		restore, err := s.use()
+		if err != nil {
+			return err
+		}
+		err = fn()
+		restore()
+		if err != nil {
+			if s.label != "" {
+				return fmt.Errorf("%s: %s", s.label, err)
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// useTarget overlays the config of the project and target selected with
+// --project and --target for commands that work with a single wiki. Without
+// either, the config is used as it is.
+func useTarget() (func(), error) {
+	if project == "" && target == "" {
+		return func() {}, nil
+	}
+
+	selections, err := selections()
+	if err != nil {
+		return nil, err
+	}
+	if len(selections) > 1 {
+		return nil, fmt.Errorf("%d targets are selected; choose one with --project and --target", len(selections))
+	}
+
+	return selections[0].use()
+}
@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+
+	"github.com/jesselang/dox/internal"
+)
+
+var serveAddr string
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Preview pages locally as they would be published",
+	Long: `Start a local HTTP server that renders each source the way dox would
+publish it, with a stylesheet approximating Confluence. Open pages reload
+automatically when files in the repo change.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		restore, err := useTarget()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			os.Exit(1)
+		}
+		defer restore()
+
+		err = dox.Serve(afero.NewOsFs(), repoRoot, serveAddr, verbose)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	serveCmd.Flags().StringVar(&serveAddr, "addr", "localhost:8080", "Address to listen on")
+	RootCmd.AddCommand(serveCmd)
+}
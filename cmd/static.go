@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/jesselang/dox/internal"
+)
+
+var staticCmd = &cobra.Command{
+	Use:   "static",
+	Short: "Render the docs as a static HTML site",
+	Long: `Render every source to an HTML file, mirroring the layout of the repo, with
+the root page as index.html. Images and linked files are copied, and relative
+links are changed to point at the generated pages.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		restore, err := useTarget()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			os.Exit(1)
+		}
+		defer restore()
+
+		fs, err := sourcesFs()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			os.Exit(1)
+		}
+		files, err := dox.FindAll(fs, repoRoot)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			os.Exit(1)
+		}
+
+		// a directory given on the command line is relative to where dox
+		// runs, while the default and config are relative to the repo
+		output := viper.GetString("static.output")
+		if cmd.Flags().Changed("output") {
+			output, err = filepath.Abs(output)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error: %s\n", err)
+				os.Exit(1)
+			}
+		}
+
+		err = dox.BuildStatic(fs, files, repoRoot, output, verbose)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	viper.SetDefault("static.output", "site")
+
+	staticCmd.Flags().StringP("output", "o", "", "Directory to write the site to (default site in the repo root)")
+	viper.BindPFlag("static.output", staticCmd.Flags().Lookup("output"))
+	RootCmd.AddCommand(staticCmd)
+}
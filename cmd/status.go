@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jesselang/dox/internal"
+)
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show which files are published, and why others are not",
+	Long: `List every source in the repo as published, with its page ID, or new. Files
+left out are listed as ignored, by the ignore directive, or excluded, with the
+pattern of .gitignore, .doxignore or config that excludes them. Excluded
+directories are listed once, rather than each file in them.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		err := forEachTarget(func() error {
+			fs, err := sourcesFs()
+			if err != nil {
+				return err
+			}
+			statuses, err := dox.Status(fs, repoRoot)
+			if err != nil {
+				return err
+			}
+
+			for _, s := range statuses {
+				fmt.Println(s)
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(statusCmd)
+}
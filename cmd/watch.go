@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+
+	"github.com/jesselang/dox/internal"
+)
+
+var watchCmd = &cobra.Command{
+	Use:   "watch",
+	Short: "Republish sources as they change",
+	Long: `Watch the repo for changes and republish the sources that changed, along
+with any sources that link to or embed the changed files.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		restore, err := useTarget()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			os.Exit(1)
+		}
+		defer restore()
+
+		err = dox.Watch(afero.NewOsFs(), repoRoot, verbose, dryRun)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(watchCmd)
+}
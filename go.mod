@@ -4,6 +4,7 @@ go 1.13
 
 require (
 	github.com/BurntSushi/toml v0.3.1 // indirect
+	github.com/fsnotify/fsnotify v1.4.7
 	github.com/inconshreveable/mousetrap v1.0.0 // indirect
 	github.com/jesselang/go-confluence v0.0.0-20181206001147-a8c884503307
 	github.com/russross/blackfriday v2.0.0+incompatible
@@ -13,4 +14,5 @@ require (
 	github.com/spf13/viper v1.2.1
 	github.com/stretchr/testify v1.5.1 // indirect
 	golang.org/x/net v0.0.0-20181207154023-610586996380
+	gopkg.in/yaml.v2 v2.2.2
 )
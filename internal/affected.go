@@ -0,0 +1,77 @@
+package dox
+
+import (
+	"net/url"
+	"path/filepath"
+
+	"github.com/jesselang/dox/internal/source"
+)
+
+// getLocalReferences returns the paths of every file the content links to or
+// embeds relative to file, whether or not that file exists.
+func getLocalReferences(content string, file string) ([]string, error) {
+	fileDir := filepath.Dir(file)
+
+	anchorHrefs, err := getAnchorHrefsFromHTML(content)
+	if err != nil {
+		return nil, err
+	}
+
+	imageSrcs, err := getImageSrcsFromHTML(content)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, ref := range append(anchorHrefs, imageSrcs...) {
+		// skip refs that are URLs
+		if _, err := url.ParseRequestURI(ref); err == nil {
+			continue
+		}
+
+		ref, _ = splitFragment(ref)
+		if ref == "" {
+			continue
+		}
+
+		paths = append(paths, filepath.Join(fileDir, ref))
+	}
+
+	return paths, nil
+}
+
+// affectedSources returns the sources that must be republished when the
+// changed files are modified, created or deleted: the changed sources
+// themselves plus any source that links to or embeds a changed file.
+func affectedSources(sources []source.Source, changed []string) ([]source.Source, error) {
+	changedSet := map[string]bool{}
+	for _, file := range changed {
+		changedSet[filepath.Clean(file)] = true
+	}
+
+	var affected []source.Source
+	for _, src := range sources {
+		if src.File() == "" {
+			continue
+		}
+
+		if changedSet[src.File()] {
+			affected = append(affected, src)
+			continue
+		}
+
+		refs, err := getLocalReferences(src.Output(), src.File())
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ref := range refs {
+			if changedSet[ref] {
+				affected = append(affected, src)
+				break
+			}
+		}
+	}
+
+	return affected, nil
+}
@@ -0,0 +1,216 @@
+package dox
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/jesselang/dox/internal/backend"
+	"github.com/jesselang/dox/internal/source"
+	"github.com/spf13/afero"
+)
+
+// applier makes the changes in a plan.
+type applier struct {
+	fs       afero.Fs
+	b        backend.Backend
+	repoRoot string
+	verbose  bool
+
+	// ids maps the pending IDs of the plan to the IDs of the pages created
+	ids map[string]string
+}
+
+// ApplyPlan makes exactly the changes in plan, which must have been made for
+// the wiki in config. Nothing is changed if any page has been changed since
+// the plan was made. The plan is applied holding the lock on its root page.
+func ApplyPlan(fs afero.Fs, plan *Plan, repoRoot string, verbose bool) error {
+	err := getConfigVars()
+	if err != nil {
+		return err
+	}
+
+	if plan.URI != uri || plan.Space != space {
+		return fmt.Errorf("plan is for space %s at %s, not space %s at %s", plan.Space, plan.URI, space, uri)
+	}
+
+	b, err := newBackend(fs)
+	if err != nil {
+		return err
+	}
+
+	return withLock(b, plan.LockID, verbose, func(ctx context.Context) error {
+		return applyPlan(ctx, fs, b, plan, repoRoot, verbose)
+	})
+}
+
+// applyPlan makes the changes in plan, stopping before the next change once
+// ctx is cancelled.
+func applyPlan(ctx context.Context, fs afero.Fs, b backend.Backend, plan *Plan, repoRoot string, verbose bool) error {
+	if err := checkCreates(fs, plan, repoRoot); err != nil {
+		return err
+	}
+	if err := checkVersions(b, plan); err != nil {
+		return err
+	}
+
+	a := &applier{
+		fs:       fs,
+		b:        b,
+		repoRoot: repoRoot,
+		verbose:  verbose,
+		ids:      map[string]string{},
+	}
+
+	for _, op := range plan.Operations {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := a.apply(op); err != nil {
+			return fmt.Errorf("%s: %s", op, err)
+		}
+		if verbose {
+			fmt.Println(a.substitute(op.String()))
+		}
+	}
+
+	return nil
+}
+
+// checkCreates returns an error if a page the plan creates has been created
+// since the plan was made, such as by applying it already.
+func checkCreates(fs afero.Fs, plan *Plan, repoRoot string) error {
+	for _, op := range plan.Operations {
+		if op.Op != OpCreate {
+			continue
+		}
+
+		src, err := opSource(fs, op, repoRoot)
+		if err != nil {
+			return err
+		}
+		if src.ID() != "" {
+			return fmt.Errorf("%q was created as page %s since the plan was made; make a new plan", op.Title, src.ID())
+		}
+	}
+
+	return nil
+}
+
+// checkVersions returns an error if any page in the plan is not at the
+// version it was planned from.
+func checkVersions(b backend.Backend, plan *Plan) error {
+	var stale []string
+	checked := map[string]bool{}
+	for _, op := range plan.Operations {
+		if op.Version == 0 || isPendingID(op.PageID) || checked[op.PageID] {
+			continue
+		}
+		// only the first operation on a page is planned from its current
+		// version; later ones follow from the earlier changes
+		checked[op.PageID] = true
+
+		page, err := b.GetPage(op.PageID)
+		if err != nil {
+			return err
+		}
+		if page.Version != op.Version {
+			stale = append(stale, fmt.Sprintf(
+				"%q (%s) is at version %d, planned from version %d",
+				page.Title,
+				page.ID,
+				page.Version,
+				op.Version,
+			))
+		}
+	}
+
+	if len(stale) > 0 {
+		return fmt.Errorf(
+			"pages changed since the plan was made; make a new plan:\n  %s",
+			strings.Join(stale, "\n  "),
+		)
+	}
+
+	return nil
+}
+
+func (a *applier) apply(op Operation) error {
+	id := a.substitute(op.PageID)
+
+	switch op.Op {
+	case OpCreate:
+		return a.create(op)
+	case OpMove:
+		return a.b.MovePage(id, a.substitute(op.ParentID))
+	case OpUpload:
+		_, err := a.b.UploadAttachment(id, filepath.Join(a.repoRoot, filepath.FromSlash(op.File)))
+		return err
+	case OpUpdate:
+		_, err := a.b.UpdatePage(&backend.Page{
+			ID:       id,
+			Title:    op.Title,
+			Body:     a.substitute(op.Body),
+			Version:  op.Version + 1,
+			ParentID: a.substitute(op.ParentID),
+			Message:  op.Message,
+		})
+		if err != nil {
+			return err
+		}
+		// marks pages published before they were marked when created
+		return markPublishedByDox(a.b, id, op.Source)
+	case OpLabel:
+		return a.label(id, op)
+	case OpPrune:
+		return a.b.DeletePage(id)
+	default:
+		return fmt.Errorf("unknown operation %q", op.Op)
+	}
+}
+
+// create creates the page of a source and records its ID in the source.
+func (a *applier) create(op Operation) error {
+	src, err := opSource(a.fs, op, a.repoRoot)
+	if err != nil {
+		return err
+	}
+
+	page, err := a.b.CreatePage(&backend.Page{
+		Title:    op.Title,
+		Body:     stubBody,
+		ParentID: a.substitute(op.ParentID),
+	})
+	if err != nil {
+		// TODO: confluence does not support duplicate title in a space
+		return err
+	}
+	a.ids[op.PageID] = page.ID
+
+	if err := src.SetID(page.ID); err != nil {
+		return err
+	}
+
+	return markPublishedByDox(a.b, page.ID, op.Source)
+}
+
+// opSource returns the source of the page an operation is for.
+func opSource(fs afero.Fs, op Operation, repoRoot string) (source.Source, error) {
+	file := ""
+	if op.Source != "" {
+		file = filepath.Join(repoRoot, filepath.FromSlash(op.Source))
+	}
+
+	return source.New(file, sourceOpts(fs))
+}
+
+// substitute replaces the pending IDs in s with the IDs of the pages created
+// for them.
+func (a *applier) substitute(s string) string {
+	for pending, id := range a.ids {
+		s = strings.Replace(s, pending, id, -1)
+	}
+
+	return s
+}
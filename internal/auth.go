@@ -0,0 +1,331 @@
+package dox
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// supported values of auth.type in config
+const (
+	authBasic  = "basic"
+	authBearer = "bearer"
+	authOAuth2 = "oauth2"
+)
+
+// authorizer adds credentials to a request.
+type authorizer interface {
+	authorize(req *http.Request) error
+}
+
+type basicAuth struct {
+	username string
+	password string
+}
+
+func (a *basicAuth) authorize(req *http.Request) error {
+	req.SetBasicAuth(a.username, a.password)
+	return nil
+}
+
+type bearerAuth struct {
+	token string
+}
+
+func (a *bearerAuth) authorize(req *http.Request) error {
+	req.Header.Set("Authorization", "Bearer "+a.token)
+	return nil
+}
+
+// oauth2Auth uses the OAuth 2.0 client credentials grant, requesting a new
+// access token shortly before the current one expires.
+type oauth2Auth struct {
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	scopes       []string
+	client       *http.Client
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func (a *oauth2Auth) authorize(req *http.Request) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.token == "" || time.Now().After(a.expiry.Add(-time.Minute)) {
+		if err := a.refresh(); err != nil {
+			return err
+		}
+	}
+
+	req.Header.Set("Authorization", "Bearer "+a.token)
+	return nil
+}
+
+func (a *oauth2Auth) refresh() error {
+	data := url.Values{}
+	data.Set("grant_type", "client_credentials")
+	data.Set("client_id", a.clientID)
+	data.Set("client_secret", a.clientSecret)
+	if len(a.scopes) > 0 {
+		data.Set("scope", strings.Join(a.scopes, " "))
+	}
+
+	resp, err := a.client.PostForm(a.tokenURL, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("could not get OAuth 2.0 access token: %s", resp.Status)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return err
+	}
+	if token.AccessToken == "" {
+		return errors.New("OAuth 2.0 token response did not include an access token")
+	}
+
+	a.token = token.AccessToken
+	a.expiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+
+	return nil
+}
+
+// authTransport authorizes every request made through it, including those
+// made by go-confluence, which always sets basic auth itself.
+type authTransport struct {
+	base http.RoundTripper
+	auth authorizer
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// a RoundTripper must not modify the request it was given, so the
+	// request and its headers are copied; Request.Clone needs Go 1.13
+	r2 := new(http.Request)
+	*r2 = *req
+	r2.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		r2.Header[k] = append([]string(nil), v...)
+	}
+	req = r2
+	if err := t.auth.authorize(req); err != nil {
+		return nil, err
+	}
+
+	return t.base.RoundTrip(req)
+}
+
+// credentialLookup finds credentials for a host that are not set in the
+// environment or config, first with the credential helper, then in netrc.
+// Each is only consulted if needed.
+type credentialLookup struct {
+	protocol string
+	// host is given to the credential helper with the port, as git does,
+	// while netrc entries are matched by hostname alone
+	host     string
+	hostname string
+
+	helper *credentials
+	netrc  *netrcEntry
+}
+
+func (l *credentialLookup) lookup() error {
+	if l.helper != nil || l.netrc != nil {
+		return nil
+	}
+
+	if helper := viper.GetString("credential_helper"); helper != "" {
+		c, err := getHelperCredentials(helper, l.protocol, l.host)
+		if err != nil {
+			return err
+		}
+		l.helper = c
+	} else {
+		l.helper = &credentials{}
+	}
+
+	netrcFile := viper.GetString("auth.netrc")
+	if netrcFile == "" {
+		netrcFile = netrcPath()
+	}
+	netrc, err := getNetrcEntry(netrcFile, l.hostname)
+	if err != nil {
+		return err
+	}
+	if netrc == nil {
+		netrc = &netrcEntry{}
+	}
+	l.netrc = netrc
+
+	return nil
+}
+
+// login returns the username or client ID for the host.
+func (l *credentialLookup) login() (string, error) {
+	if err := l.lookup(); err != nil {
+		return "", err
+	}
+
+	if l.helper.username != "" {
+		return l.helper.username, nil
+	}
+
+	return l.netrc.login, nil
+}
+
+// secret returns a function returning the password, token or client secret
+// for the host, as used by auth of type authType. From the credential helper,
+// bearer auth takes the token and other auth the password, each falling back
+// to the other if the helper printed only one.
+func (l *credentialLookup) secret(authType string) func() (string, error) {
+	return func() (string, error) {
+		if err := l.lookup(); err != nil {
+			return "", err
+		}
+
+		first, second := l.helper.password, l.helper.token
+		if authType == authBearer {
+			first, second = second, first
+		}
+		if first != "" {
+			return first, nil
+		}
+		if second != "" {
+			return second, nil
+		}
+
+		return l.netrc.password, nil
+	}
+}
+
+// getAuthorizer builds an authorizer for uri from the auth section of the
+// config. Each credential is read from the environment, the config, the
+// credential helper, or the netrc entry for the host of uri, in that order.
+// Any requests needed to obtain credentials are made with client.
+func getAuthorizer(uri string, client *http.Client) (authorizer, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &credentialLookup{protocol: u.Scheme, host: u.Host, hostname: u.Hostname()}
+
+	authType := viper.GetString("auth.type")
+	if authType == "" {
+		authType = authBasic
+	}
+
+	switch authType {
+	case authBasic:
+		// Confluence Cloud uses basic auth with an email address and an
+		// API token as the password.
+		username, err := getCredential("DOX_USERNAME", "auth.username", "", l.login)
+		if err != nil {
+			return nil, err
+		}
+		password, err := getCredential("DOX_PASSWORD", "", "auth.password_file", l.secret(authType))
+		if err != nil {
+			return nil, err
+		}
+		if username == "" {
+			return nil, errors.New("DOX_USERNAME, auth.username, credential_helper or a netrc login must be set")
+		}
+		if password == "" {
+			return nil, errors.New("DOX_PASSWORD, auth.password_file, credential_helper or a netrc password must be set")
+		}
+
+		return &basicAuth{username: username, password: password}, nil
+	case authBearer:
+		// personal access tokens for Confluence Server and Data Center
+		token, err := getCredential("DOX_TOKEN", "", "auth.token_file", l.secret(authType))
+		if err != nil {
+			return nil, err
+		}
+		if token == "" {
+			return nil, errors.New("DOX_TOKEN, auth.token_file, credential_helper or a netrc password must be set")
+		}
+
+		return &bearerAuth{token: token}, nil
+	case authOAuth2:
+		tokenURL := viper.GetString("auth.token_url")
+		if tokenURL == "" {
+			return nil, errors.New("auth.token_url must be set in config")
+		}
+		clientID, err := getCredential("DOX_CLIENT_ID", "auth.client_id", "", l.login)
+		if err != nil {
+			return nil, err
+		}
+		clientSecret, err := getCredential("DOX_CLIENT_SECRET", "", "auth.client_secret_file", l.secret(authType))
+		if err != nil {
+			return nil, err
+		}
+		if clientID == "" {
+			return nil, errors.New("DOX_CLIENT_ID, auth.client_id, credential_helper or a netrc login must be set")
+		}
+		if clientSecret == "" {
+			return nil, errors.New("DOX_CLIENT_SECRET, auth.client_secret_file, credential_helper or a netrc password must be set")
+		}
+
+		return &oauth2Auth{
+			tokenURL:     tokenURL,
+			clientID:     clientID,
+			clientSecret: clientSecret,
+			scopes:       viper.GetStringSlice("auth.scopes"),
+			client:       client,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported auth.type %q; use %s, %s or %s", authType, authBasic, authBearer, authOAuth2)
+}
+
+// getCredential returns the first value found in the environment variable
+// env, the config key key, the file named by the config key fileKey, or
+// returned by fallback. Empty names are skipped.
+func getCredential(env string, key string, fileKey string, fallback func() (string, error)) (string, error) {
+	if env != "" {
+		if value := os.Getenv(env); value != "" {
+			return value, nil
+		}
+	}
+
+	if key != "" {
+		if value := viper.GetString(key); value != "" {
+			return value, nil
+		}
+	}
+
+	if fileKey != "" {
+		if file := viper.GetString(fileKey); file != "" {
+			buf, err := ioutil.ReadFile(file)
+			if err != nil {
+				return "", err
+			}
+			return strings.TrimSpace(string(buf)), nil
+		}
+	}
+
+	return fallback()
+}
@@ -0,0 +1,187 @@
+//go:build !windows
+// +build !windows
+
+package dox_test
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jesselang/dox/internal"
+	"github.com/spf13/viper"
+)
+
+func basic(username string, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+func TestAuthorization(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dox-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"password": "from-file\n",
+		"token":    "token-from-file\n",
+		"netrc":    "default login netrc-user password netrc-secret\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a helper printing every credential, and one printing only a password
+	helper := `printf 'username=helper-user\npassword=helper-password\ntoken=helper-token\n'`
+	passwordHelper := `printf 'username=helper-user\npassword=helper-password\n'`
+
+	// the OAuth 2.0 token endpoint returns the client credentials it was
+	// given as the access token
+	tokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"access_token": "%s:%s", "expires_in": 3600}`, r.FormValue("client_id"), r.FormValue("client_secret"))
+	}))
+	defer tokens.Close()
+
+	envs := []string{"DOX_USERNAME", "DOX_PASSWORD", "DOX_TOKEN", "DOX_CLIENT_ID", "DOX_CLIENT_SECRET", "NETRC"}
+	for _, env := range envs {
+		defer os.Setenv(env, os.Getenv(env))
+		os.Unsetenv(env)
+	}
+	defer viper.Reset()
+
+	for i, tc := range []struct {
+		name   string
+		env    map[string]string
+		config map[string]interface{}
+		want   string
+		err    string
+	}{
+		{
+			name: "basic from the environment",
+			env:  map[string]string{"DOX_USERNAME": "env-user", "DOX_PASSWORD": "env-password"},
+			config: map[string]interface{}{
+				"auth.username": "config-user", "auth.password_file": filepath.Join(dir, "password"),
+				"credential_helper": helper,
+			},
+			want: basic("env-user", "env-password"),
+		},
+		{
+			name:   "basic from config",
+			config: map[string]interface{}{"auth.username": "config-user", "auth.password_file": filepath.Join(dir, "password"), "credential_helper": helper},
+			want:   basic("config-user", "from-file"),
+		},
+		{
+			name:   "basic from the helper takes the password",
+			config: map[string]interface{}{"credential_helper": helper},
+			want:   basic("helper-user", "helper-password"),
+		},
+		{
+			name:   "basic from a helper printing only a token",
+			config: map[string]interface{}{"credential_helper": `printf 'username=helper-user\ntoken=helper-token\n'`},
+			want:   basic("helper-user", "helper-token"),
+		},
+		{
+			name:   "basic from netrc",
+			config: map[string]interface{}{"auth.netrc": filepath.Join(dir, "netrc")},
+			want:   basic("netrc-user", "netrc-secret"),
+		},
+		{
+			name:   "basic from the helper and netrc",
+			env:    map[string]string{"DOX_USERNAME": "env-user"},
+			config: map[string]interface{}{"credential_helper": `printf 'username=helper-user\n'`, "auth.netrc": filepath.Join(dir, "netrc")},
+			want:   basic("env-user", "netrc-secret"),
+		},
+		{
+			name:   "basic without a password",
+			env:    map[string]string{"DOX_USERNAME": "env-user"},
+			config: map[string]interface{}{"auth.netrc": filepath.Join(dir, "missing")},
+			err:    "DOX_PASSWORD, auth.password_file, credential_helper or a netrc password must be set",
+		},
+		{
+			name:   "bearer from the environment",
+			env:    map[string]string{"DOX_TOKEN": "env-token"},
+			config: map[string]interface{}{"auth.type": "bearer", "auth.token_file": filepath.Join(dir, "token")},
+			want:   "Bearer env-token",
+		},
+		{
+			name:   "bearer from config",
+			config: map[string]interface{}{"auth.type": "bearer", "auth.token_file": filepath.Join(dir, "token"), "credential_helper": helper},
+			want:   "Bearer token-from-file",
+		},
+		{
+			name:   "bearer from the helper takes the token",
+			config: map[string]interface{}{"auth.type": "bearer", "credential_helper": helper},
+			want:   "Bearer helper-token",
+		},
+		{
+			name:   "bearer from a helper printing only a password",
+			config: map[string]interface{}{"auth.type": "bearer", "credential_helper": passwordHelper},
+			want:   "Bearer helper-password",
+		},
+		{
+			name:   "bearer from netrc",
+			config: map[string]interface{}{"auth.type": "bearer", "auth.netrc": filepath.Join(dir, "netrc")},
+			want:   "Bearer netrc-secret",
+		},
+		{
+			name:   "bearer without a token",
+			config: map[string]interface{}{"auth.type": "bearer", "auth.netrc": filepath.Join(dir, "missing")},
+			err:    "DOX_TOKEN, auth.token_file, credential_helper or a netrc password must be set",
+		},
+		{
+			name:   "oauth2 from the helper takes the password",
+			config: map[string]interface{}{"auth.type": "oauth2", "auth.token_url": tokens.URL, "credential_helper": helper},
+			want:   "Bearer helper-user:helper-password",
+		},
+		{
+			name:   "oauth2 from the environment and netrc",
+			env:    map[string]string{"DOX_CLIENT_ID": "env-client"},
+			config: map[string]interface{}{"auth.type": "oauth2", "auth.token_url": tokens.URL, "auth.netrc": filepath.Join(dir, "netrc")},
+			want:   "Bearer env-client:netrc-secret",
+		},
+		{
+			name:   "oauth2 without a token URL",
+			config: map[string]interface{}{"auth.type": "oauth2", "credential_helper": helper},
+			err:    "auth.token_url must be set in config",
+		},
+		{
+			name:   "unsupported type",
+			config: map[string]interface{}{"auth.type": "digest"},
+			err:    `unsupported auth.type "digest"; use basic, bearer or oauth2`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			viper.Reset()
+			for key, value := range tc.config {
+				viper.Set(key, value)
+			}
+			for env, value := range tc.env {
+				os.Setenv(env, value)
+				defer os.Unsetenv(env)
+			}
+
+			// credentials from the helper are cached by host
+			uri := fmt.Sprintf("https://wiki-%d.example.com", i)
+			got, err := dox.Authorization(uri, tokens.Client())
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("error is %v, want %s", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("authorization is %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// Page is a page as stored by a backend.
+type Page struct {
+	ID       string
+	Title    string
+	Body     string
+	Version  int
+	ParentID string
+	// Message describes the change in the version history of the page when
+	// it is updated. It is not returned by GetPage.
+	Message string
+}
+
+// Property is a piece of JSON stored with a page, out of sight of readers.
+type Property struct {
+	Key   string
+	Value json.RawMessage
+	// Version is incremented each time the property is changed, and is 0 for
+	// a property that has not been stored yet.
+	Version int
+}
+
+type Opts struct {
+	URI   string
+	Space string
+	// API selects the Confluence REST API: "v1" for Server and Data Center,
+	// "v2" for Cloud, or "auto" to use v2 for Atlassian Cloud sites.
+	API string
+	// Client is used for every request to the backend, and takes care of
+	// authorization.
+	Client *http.Client
+	// Fs is the filesystem attachments are uploaded from, which is the OS
+	// filesystem if nil.
+	Fs afero.Fs
+}
+
+// Backend is a place dox publishes pages to.
+type Backend interface {
+	// GetPage returns the page with the given ID, including its body and
+	// current version.
+	GetPage(id string) (*Page, error)
+	// CreatePage creates a page, returning it with its new ID.
+	CreatePage(page *Page) (*Page, error)
+	// UpdatePage replaces the title and body of a page. The version of page
+	// must be the next version of the page, and ErrConflict is returned if
+	// the page has been changed by someone else in the meantime.
+	UpdatePage(page *Page) (*Page, error)
+	// MovePage makes the page a child of parentID.
+	MovePage(id string, parentID string) error
+	// DeletePage removes the page.
+	DeletePage(id string) error
+	// GetChildren returns the pages that are children of the page, including
+	// their bodies and current versions.
+	GetChildren(id string) ([]*Page, error)
+	// FindPage returns the page of the space with the given title, or nil if
+	// there is no such page. Titles are unique within a space.
+	FindPage(title string) (*Page, error)
+	// UploadAttachment attaches the file at path to the page, replacing an
+	// attachment with the same name if its contents differ, and returns the
+	// URL of the attachment.
+	UploadAttachment(pageID string, path string) (string, error)
+	// GetAttachment returns the contents of the attachment of the page with
+	// the given name, or nil if there is no such attachment.
+	GetAttachment(pageID string, filename string) ([]byte, error)
+	// AttachmentURL returns the URL an attachment of the page with the given
+	// name has, or will have once it is uploaded.
+	AttachmentURL(pageID string, filename string) string
+	// GetLabels returns the labels of the page.
+	GetLabels(pageID string) ([]string, error)
+	// SetLabels changes the labels of the page to exactly labels.
+	SetLabels(pageID string, labels []string) error
+	// GetProperty returns the property of the page with the given key, or nil
+	// if there is no such property.
+	GetProperty(pageID string, key string) (*Property, error)
+	// SetProperty stores a property of the page. The version of property must
+	// be its current version, or 0 to create it, and ErrConflict is returned
+	// if it has been changed or created by someone else in the meantime.
+	SetProperty(pageID string, property *Property) (*Property, error)
+	// DeleteProperty removes the property of the page with the given key.
+	DeleteProperty(pageID string, key string) error
+	// PageURL returns the URL of the page for use in links.
+	PageURL(id string) string
+}
+
+// Factory creates a backend.
+type Factory func(opts Opts) (Backend, error)
+
+var factories = map[string]Factory{
+	"confluence": newConfluence,
+}
+
+// Register makes a backend available by name, replacing any backend already
+// registered with that name.
+func Register(name string, factory Factory) {
+	factories[name] = factory
+}
+
+func New(name string, opts Opts) (Backend, error) {
+	factory, ok := factories[name]
+	if !ok {
+		var names []string
+		for n := range factories {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+
+		return nil, fmt.Errorf(
+			"unsupported backend %q; use one of %s",
+			name,
+			strings.Join(names, ", "),
+		)
+	}
+
+	return factory(opts)
+}
+
+// ErrConflict is returned when a change is rejected because the thing being
+// changed is not at the version the change was based on.
+var ErrConflict = errors.New("changed by someone else")
+
+// StatusError is returned when a backend responds to a request with an
+// error status.
+type StatusError struct {
+	Method     string
+	URL        string
+	Status     string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.Method, e.URL, e.Status)
+}
@@ -0,0 +1,524 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/jesselang/go-confluence"
+	"github.com/spf13/afero"
+)
+
+// confluenceBackend publishes to Confluence Server using the v1 REST API.
+// go-confluence is used where it supports an operation, and requests are
+// made directly otherwise.
+type confluenceBackend struct {
+	uri    string
+	space  string
+	client *http.Client
+	fs     afero.Fs
+	wiki   *confluence.Wiki
+}
+
+func newConfluence(opts Opts) (Backend, error) {
+	useV2, err := useCloudAPI(opts)
+	if err != nil {
+		return nil, err
+	}
+	if useV2 {
+		return newConfluenceCloud(opts)
+	}
+
+	return newConfluenceServer(opts)
+}
+
+// useCloudAPI reports whether the v2 REST API, which is only available in
+// Confluence Cloud, should be used.
+func useCloudAPI(opts Opts) (bool, error) {
+	switch opts.API {
+	case "v1":
+		return false, nil
+	case "v2":
+		return true, nil
+	case "", "auto":
+		u, err := url.Parse(opts.URI)
+		if err != nil {
+			return false, err
+		}
+		return strings.HasSuffix(u.Hostname(), ".atlassian.net"), nil
+	default:
+		return false, fmt.Errorf("unsupported api %q; use one of v1, v2, auto", opts.API)
+	}
+}
+
+func newConfluenceServer(opts Opts) (*confluenceBackend, error) {
+	// go-confluence requires credentials, but they are replaced by those
+	// added by opts.Client
+	wiki, err := confluence.NewWiki(opts.URI, confluence.BasicAuth("", ""))
+	if err != nil {
+		return nil, err
+	}
+	wiki.SetClient(opts.Client)
+
+	fs := opts.Fs
+	if fs == nil {
+		fs = afero.NewOsFs()
+	}
+
+	return &confluenceBackend{
+		uri:    strings.TrimSuffix(opts.URI, "/"),
+		space:  opts.Space,
+		client: opts.Client,
+		fs:     fs,
+		wiki:   wiki,
+	}, nil
+}
+
+func (b *confluenceBackend) GetPage(id string) (*Page, error) {
+	c, err := b.wiki.GetContent(id, []string{"body.storage", "space", "version", "ancestors"})
+	if err != nil {
+		return nil, err
+	}
+
+	return pageFromContent(c), nil
+}
+
+func (b *confluenceBackend) CreatePage(page *Page) (*Page, error) {
+	c := &confluence.Content{
+		Type:  "page",
+		Title: page.Title,
+	}
+
+	if page.ParentID != "" {
+		c.Ancestors = []confluence.ContentAncestor{{ID: page.ParentID}}
+	}
+	c.Body.Storage.Value = page.Body
+	c.Body.Storage.Representation = "storage"
+	c.Space.Key = b.space
+	c.Version.Number = 1
+
+	c, err := b.wiki.CreateContent(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return pageFromContent(c), nil
+}
+
+// confluenceUpdate is the body of a request to update a page. It is sent
+// directly, rather than with go-confluence, which has no version message.
+type confluenceUpdate struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Title   string `json:"title"`
+	Version struct {
+		Number  int    `json:"number"`
+		Message string `json:"message,omitempty"`
+	} `json:"version"`
+	Ancestors []confluence.ContentAncestor `json:"ancestors,omitempty"`
+	Body      struct {
+		Storage struct {
+			Value          string `json:"value"`
+			Representation string `json:"representation"`
+		} `json:"storage"`
+	} `json:"body"`
+	Space struct {
+		Key string `json:"key"`
+	} `json:"space"`
+}
+
+func (b *confluenceBackend) UpdatePage(page *Page) (*Page, error) {
+	u := &confluenceUpdate{
+		ID:    page.ID,
+		Type:  "page",
+		Title: page.Title,
+	}
+
+	if page.ParentID != "" {
+		u.Ancestors = []confluence.ContentAncestor{{ID: page.ParentID}}
+	}
+	u.Body.Storage.Value = page.Body
+	u.Body.Storage.Representation = "storage"
+	u.Space.Key = b.space
+	u.Version.Number = page.Version
+	u.Version.Message = page.Message
+
+	var c confluence.Content
+	err := b.request("PUT", "/rest/api/content/"+page.ID, u, &c)
+	if isStatus(err, http.StatusConflict) {
+		return nil, ErrConflict
+	} else if err != nil {
+		return nil, err
+	}
+
+	return pageFromContent(&c), nil
+}
+
+func (b *confluenceBackend) MovePage(id string, parentID string) error {
+	page, err := b.GetPage(id)
+	if err != nil {
+		return err
+	}
+
+	if page.ParentID == parentID {
+		return nil
+	}
+
+	page.ParentID = parentID
+	page.Version++
+
+	_, err = b.UpdatePage(page)
+
+	return err
+}
+
+func (b *confluenceBackend) DeletePage(id string) error {
+	return b.request("DELETE", "/rest/api/content/"+id, nil, nil)
+}
+
+func (b *confluenceBackend) GetChildren(id string) ([]*Page, error) {
+	var pages []*Page
+	endpoint := fmt.Sprintf("/rest/api/content/%s/child/page?expand=body.storage,version,ancestors", id)
+	err := b.list(endpoint, func(result json.RawMessage) error {
+		var c confluence.Content
+		if err := json.Unmarshal(result, &c); err != nil {
+			return err
+		}
+		pages = append(pages, pageFromContent(&c))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return pages, nil
+}
+
+func (b *confluenceBackend) FindPage(title string) (*Page, error) {
+	var page *Page
+	endpoint := fmt.Sprintf(
+		"/rest/api/content?type=page&spaceKey=%s&title=%s&expand=body.storage,version,ancestors",
+		url.QueryEscape(b.space),
+		url.QueryEscape(title),
+	)
+	err := b.list(endpoint, func(result json.RawMessage) error {
+		var c confluence.Content
+		if err := json.Unmarshal(result, &c); err != nil {
+			return err
+		}
+		page = pageFromContent(&c)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return page, nil
+}
+
+func (b *confluenceBackend) UploadAttachment(pageID string, path string) (string, error) {
+	filename := filepath.Base(path)
+
+	results, err := b.wiki.GetAttachment(pageID, filename)
+	if err != nil {
+		return "", err
+	}
+
+	if len(results.Results) == 0 {
+		// create new attachment
+		if err := b.uploadFile(pageID, "", path); err != nil {
+			return "", err
+		}
+	} else {
+		// update existing attachment
+		data, err := b.wiki.GetAttachmentData(pageID, filename)
+		if err != nil {
+			return "", err
+		}
+
+		fileSum, err := FileSha256(b.fs, path)
+		if err != nil {
+			return "", err
+		}
+
+		if fileSum != BytesSha256(data) {
+			if err := b.uploadFile(pageID, results.Results[0].ID, path); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return b.AttachmentURL(pageID, filename), nil
+}
+
+func (b *confluenceBackend) GetAttachment(pageID string, filename string) ([]byte, error) {
+	results, err := b.wiki.GetAttachment(pageID, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(results.Results) == 0 {
+		return nil, nil
+	}
+
+	return b.wiki.GetAttachmentData(pageID, filename)
+}
+
+func (b *confluenceBackend) AttachmentURL(pageID string, filename string) string {
+	return fmt.Sprintf("%s/download/attachments/%s/%s", b.uri, pageID, filename)
+}
+
+type confluenceLabel struct {
+	Prefix string `json:"prefix"`
+	Name   string `json:"name"`
+}
+
+func (b *confluenceBackend) GetLabels(pageID string) ([]string, error) {
+	var labels []string
+	err := b.list(fmt.Sprintf("/rest/api/content/%s/label?limit=200", pageID), func(result json.RawMessage) error {
+		var l confluenceLabel
+		if err := json.Unmarshal(result, &l); err != nil {
+			return err
+		}
+		labels = append(labels, l.Name)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return labels, nil
+}
+
+func (b *confluenceBackend) SetLabels(pageID string, labels []string) error {
+	current, err := b.GetLabels(pageID)
+	if err != nil {
+		return err
+	}
+
+	return b.changeLabels(pageID, current, labels)
+}
+
+// changeLabels adds and removes labels to change the labels of the page from
+// current to labels.
+func (b *confluenceBackend) changeLabels(pageID string, current []string, labels []string) error {
+	want := map[string]bool{}
+	for _, l := range labels {
+		want[l] = true
+	}
+	have := map[string]bool{}
+	for _, l := range current {
+		have[l] = true
+	}
+
+	var add []confluenceLabel
+	for _, l := range labels {
+		if !have[l] {
+			add = append(add, confluenceLabel{Prefix: "global", Name: l})
+		}
+	}
+	if len(add) > 0 {
+		err := b.request("POST", fmt.Sprintf("/rest/api/content/%s/label", pageID), add, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, l := range current {
+		if want[l] {
+			continue
+		}
+		endpoint := fmt.Sprintf("/rest/api/content/%s/label?name=%s", pageID, url.QueryEscape(l))
+		if err := b.request("DELETE", endpoint, nil, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type confluenceProperty struct {
+	ID      string          `json:"id,omitempty"`
+	Key     string          `json:"key"`
+	Value   json.RawMessage `json:"value"`
+	Version *struct {
+		Number int `json:"number"`
+	} `json:"version,omitempty"`
+}
+
+func (p *confluenceProperty) property() *Property {
+	property := &Property{Key: p.Key, Value: p.Value}
+	if p.Version != nil {
+		property.Version = p.Version.Number
+	}
+	return property
+}
+
+// newConfluenceProperty returns property as it is sent to store it as its
+// next version.
+func newConfluenceProperty(property *Property) *confluenceProperty {
+	p := &confluenceProperty{Key: property.Key, Value: property.Value}
+	if property.Version > 0 {
+		p.Version = &struct {
+			Number int `json:"number"`
+		}{property.Version + 1}
+	}
+	return p
+}
+
+func (b *confluenceBackend) GetProperty(pageID string, key string) (*Property, error) {
+	var p confluenceProperty
+	err := b.request("GET", fmt.Sprintf("/rest/api/content/%s/property/%s", pageID, url.PathEscape(key)), nil, &p)
+	if isStatus(err, http.StatusNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return p.property(), nil
+}
+
+func (b *confluenceBackend) SetProperty(pageID string, property *Property) (*Property, error) {
+	method := "POST"
+	endpoint := fmt.Sprintf("/rest/api/content/%s/property", pageID)
+	if property.Version > 0 {
+		method = "PUT"
+		endpoint += "/" + url.PathEscape(property.Key)
+	}
+
+	var p confluenceProperty
+	err := b.request(method, endpoint, newConfluenceProperty(property), &p)
+	if isStatus(err, http.StatusConflict) {
+		return nil, ErrConflict
+	} else if err != nil {
+		return nil, err
+	}
+
+	return p.property(), nil
+}
+
+func (b *confluenceBackend) DeleteProperty(pageID string, key string) error {
+	err := b.request("DELETE", fmt.Sprintf("/rest/api/content/%s/property/%s", pageID, url.PathEscape(key)), nil, nil)
+	if isStatus(err, http.StatusNotFound) {
+		return nil
+	}
+
+	return err
+}
+
+func (b *confluenceBackend) PageURL(id string) string {
+	return fmt.Sprintf("%s/pages/viewpage.action?pageId=%s", b.uri, id)
+}
+
+// uploadFile uploads the file at path as a new attachment of the page, or as
+// a new version of the attachment with the given ID. go-confluence can only
+// upload files from the OS filesystem, so the request is made here.
+func (b *confluenceBackend) uploadFile(pageID string, attachmentID string, path string) error {
+	data, err := afero.ReadFile(b.fs, path)
+	if err != nil {
+		return err
+	}
+
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+	part, err := w.CreateFormFile("file", filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	if _, err := part.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	endpoint := fmt.Sprintf("%s/rest/api/content/%s/child/attachment", b.uri, pageID)
+	if attachmentID != "" {
+		endpoint += fmt.Sprintf("/%s/data", attachmentID)
+	}
+	req, err := http.NewRequest("POST", endpoint, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	// multipart requests are refused without it, to protect against XSRF
+	req.Header.Set("X-Atlassian-Token", "nocheck")
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode >= 400 {
+		return &StatusError{
+			Method:     "POST",
+			URL:        endpoint,
+			Status:     resp.Status,
+			StatusCode: resp.StatusCode,
+		}
+	}
+
+	return nil
+}
+
+// request sends a request to the v1 REST API.
+func (b *confluenceBackend) request(method string, endpoint string, in interface{}, out interface{}) error {
+	return requestJSON(b.client, method, b.uri+endpoint, in, out)
+}
+
+// list requests every page of a list from the v1 REST API. Links to the next
+// page are relative to the base URI.
+func (b *confluenceBackend) list(endpoint string, fn func(result json.RawMessage) error) error {
+	next := func(link string) string { return b.uri + link }
+	return listJSON(b.client, b.uri+endpoint, next, fn)
+}
+
+func pageFromContent(c *confluence.Content) *Page {
+	page := &Page{
+		ID:      c.ID,
+		Title:   c.Title,
+		Body:    c.Body.Storage.Value,
+		Version: c.Version.Number,
+	}
+
+	// the last ancestor is the parent
+	if len(c.Ancestors) > 0 {
+		page.ParentID = c.Ancestors[len(c.Ancestors)-1].ID
+	}
+
+	return page
+}
+
+// FileSha256 returns the hex encoded SHA-256 sum of the file at path, for
+// comparing files with the attachments they are uploaded as.
+func FileSha256(fs afero.Fs, path string) (string, error) {
+	f, err := fs.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// BytesSha256 returns the hex encoded SHA-256 sum of b.
+func BytesSha256(b []byte) string {
+	h := sha256.New()
+	h.Write(b)
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,463 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// confluenceCloudBackend publishes to Confluence Cloud using the v2 REST API.
+// v2 has no way to upload attachments or change labels, so the v1 API is
+// used for those.
+type confluenceCloudBackend struct {
+	v1 *confluenceBackend
+	// uri is the base URI of the site, including the /wiki context path
+	uri string
+	// site is the scheme and host of uri, which links to the next page of a
+	// list are relative to
+	site  string
+	space string
+	// spaceID is looked up from the space key when a page is first created
+	spaceID string
+}
+
+type cloudBody struct {
+	Representation string `json:"representation"`
+	Value          string `json:"value"`
+}
+
+type cloudVersion struct {
+	Number  int    `json:"number"`
+	Message string `json:"message,omitempty"`
+}
+
+type cloudPage struct {
+	ID       string        `json:"id,omitempty"`
+	Status   string        `json:"status"`
+	Title    string        `json:"title"`
+	SpaceID  string        `json:"spaceId,omitempty"`
+	ParentID string        `json:"parentId,omitempty"`
+	Version  *cloudVersion `json:"version,omitempty"`
+	Body     struct {
+		// pages are returned with the body in storage, but sent with the
+		// body directly in body
+		Storage *cloudBody `json:"storage,omitempty"`
+		cloudBody
+	} `json:"body"`
+}
+
+func (p *cloudPage) page() *Page {
+	page := &Page{
+		ID:       p.ID,
+		Title:    p.Title,
+		ParentID: p.ParentID,
+	}
+	if p.Body.Storage != nil {
+		page.Body = p.Body.Storage.Value
+	}
+	if p.Version != nil {
+		page.Version = p.Version.Number
+	}
+
+	return page
+}
+
+func newConfluenceCloud(opts Opts) (Backend, error) {
+	u, err := url.Parse(strings.TrimSuffix(opts.URI, "/"))
+	if err != nil {
+		return nil, err
+	}
+	// Confluence Cloud is always served from /wiki
+	if u.Path == "" {
+		u.Path = "/wiki"
+	}
+	opts.URI = u.String()
+
+	v1, err := newConfluenceServer(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &confluenceCloudBackend{
+		v1:    v1,
+		uri:   opts.URI,
+		site:  fmt.Sprintf("%s://%s", u.Scheme, u.Host),
+		space: opts.Space,
+	}, nil
+}
+
+func (b *confluenceCloudBackend) GetPage(id string) (*Page, error) {
+	var p cloudPage
+	if err := b.request("GET", fmt.Sprintf("/pages/%s?body-format=storage", id), nil, &p); err != nil {
+		return nil, err
+	}
+
+	return p.page(), nil
+}
+
+func (b *confluenceCloudBackend) CreatePage(page *Page) (*Page, error) {
+	spaceID, err := b.getSpaceID()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &cloudPage{
+		Status:   "current",
+		Title:    page.Title,
+		SpaceID:  spaceID,
+		ParentID: page.ParentID,
+	}
+	p.Body.cloudBody = cloudBody{Representation: "storage", Value: page.Body}
+
+	var created cloudPage
+	if err := b.request("POST", "/pages", p, &created); err != nil {
+		return nil, err
+	}
+
+	return created.page(), nil
+}
+
+func (b *confluenceCloudBackend) UpdatePage(page *Page) (*Page, error) {
+	p := &cloudPage{
+		ID:       page.ID,
+		Status:   "current",
+		Title:    page.Title,
+		ParentID: page.ParentID,
+		Version:  &cloudVersion{Number: page.Version, Message: page.Message},
+	}
+	p.Body.cloudBody = cloudBody{Representation: "storage", Value: page.Body}
+
+	var updated cloudPage
+	err := b.request("PUT", "/pages/"+page.ID, p, &updated)
+	if isStatus(err, http.StatusConflict) {
+		return nil, ErrConflict
+	} else if err != nil {
+		return nil, err
+	}
+
+	return updated.page(), nil
+}
+
+func (b *confluenceCloudBackend) MovePage(id string, parentID string) error {
+	page, err := b.GetPage(id)
+	if err != nil {
+		return err
+	}
+
+	if page.ParentID == parentID {
+		return nil
+	}
+
+	page.ParentID = parentID
+	page.Version++
+
+	_, err = b.UpdatePage(page)
+
+	return err
+}
+
+type cloudAttachment struct {
+	ID           string `json:"id"`
+	Title        string `json:"title"`
+	DownloadLink string `json:"downloadLink"`
+}
+
+func (b *confluenceCloudBackend) DeletePage(id string) error {
+	return b.request("DELETE", "/pages/"+id, nil, nil)
+}
+
+func (b *confluenceCloudBackend) GetChildren(id string) ([]*Page, error) {
+	// children are listed without their bodies, so each is fetched in turn
+	var ids []string
+	err := b.list(fmt.Sprintf("/pages/%s/children", id), func(result json.RawMessage) error {
+		var child struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal(result, &child); err != nil {
+			return err
+		}
+		ids = append(ids, child.ID)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var pages []*Page
+	for _, id := range ids {
+		page, err := b.GetPage(id)
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, page)
+	}
+
+	return pages, nil
+}
+
+func (b *confluenceCloudBackend) FindPage(title string) (*Page, error) {
+	spaceID, err := b.getSpaceID()
+	if err != nil {
+		return nil, err
+	}
+
+	var page *Page
+	endpoint := fmt.Sprintf(
+		"/pages?space-id=%s&title=%s&body-format=storage",
+		url.QueryEscape(spaceID),
+		url.QueryEscape(title),
+	)
+	err = b.list(endpoint, func(result json.RawMessage) error {
+		var p cloudPage
+		if err := json.Unmarshal(result, &p); err != nil {
+			return err
+		}
+		page = p.page()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return page, nil
+}
+
+// getAttachment returns the attachment of the page with the given name, or
+// nil if there is no such attachment.
+func (b *confluenceCloudBackend) getAttachment(pageID string, filename string) (*cloudAttachment, error) {
+	var attachment *cloudAttachment
+	endpoint := fmt.Sprintf("/pages/%s/attachments?filename=%s", pageID, url.QueryEscape(filename))
+	err := b.list(endpoint, func(result json.RawMessage) error {
+		var a cloudAttachment
+		if err := json.Unmarshal(result, &a); err != nil {
+			return err
+		}
+		if a.Title == filename {
+			attachment = &a
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return attachment, nil
+}
+
+func (b *confluenceCloudBackend) UploadAttachment(pageID string, path string) (string, error) {
+	filename := filepath.Base(path)
+
+	existing, err := b.getAttachment(pageID, filename)
+	if err != nil {
+		return "", err
+	}
+
+	if existing == nil {
+		// create new attachment
+		if err := b.v1.uploadFile(pageID, "", path); err != nil {
+			return "", err
+		}
+	} else {
+		// update existing attachment
+		data, err := b.download(existing.DownloadLink)
+		if err != nil {
+			return "", err
+		}
+
+		fileSum, err := FileSha256(b.v1.fs, path)
+		if err != nil {
+			return "", err
+		}
+
+		if fileSum != BytesSha256(data) {
+			if err := b.v1.uploadFile(pageID, existing.ID, path); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return b.AttachmentURL(pageID, filename), nil
+}
+
+func (b *confluenceCloudBackend) GetAttachment(pageID string, filename string) ([]byte, error) {
+	a, err := b.getAttachment(pageID, filename)
+	if err != nil || a == nil {
+		return nil, err
+	}
+
+	return b.download(a.DownloadLink)
+}
+
+func (b *confluenceCloudBackend) AttachmentURL(pageID string, filename string) string {
+	return b.v1.AttachmentURL(pageID, filename)
+}
+
+// download returns the contents of an attachment from its download link,
+// which is relative to the base URI.
+func (b *confluenceCloudBackend) download(link string) ([]byte, error) {
+	resp, err := b.v1.client.Get(b.uri + link)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return nil, &StatusError{
+			Method:     "GET",
+			URL:        b.uri + link,
+			Status:     resp.Status,
+			StatusCode: resp.StatusCode,
+		}
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (b *confluenceCloudBackend) GetLabels(pageID string) ([]string, error) {
+	var labels []string
+	err := b.list(fmt.Sprintf("/pages/%s/labels", pageID), func(result json.RawMessage) error {
+		var l confluenceLabel
+		if err := json.Unmarshal(result, &l); err != nil {
+			return err
+		}
+		labels = append(labels, l.Name)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return labels, nil
+}
+
+func (b *confluenceCloudBackend) SetLabels(pageID string, labels []string) error {
+	current, err := b.GetLabels(pageID)
+	if err != nil {
+		return err
+	}
+
+	return b.v1.changeLabels(pageID, current, labels)
+}
+
+// getProperty returns the property of the page with the given key, including
+// its ID, which v2 uses to refer to properties.
+func (b *confluenceCloudBackend) getProperty(pageID string, key string) (*confluenceProperty, error) {
+	var property *confluenceProperty
+	endpoint := fmt.Sprintf("/pages/%s/properties?key=%s", pageID, url.QueryEscape(key))
+	err := b.list(endpoint, func(result json.RawMessage) error {
+		var p confluenceProperty
+		if err := json.Unmarshal(result, &p); err != nil {
+			return err
+		}
+		if p.Key == key {
+			property = &p
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return property, nil
+}
+
+func (b *confluenceCloudBackend) GetProperty(pageID string, key string) (*Property, error) {
+	p, err := b.getProperty(pageID, key)
+	if err != nil || p == nil {
+		return nil, err
+	}
+
+	return p.property(), nil
+}
+
+func (b *confluenceCloudBackend) SetProperty(pageID string, property *Property) (*Property, error) {
+	method := "POST"
+	endpoint := fmt.Sprintf("/pages/%s/properties", pageID)
+
+	if property.Version > 0 {
+		current, err := b.getProperty(pageID, property.Key)
+		if err != nil {
+			return nil, err
+		}
+		if current == nil {
+			// deleted by someone else
+			return nil, ErrConflict
+		}
+
+		method = "PUT"
+		endpoint += "/" + current.ID
+	}
+
+	var p confluenceProperty
+	err := b.request(method, endpoint, newConfluenceProperty(property), &p)
+	if isStatus(err, http.StatusConflict) {
+		return nil, ErrConflict
+	} else if err != nil {
+		return nil, err
+	}
+
+	return p.property(), nil
+}
+
+func (b *confluenceCloudBackend) DeleteProperty(pageID string, key string) error {
+	p, err := b.getProperty(pageID, key)
+	if err != nil || p == nil {
+		return err
+	}
+
+	err = b.request("DELETE", fmt.Sprintf("/pages/%s/properties/%s", pageID, p.ID), nil, nil)
+	if isStatus(err, http.StatusNotFound) {
+		return nil
+	}
+
+	return err
+}
+
+func (b *confluenceCloudBackend) PageURL(id string) string {
+	return b.v1.PageURL(id)
+}
+
+func (b *confluenceCloudBackend) getSpaceID() (string, error) {
+	if b.spaceID != "" {
+		return b.spaceID, nil
+	}
+
+	err := b.list("/spaces?keys="+url.QueryEscape(b.space), func(result json.RawMessage) error {
+		var space struct {
+			ID  string `json:"id"`
+			Key string `json:"key"`
+		}
+		if err := json.Unmarshal(result, &space); err != nil {
+			return err
+		}
+		if space.Key == b.space {
+			b.spaceID = space.ID
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if b.spaceID == "" {
+		return "", fmt.Errorf("could not find space %s", b.space)
+	}
+
+	return b.spaceID, nil
+}
+
+// request sends a request to the v2 REST API.
+func (b *confluenceCloudBackend) request(method string, endpoint string, in interface{}, out interface{}) error {
+	return requestJSON(b.v1.client, method, b.uri+"/api/v2"+endpoint, in, out)
+}
+
+// list requests every page of a list from the v2 REST API. Links to the next
+// page include the context path, and are relative to the site.
+func (b *confluenceCloudBackend) list(endpoint string, fn func(result json.RawMessage) error) error {
+	next := func(link string) string { return b.site + link }
+	return listJSON(b.v1.client, b.uri+"/api/v2"+endpoint, next, fn)
+}
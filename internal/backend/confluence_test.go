@@ -0,0 +1,368 @@
+//go:build !windows
+// +build !windows
+
+package backend_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/jesselang/dox/internal/backend"
+)
+
+// interaction is a request recorded from a Confluence site, and the response
+// it was sent.
+type interaction struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	// Body holds the fields the request body must contain
+	Body     json.RawMessage `json:"body"`
+	Status   int             `json:"status"`
+	Response json.RawMessage `json:"response"`
+	// Text is sent instead of Response for requests that are not JSON
+	Text string `json:"text"`
+}
+
+// replay serves the interactions recorded in fixture, failing the test if the
+// requests made are not the ones recorded, in the same order.
+func replay(t *testing.T, api string, fixture string) (b backend.Backend, done func()) {
+	buf, err := ioutil.ReadFile(filepath.Join("testdata", api, fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var interactions []interaction
+	if err := json.Unmarshal(buf, &interactions); err != nil {
+		t.Fatal(err)
+	}
+
+	next := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if next >= len(interactions) {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			http.Error(w, "unexpected request", http.StatusNotImplemented)
+			return
+		}
+		i := interactions[next]
+		next++
+
+		want, err := url.Parse(i.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Method != i.Method || r.URL.Path != want.Path || !reflect.DeepEqual(r.URL.Query(), want.Query()) {
+			t.Errorf("request %d is %s %s, want %s %s", next, r.Method, r.URL, i.Method, i.Path)
+		}
+
+		if i.Body != nil {
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got, want interface{}
+			if err := json.Unmarshal(body, &got); err != nil {
+				t.Errorf("request %d body is not JSON: %s", next, err)
+			} else if err := json.Unmarshal(i.Body, &want); err != nil {
+				t.Fatal(err)
+			} else if !contains(got, want) {
+				t.Errorf("request %d body is %s, want it to contain %s", next, body, i.Body)
+			}
+		}
+
+		if i.Text != "" {
+			w.WriteHeader(i.Status)
+			w.Write([]byte(i.Text))
+			return
+		}
+		if i.Response != nil {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		w.WriteHeader(i.Status)
+		w.Write(i.Response)
+	}))
+
+	b, err = backend.New("confluence", backend.Opts{
+		URI:    srv.URL + "/wiki",
+		Space:  "DOX",
+		API:    api,
+		Client: srv.Client(),
+	})
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+
+	return b, func() {
+		srv.Close()
+		if next < len(interactions) {
+			t.Errorf("%d of %d recorded requests were not made", len(interactions)-next, len(interactions))
+		}
+	}
+}
+
+// contains reports whether got has every field in want, ignoring any others.
+func contains(got interface{}, want interface{}) bool {
+	switch w := want.(type) {
+	case map[string]interface{}:
+		g, ok := got.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for k, v := range w {
+			if !contains(g[k], v) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		g, ok := got.([]interface{})
+		if !ok || len(g) != len(w) {
+			return false
+		}
+		for i := range w {
+			if !contains(g[i], w[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return reflect.DeepEqual(got, want)
+	}
+}
+
+var apis = []string{"v1", "v2"}
+
+func TestGetPage(t *testing.T) {
+	for _, api := range apis {
+		t.Run(api, func(t *testing.T) {
+			b, done := replay(t, api, "get_page.json")
+			defer done()
+
+			page, err := b.GetPage("100")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := &backend.Page{
+				ID:       "100",
+				Title:    "Install",
+				Body:     "<p>Run the installer.</p>",
+				Version:  3,
+				ParentID: "10",
+			}
+			if !reflect.DeepEqual(page, want) {
+				t.Errorf("page is %+v, want %+v", page, want)
+			}
+		})
+	}
+}
+
+func TestCreatePage(t *testing.T) {
+	for _, api := range apis {
+		t.Run(api, func(t *testing.T) {
+			b, done := replay(t, api, "create_page.json")
+			defer done()
+
+			page, err := b.CreatePage(&backend.Page{Title: "Install", Body: "<p>stub</p>", ParentID: "10"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if page.ID != "101" || page.Version != 1 || page.ParentID != "10" {
+				t.Errorf("created page is %+v", page)
+			}
+		})
+	}
+}
+
+func TestUpdatePage(t *testing.T) {
+	for _, api := range apis {
+		t.Run(api, func(t *testing.T) {
+			b, done := replay(t, api, "update_page.json")
+			defer done()
+
+			page, err := b.UpdatePage(&backend.Page{
+				ID:       "100",
+				Title:    "Install",
+				Body:     "<p>Run it.</p>",
+				Version:  4,
+				ParentID: "10",
+				Message:  "dox: 1a2b3c4 Document installing",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if page.Version != 4 || page.Body != "<p>Run it.</p>" {
+				t.Errorf("updated page is %+v", page)
+			}
+		})
+	}
+}
+
+func TestChildren(t *testing.T) {
+	for _, api := range apis {
+		t.Run(api, func(t *testing.T) {
+			b, done := replay(t, api, "children.json")
+			defer done()
+
+			children, err := b.GetChildren("10")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(children) != 1 || children[0].ID != "100" || children[0].Version != 3 || children[0].Body == "" {
+				t.Fatalf("children are %+v", children)
+			}
+
+			if err := b.DeletePage(children[0].ID); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestFindPage(t *testing.T) {
+	for _, api := range apis {
+		t.Run(api, func(t *testing.T) {
+			b, done := replay(t, api, "find_page.json")
+			defer done()
+
+			page, err := b.FindPage("Engineering Docs")
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := &backend.Page{
+				ID:      "5",
+				Title:   "Engineering Docs",
+				Body:    "<p>Start here.</p>",
+				Version: 2,
+			}
+			if !reflect.DeepEqual(page, want) {
+				t.Errorf("page is %+v, want %+v", page, want)
+			}
+
+			page, err = b.FindPage("Missing")
+			if err != nil || page != nil {
+				t.Errorf("found %+v (%v) for a missing title", page, err)
+			}
+		})
+	}
+}
+
+func TestSetLabels(t *testing.T) {
+	for _, api := range apis {
+		t.Run(api, func(t *testing.T) {
+			b, done := replay(t, api, "labels.json")
+			defer done()
+
+			// the current labels span two pages of results
+			if err := b.SetLabels("100", []string{"docs", "dox", "howto"}); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestProperties(t *testing.T) {
+	for _, api := range apis {
+		t.Run(api, func(t *testing.T) {
+			b, done := replay(t, api, "properties.json")
+			defer done()
+
+			p, err := b.GetProperty("100", "dox")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p != nil {
+				t.Fatalf("missing property is %+v, want nil", p)
+			}
+
+			p, err = b.SetProperty("100", &backend.Property{Key: "dox", Value: json.RawMessage(`{"commit":"abc123"}`)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Version != 1 {
+				t.Errorf("created property version is %d, want 1", p.Version)
+			}
+
+			p, err = b.GetProperty("100", "dox")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p == nil || p.Version != 1 {
+				t.Fatalf("property is %+v", p)
+			}
+			var value struct {
+				Commit string `json:"commit"`
+			}
+			if err := json.Unmarshal(p.Value, &value); err != nil || value.Commit != "abc123" {
+				t.Errorf("property value is %s", p.Value)
+			}
+
+			// the recorded site rejects the update as if someone else got there
+			// first
+			p.Value = json.RawMessage(`{"commit":"def456"}`)
+			if _, err := b.SetProperty("100", p); err != backend.ErrConflict {
+				t.Errorf("conflicting update returned %v, want ErrConflict", err)
+			}
+
+			if err := b.DeleteProperty("100", "dox"); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestUploadAttachment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dox-backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "logo.png")
+	if err := ioutil.WriteFile(path, []byte("new logo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, api := range apis {
+		t.Run(api, func(t *testing.T) {
+			b, done := replay(t, api, "attachment.json")
+			defer done()
+
+			// the attachment exists with different contents, so it is updated
+			u, err := b.UploadAttachment("100", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if filepath.Base(u) != "logo.png" {
+				t.Errorf("attachment URL is %s", u)
+			}
+		})
+	}
+}
+
+func TestNewUnsupportedAPI(t *testing.T) {
+	_, err := backend.New("confluence", backend.Opts{URI: "https://wiki.example.com", API: "v3"})
+	if err == nil {
+		t.Fatal("expected an error for an unsupported api")
+	}
+}
+
+func TestNewUnsupportedBackend(t *testing.T) {
+	_, err := backend.New("notion", backend.Opts{})
+	if err == nil {
+		t.Fatal("expected an error for an unsupported backend")
+	}
+
+	// the error lists the backends that are supported
+	if want := `unsupported backend "notion"; use one of confluence`; err.Error() != want {
+		t.Errorf("error is %q, want %q", err, want)
+	}
+}
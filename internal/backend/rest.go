@@ -0,0 +1,95 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// requestJSON sends a request, encoding in as the JSON body and decoding the
+// JSON response into out, if they are not nil. A *StatusError is returned
+// for error responses.
+func requestJSON(client *http.Client, method string, url string, in interface{}, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		buf, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(buf)
+	}
+
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	res, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 400 {
+		return &StatusError{
+			Method:     method,
+			URL:        req.URL.String(),
+			Status:     resp.Status,
+			StatusCode: resp.StatusCode,
+		}
+	}
+
+	if out != nil && len(res) > 0 {
+		return json.Unmarshal(res, out)
+	}
+
+	return nil
+}
+
+// listJSON requests every page of a paginated list starting at url, calling
+// fn with each result. Both REST APIs link to the next page of results in
+// _links.next, which next turns into a URL.
+func listJSON(client *http.Client, url string, next func(link string) string, fn func(result json.RawMessage) error) error {
+	for url != "" {
+		var results struct {
+			Results []json.RawMessage `json:"results"`
+			Links   struct {
+				Next string `json:"next"`
+			} `json:"_links"`
+		}
+
+		if err := requestJSON(client, "GET", url, nil, &results); err != nil {
+			return err
+		}
+
+		for _, r := range results.Results {
+			if err := fn(r); err != nil {
+				return err
+			}
+		}
+
+		url = ""
+		if results.Links.Next != "" {
+			url = next(results.Links.Next)
+		}
+	}
+
+	return nil
+}
+
+// isStatus reports whether err is a *StatusError with the given status code.
+func isStatus(err error, code int) bool {
+	e, ok := err.(*StatusError)
+	return ok && e.StatusCode == code
+}
@@ -0,0 +1,292 @@
+package dox
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/jesselang/dox/internal/source"
+	"github.com/spf13/afero"
+)
+
+// Diagnostic describes a problem found in a source file.
+type Diagnostic struct {
+	File    string
+	Line    int
+	Message string
+}
+
+// String formats d as file:line: message, leaving out the line if it is not
+// known.
+func (d Diagnostic) String() string {
+	if d.Line == 0 {
+		return fmt.Sprintf("%s: %s", d.File, d.Message)
+	}
+
+	return fmt.Sprintf("%s:%d: %s", d.File, d.Line, d.Message)
+}
+
+type checker struct {
+	fs          afero.Fs
+	repoRoot    string
+	diagnostics []Diagnostic
+
+	// sources are cached by filename, since many pages link to the same
+	// few sources
+	sources map[string]source.Source
+	anchors map[string]map[string]bool
+}
+
+// Check verifies that every relative link and image in the sources refers
+// to a file that exists, that linked sources are not ignored and that links
+// to anchors match a heading in the linked source. Check makes no network
+// calls.
+func Check(fs afero.Fs, files []string, repoRoot string) ([]Diagnostic, error) {
+	c := &checker{
+		fs:       fs,
+		repoRoot: repoRoot,
+		sources:  map[string]source.Source{},
+		anchors:  map[string]map[string]bool{},
+	}
+
+	for _, file := range files {
+		src, err := c.source(file)
+		if err != nil {
+			c.report(file, 1, strings.TrimPrefix(err.Error(), file+": "))
+			continue
+		}
+		if src.Ignore() {
+			continue
+		}
+
+		if err := c.checkSource(src); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(c.diagnostics, func(i, j int) bool {
+		a, b := c.diagnostics[i], c.diagnostics[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		return a.Line < b.Line
+	})
+
+	return c.diagnostics, nil
+}
+
+func (c *checker) checkSource(src source.Source) error {
+	buf, err := afero.ReadFile(c.fs, src.File())
+	if err != nil {
+		return err
+	}
+	lines := newLineFinder(buf)
+
+	content := src.Output()
+
+	anchorHrefs, err := getAnchorHrefsFromHTML(content)
+	if err != nil {
+		return err
+	}
+	for _, anchorHref := range anchorHrefs {
+		c.checkRef(src, lines, anchorHref, "link")
+	}
+
+	imageSrcs, err := getImageSrcsFromHTML(content)
+	if err != nil {
+		return err
+	}
+	for _, imageSrc := range imageSrcs {
+		c.checkRef(src, lines, imageSrc, "image")
+	}
+
+	return nil
+}
+
+func (c *checker) checkRef(src source.Source, lines *lineFinder, ref string, kind string) {
+	// skip refs that are URLs
+	if _, err := url.ParseRequestURI(ref); err == nil {
+		return
+	}
+
+	line := lines.line(ref)
+
+	refPath, fragment := splitFragment(ref)
+
+	target := src.File()
+	if refPath != "" {
+		unescaped, err := url.PathUnescape(refPath)
+		if err != nil {
+			unescaped = refPath
+		}
+		target = filepath.Join(filepath.Dir(src.File()), unescaped)
+
+		if _, err := c.fs.Stat(target); os.IsNotExist(err) {
+			c.report(src.File(), line, fmt.Sprintf("%s to missing file %s", kind, c.rel(target)))
+			return
+		}
+	}
+
+	isSource := false
+	for _, e := range source.Extensions() {
+		if filepath.Ext(target) == e {
+			isSource = true
+		}
+	}
+	if !isSource {
+		return
+	}
+
+	linked, err := c.source(target)
+	if err != nil {
+		c.report(src.File(), line, fmt.Sprintf("%s to invalid source %s: %s", kind, c.rel(target), err))
+		return
+	}
+	if linked.Ignore() {
+		c.report(src.File(), line, fmt.Sprintf("%s to ignored source %s", kind, c.rel(target)))
+		return
+	}
+
+	if fragment == "" {
+		return
+	}
+
+	anchors, err := c.sourceAnchors(linked)
+	if err != nil {
+		c.report(src.File(), line, err.Error())
+		return
+	}
+	if !anchors[fragment] {
+		c.report(src.File(), line, fmt.Sprintf("%s to missing anchor #%s in %s", kind, fragment, c.rel(target)))
+	}
+}
+
+func (c *checker) source(file string) (source.Source, error) {
+	if src, ok := c.sources[file]; ok {
+		return src, nil
+	}
+
+	opts := sourceOpts(c.fs)
+	opts.StripComments = true
+	opts.TrimSpace = true
+
+	src, err := source.New(file, opts)
+	if err != nil {
+		return nil, err
+	}
+	c.sources[file] = src
+
+	return src, nil
+}
+
+// sourceAnchors returns the set of anchor names for the headings in src,
+// including its title.
+func (c *checker) sourceAnchors(src source.Source) (map[string]bool, error) {
+	if anchors, ok := c.anchors[src.File()]; ok {
+		return anchors, nil
+	}
+
+	headings, err := getHeadingsFromHTML(src.Output())
+	if err != nil {
+		return nil, err
+	}
+	headings = append([]heading{{level: 1, text: src.Title()}}, headings...)
+
+	anchors := map[string]bool{}
+	for _, slug := range headingSlugs(headings) {
+		anchors[slug] = true
+	}
+	c.anchors[src.File()] = anchors
+
+	return anchors, nil
+}
+
+func (c *checker) report(file string, line int, message string) {
+	c.diagnostics = append(c.diagnostics, Diagnostic{
+		File:    c.rel(file),
+		Line:    line,
+		Message: message,
+	})
+}
+
+func (c *checker) rel(file string) string {
+	rel, err := filepath.Rel(c.repoRoot, file)
+	if err != nil {
+		return file
+	}
+
+	return rel
+}
+
+// lineFinder finds the lines refs are written on in a source. Refs are looked
+// up in the order they are rendered, so each use of a ref written more than
+// once is found on its own line.
+type lineFinder struct {
+	lines []string
+	// uses counts the lookups of each ref so far
+	uses map[string]int
+}
+
+func newLineFinder(content []byte) *lineFinder {
+	return &lineFinder{
+		lines: strings.Split(string(content), "\n"),
+		uses:  map[string]int{},
+	}
+}
+
+// line returns the line number of the next use of ref, as it is written or
+// unescaped. A ref used more often than it is written, as reference links
+// can be, is found on the line it was last written on. 0 is returned if ref
+// can not be found.
+func (f *lineFinder) line(ref string) int {
+	if ref == "" {
+		return 0
+	}
+	n := f.uses[ref]
+	f.uses[ref]++
+
+	refs := []string{ref}
+	if unescaped, err := url.PathUnescape(ref); err == nil && unescaped != ref {
+		refs = append(refs, unescaped)
+	}
+
+	for _, r := range refs {
+		last := 0
+		for i, line := range f.lines {
+			for range refIndexes(line, r) {
+				if n == 0 {
+					return i + 1
+				}
+				n--
+				last = i + 1
+			}
+		}
+		if last > 0 {
+			return last
+		}
+	}
+
+	return 0
+}
+
+// refIndexes returns where ref is written in line as a whole, and not as part
+// of a longer ref, such as a link to an anchor in the file ref links to.
+func refIndexes(line string, ref string) []int {
+	var indexes []int
+	for start := 0; ; {
+		i := strings.Index(line[start:], ref)
+		if i < 0 {
+			return indexes
+		}
+		i += start
+		end := i + len(ref)
+		if (i == 0 || strings.ContainsRune("(<\"' \t:", rune(line[i-1]))) &&
+			(end == len(line) || strings.ContainsRune(")>\"' \t", rune(line[end]))) {
+			indexes = append(indexes, i)
+		}
+		start = i + 1
+	}
+}
@@ -0,0 +1,359 @@
+package dox
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jesselang/dox/internal/source"
+	"github.com/spf13/afero"
+)
+
+// ExternalOpts controls how external links are checked.
+type ExternalOpts struct {
+	// Concurrency is the maximum number of links checked at once.
+	Concurrency int
+	// HostInterval is the minimum time between requests to the same host.
+	HostInterval time.Duration
+	// Timeout limits each request.
+	Timeout time.Duration
+	// CacheFile stores the links found alive between runs, which are not
+	// checked again until they are older than CacheTTL. Dead links are not
+	// cached, so they are checked again every run. No cache is used if
+	// CacheFile is empty.
+	CacheFile string
+	CacheTTL  time.Duration
+	// URLs matching a Deny pattern are reported without being checked,
+	// unless they also match an Allow pattern, which makes an exception to
+	// the Deny patterns. Allowed URLs are checked like any other.
+	Allow []string
+	Deny  []string
+}
+
+type linkResult struct {
+	OK      bool      `json:"ok"`
+	Status  string    `json:"status"`
+	Checked time.Time `json:"checked"`
+}
+
+type externalLink struct {
+	file string
+	line int
+	url  string
+}
+
+type hostLimiter struct {
+	mu   sync.Mutex
+	last time.Time
+}
+
+type externalChecker struct {
+	fs     afero.Fs
+	opts   ExternalOpts
+	client *http.Client
+	allow  []*regexp.Regexp
+	deny   []*regexp.Regexp
+
+	mu    sync.Mutex
+	cache map[string]linkResult
+	hosts map[string]*hostLimiter
+}
+
+// CheckExternal requests every absolute link and image in the sources and
+// reports the ones that could not be reached. The sources and the cache are
+// read from fs.
+func CheckExternal(fs afero.Fs, files []string, repoRoot string, opts ExternalOpts) ([]Diagnostic, error) {
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 1
+	}
+
+	c := &externalChecker{
+		fs:     fs,
+		opts:   opts,
+		client: &http.Client{Timeout: opts.Timeout},
+		cache:  map[string]linkResult{},
+		hosts:  map[string]*hostLimiter{},
+	}
+
+	for _, pattern := range opts.Allow {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allow pattern %q: %s", pattern, err)
+		}
+		c.allow = append(c.allow, re)
+	}
+	for _, pattern := range opts.Deny {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid deny pattern %q: %s", pattern, err)
+		}
+		c.deny = append(c.deny, re)
+	}
+
+	if err := c.loadCache(); err != nil {
+		return nil, err
+	}
+
+	links, err := getExternalLinks(fs, files)
+	if err != nil {
+		return nil, err
+	}
+
+	// each URL is checked once, no matter how many files link to it
+	var urls []string
+	seen := map[string]bool{}
+	for _, link := range links {
+		if !seen[link.url] {
+			seen[link.url] = true
+			urls = append(urls, link.url)
+		}
+	}
+
+	results := map[string]linkResult{}
+	var resultsMu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, opts.Concurrency)
+	for _, u := range urls {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(u string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			result := c.check(u)
+
+			resultsMu.Lock()
+			results[u] = result
+			resultsMu.Unlock()
+		}(u)
+	}
+	wg.Wait()
+
+	if err := c.saveCache(); err != nil {
+		return nil, err
+	}
+
+	var diagnostics []Diagnostic
+	for _, link := range links {
+		result := results[link.url]
+		if result.OK {
+			continue
+		}
+
+		file, err := filepath.Rel(repoRoot, link.file)
+		if err != nil {
+			file = link.file
+		}
+		diagnostics = append(diagnostics, Diagnostic{
+			File:    file,
+			Line:    link.line,
+			Message: fmt.Sprintf("dead link %s: %s", link.url, result.Status),
+		})
+	}
+
+	sort.SliceStable(diagnostics, func(i, j int) bool {
+		a, b := diagnostics[i], diagnostics[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		return a.Line < b.Line
+	})
+
+	return diagnostics, nil
+}
+
+func getExternalLinks(fs afero.Fs, files []string) ([]externalLink, error) {
+	opts := sourceOpts(fs)
+	opts.StripComments = true
+	opts.TrimSpace = true
+
+	var links []externalLink
+	for _, file := range files {
+		src, err := source.New(file, opts)
+		if err != nil {
+			return nil, err
+		}
+		if src.Ignore() {
+			continue
+		}
+
+		buf, err := afero.ReadFile(fs, file)
+		if err != nil {
+			return nil, err
+		}
+		lines := newLineFinder(buf)
+
+		content := src.Output()
+
+		anchorHrefs, err := getAnchorHrefsFromHTML(content)
+		if err != nil {
+			return nil, err
+		}
+		imageSrcs, err := getImageSrcsFromHTML(content)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ref := range append(anchorHrefs, imageSrcs...) {
+			u, err := url.ParseRequestURI(ref)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				continue
+			}
+
+			links = append(links, externalLink{
+				file: file,
+				line: lines.line(ref),
+				url:  ref,
+			})
+		}
+	}
+
+	return links, nil
+}
+
+func (c *externalChecker) check(u string) linkResult {
+	if re := c.denied(u); re != nil {
+		return linkResult{Status: fmt.Sprintf("denied by pattern %q", re.String())}
+	}
+
+	c.mu.Lock()
+	cached, ok := c.cache[u]
+	c.mu.Unlock()
+	if ok && cached.OK && time.Since(cached.Checked) < c.opts.CacheTTL {
+		return cached
+	}
+
+	// some servers do not support HEAD, so fall back to GET before
+	// declaring a link dead
+	result := c.request(http.MethodHead, u)
+	if !result.OK {
+		result = c.request(http.MethodGet, u)
+	}
+
+	c.mu.Lock()
+	if result.OK {
+		c.cache[u] = result
+	} else {
+		delete(c.cache, u)
+	}
+	c.mu.Unlock()
+
+	return result
+}
+
+// denied returns the Deny pattern u matches, or nil if it matches none or is
+// allowed.
+func (c *externalChecker) denied(u string) *regexp.Regexp {
+	for _, re := range c.allow {
+		if re.MatchString(u) {
+			return nil
+		}
+	}
+	for _, re := range c.deny {
+		if re.MatchString(u) {
+			return re
+		}
+	}
+
+	return nil
+}
+
+func (c *externalChecker) request(method string, u string) linkResult {
+	result := linkResult{Checked: time.Now()}
+
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		result.Status = err.Error()
+		return result
+	}
+	req.Header.Set("User-Agent", "dox link checker")
+
+	c.wait(req.URL.Host)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		result.Status = err.Error()
+		return result
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	result.OK = resp.StatusCode < 400
+	result.Status = resp.Status
+
+	return result
+}
+
+// wait blocks until a request may be sent to host without exceeding the
+// per-host rate limit.
+func (c *externalChecker) wait(host string) {
+	c.mu.Lock()
+	limiter, ok := c.hosts[host]
+	if !ok {
+		limiter = &hostLimiter{}
+		c.hosts[host] = limiter
+	}
+	c.mu.Unlock()
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	if d := c.opts.HostInterval - time.Since(limiter.last); d > 0 {
+		time.Sleep(d)
+	}
+	limiter.last = time.Now()
+}
+
+func (c *externalChecker) loadCache() error {
+	if c.opts.CacheFile == "" {
+		return nil
+	}
+
+	buf, err := afero.ReadFile(c.fs, c.opts.CacheFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(buf, &c.cache); err != nil {
+		fmt.Printf("warn: ignoring invalid link cache %s: %s\n", c.opts.CacheFile, err)
+		c.cache = map[string]linkResult{}
+	}
+
+	return nil
+}
+
+func (c *externalChecker) saveCache() error {
+	if c.opts.CacheFile == "" {
+		return nil
+	}
+
+	// drop expired results so the cache does not grow forever, and dead
+	// links cached by older versions
+	for u, result := range c.cache {
+		if !result.OK || time.Since(result.Checked) >= c.opts.CacheTTL {
+			delete(c.cache, u)
+		}
+	}
+
+	buf, err := json.MarshalIndent(c.cache, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := c.fs.MkdirAll(filepath.Dir(c.opts.CacheFile), 0755); err != nil {
+		return err
+	}
+
+	return afero.WriteFile(c.fs, c.opts.CacheFile, buf, 0644)
+}
@@ -0,0 +1,111 @@
+//go:build !windows
+// +build !windows
+
+package dox_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jesselang/dox/internal"
+	"github.com/spf13/afero"
+)
+
+func TestCheckExternal(t *testing.T) {
+	var requests, fixed int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		switch r.URL.Path {
+		case "/ok", "/denied/ok":
+		case "/missing":
+			if atomic.LoadInt32(&fixed) == 0 {
+				http.NotFound(w, r)
+			}
+		case "/no-head":
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	// the sources and the cache are only on fs
+	fs := afero.NewMemMapFs()
+	root := "/repo"
+
+	readme := filepath.Join(root, "README.md")
+	content := fmt.Sprintf(`# Readme
+
+[ok](%[1]s/ok) and [no head](%[1]s/no-head)
+
+[missing](%[1]s/missing)
+
+[denied](%[1]s/denied/page) and [allowed](%[1]s/denied/ok)
+
+[allowed but dead](%[1]s/denied/gone)
+
+[missing again](%[1]s/missing)
+`, ts.URL)
+	if err := afero.WriteFile(fs, readme, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := dox.ExternalOpts{
+		Concurrency:  2,
+		HostInterval: time.Millisecond,
+		Timeout:      time.Second,
+		CacheFile:    filepath.Join(root, "cache", "links.json"),
+		CacheTTL:     time.Hour,
+		Allow:        []string{"/denied/(ok|gone)$"},
+		Deny:         []string{"/denied/"},
+	}
+
+	diagnostics, err := dox.CheckExternal(fs, []string{readme}, root, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		fmt.Sprintf("README.md:5: dead link %s/missing: 404 Not Found", ts.URL),
+		fmt.Sprintf(`README.md:7: dead link %s/denied/page: denied by pattern "/denied/"`, ts.URL),
+		// allowed links are exceptions to the deny patterns, checked like
+		// any other
+		fmt.Sprintf("README.md:9: dead link %s/denied/gone: 404 Not Found", ts.URL),
+		fmt.Sprintf("README.md:11: dead link %s/missing: 404 Not Found", ts.URL),
+	}
+	if len(diagnostics) != len(expected) {
+		t.Fatalf("unexpected diagnostics: %v", diagnostics)
+	}
+	for i, d := range diagnostics {
+		if d.String() != expected[i] {
+			t.Errorf("expected %s, got %s", expected[i], d)
+		}
+	}
+
+	// links found alive are cached, so checking again only requests the
+	// dead links, each with HEAD and then GET
+	before := atomic.LoadInt32(&requests)
+	if _, err := dox.CheckExternal(fs, []string{readme}, root, opts); err != nil {
+		t.Fatal(err)
+	}
+	if after := atomic.LoadInt32(&requests); after-before != 4 {
+		t.Errorf("expected 4 requests for the dead links, got %d", after-before)
+	}
+
+	// a dead link that is fixed is not reported from the cache
+	atomic.StoreInt32(&fixed, 1)
+	diagnostics, err = dox.CheckExternal(fs, []string{readme}, root, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diagnostics) != 2 || diagnostics[0].String() != expected[1] || diagnostics[1].String() != expected[2] {
+		t.Errorf("expected only %s once the dead link is fixed, got %v", expected[1:3], diagnostics)
+	}
+}
@@ -0,0 +1,75 @@
+//go:build !windows
+// +build !windows
+
+package dox_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/jesselang/dox/internal"
+	"github.com/spf13/afero"
+)
+
+func TestCheck(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	root := "/repo"
+
+	files := map[string]string{
+		"README.md": `# Readme
+
+See [setup](docs/install.md#setup), [usage](#usage) and [the logo](logo.png).
+
+![diagram](docs/missing.png)
+
+Read [the old docs](docs/old.md) or [nowhere](docs/install.md#nowhere).
+
+## Usage
+
+Ask [someone](docs/ask\_me.md) or read [my notes](<docs/my notes.md>).
+
+Read [the old docs](docs/old.md#new), or [nowhere](docs/install.md#nowhere) again.
+`,
+		"docs/install.md": "# Install\n\n## Setup\n",
+		"docs/old.md":     "<!-- dox: ignore -->\n# Old\n",
+		"logo.png":        "",
+	}
+
+	var sources []string
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := afero.WriteFile(fs, path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Ext(name) == ".md" {
+			sources = append(sources, path)
+		}
+	}
+
+	diagnostics, err := dox.Check(fs, sources, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]bool{
+		"README.md:5: image to missing file docs/missing.png":             true,
+		"README.md:7: link to ignored source docs/old.md":                 true,
+		"README.md:7: link to missing anchor #nowhere in docs/install.md": true,
+		// the link is not written as it is rendered, so its line is unknown
+		"README.md: link to missing file docs/ask_me.md":      true,
+		"README.md:11: link to missing file docs/my notes.md": true,
+		// each use of a link is found on its own line
+		"README.md:13: link to ignored source docs/old.md":                 true,
+		"README.md:13: link to missing anchor #nowhere in docs/install.md": true,
+	}
+
+	if len(diagnostics) != len(expected) {
+		t.Fatalf("unexpected diagnostics: %v", diagnostics)
+	}
+
+	for _, d := range diagnostics {
+		if !expected[d.String()] {
+			t.Errorf("unexpected diagnostic: %s", d)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package dox
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const defaultTimeout = 60 * time.Second
+
+// systemCertPool returns the CAs trusted by the system. Tests replace it,
+// since the system CAs can only be changed for the whole process.
+var systemCertPool = x509.SystemCertPool
+
+// newHTTPClient returns a client for talking to Confluence, configured with
+// the TLS, proxy and timeout settings from the config.
+func newHTTPClient() (*http.Client, error) {
+	transport, err := newTransport()
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := defaultTimeout
+	if viper.IsSet("timeout") {
+		timeout = viper.GetDuration("timeout")
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+	}, nil
+}
+
+func newTransport() (*http.Transport, error) {
+	tlsConfig := &tls.Config{}
+
+	// the CAs of the system are trusted, along with those in ca_file. If
+	// they can not be listed, the system verifies certificates itself.
+	pool, err := systemCertPool()
+	if err != nil {
+		pool = nil
+	}
+	if caFile := viper.GetString("ca_file"); caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		if pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ca_file %s", caFile)
+		}
+	}
+	tlsConfig.RootCAs = pool
+
+	clientCert := viper.GetString("client_cert")
+	clientKey := viper.GetString("client_key")
+	if clientCert != "" || clientKey != "" {
+		if clientCert == "" || clientKey == "" {
+			return nil, fmt.Errorf("client_cert and client_key must be set together")
+		}
+
+		cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if viper.GetBool("insecure_skip_verify") {
+		fmt.Fprintln(os.Stderr, "WARNING: insecure_skip_verify is set; TLS certificates will NOT be verified and credentials can be intercepted")
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if p := viper.GetString("proxy"); p != "" {
+		proxyURL, err := url.Parse(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %s: %s", p, err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	// the remaining settings match http.DefaultTransport
+	return &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}, nil
+}
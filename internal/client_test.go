@@ -0,0 +1,240 @@
+//go:build !windows
+// +build !windows
+
+// Like the other tests of the package, these are not built on Windows, since
+// they use the exports of export_test.go, which is not either.
+
+package dox_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jesselang/dox/internal"
+	"github.com/spf13/viper"
+)
+
+// testCA is a CA issuing certificates for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCA{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// issue returns a certificate for 127.0.0.1 signed by the CA, and the PEM
+// encoded certificate and key.
+func (ca *testCA) issue(t *testing.T) (tls.Certificate, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, certPEM, keyPEM
+}
+
+// newTLSServer starts a server with a certificate signed by ca, requiring
+// clients to present a certificate signed by clientCA if it is not nil.
+func newTLSServer(t *testing.T, ca *testCA, clientCA *testCA) *httptest.Server {
+	cert, _, _ := ca.issue(t)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	// refused handshakes are expected
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	if clientCA != nil {
+		pool := x509.NewCertPool()
+		pool.AddCert(clientCA.cert)
+		srv.TLS.ClientCAs = pool
+		srv.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	srv.StartTLS()
+
+	return srv
+}
+
+func TestHTTPClient(t *testing.T) {
+	// a CA standing in for those of the system, and another for an internal
+	// CA trusted with ca_file
+	systemCA := newCA(t, "System CA")
+	defer dox.SetSystemCAs(systemCA.cert)()
+
+	dir, err := ioutil.TempDir("", "dox-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer viper.Reset()
+
+	ca := newCA(t, "Internal CA")
+	_, clientCert, clientKey := ca.issue(t)
+	for name, content := range map[string][]byte{
+		"ca.pem":     ca.pem,
+		"client.pem": clientCert,
+		"client.key": clientKey,
+		"empty.pem":  []byte("no certificates\n"),
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	internal := newTLSServer(t, ca, nil)
+	defer internal.Close()
+	public := newTLSServer(t, systemCA, nil)
+	defer public.Close()
+	mutual := newTLSServer(t, ca, ca)
+	defer mutual.Close()
+
+	for _, tc := range []struct {
+		name   string
+		config map[string]interface{}
+		// the servers reached, and those refused, by the client
+		reached []*httptest.Server
+		refused []*httptest.Server
+		err     string
+	}{
+		{
+			name:    "system CAs",
+			reached: []*httptest.Server{public},
+			refused: []*httptest.Server{internal, mutual},
+		},
+		{
+			name:    "ca_file",
+			config:  map[string]interface{}{"ca_file": filepath.Join(dir, "ca.pem")},
+			reached: []*httptest.Server{internal, public},
+			refused: []*httptest.Server{mutual},
+		},
+		{
+			name:   "ca_file without certificates",
+			config: map[string]interface{}{"ca_file": filepath.Join(dir, "empty.pem")},
+			err:    "no certificates found in ca_file " + filepath.Join(dir, "empty.pem"),
+		},
+		{
+			name: "client certificate",
+			config: map[string]interface{}{
+				"ca_file":     filepath.Join(dir, "ca.pem"),
+				"client_cert": filepath.Join(dir, "client.pem"),
+				"client_key":  filepath.Join(dir, "client.key"),
+			},
+			reached: []*httptest.Server{internal, public, mutual},
+		},
+		{
+			name:   "client certificate without a key",
+			config: map[string]interface{}{"client_cert": filepath.Join(dir, "client.pem")},
+			err:    "client_cert and client_key must be set together",
+		},
+		{
+			name:    "insecure_skip_verify",
+			config:  map[string]interface{}{"insecure_skip_verify": true},
+			reached: []*httptest.Server{internal, public},
+			refused: []*httptest.Server{mutual},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			viper.Reset()
+			for key, value := range tc.config {
+				viper.Set(key, value)
+			}
+
+			client, err := dox.NewHTTPClient()
+			if tc.err != "" {
+				if err == nil || err.Error() != tc.err {
+					t.Fatalf("error is %v, want %s", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, srv := range tc.reached {
+				resp, err := client.Get(srv.URL)
+				if err != nil {
+					t.Errorf("GET %s: %s", srv.URL, err)
+					continue
+				}
+				resp.Body.Close()
+			}
+			for _, srv := range tc.refused {
+				resp, err := client.Get(srv.URL)
+				if err == nil {
+					resp.Body.Close()
+					t.Errorf("GET %s succeeded, want it refused", srv.URL)
+				} else if !strings.Contains(err.Error(), "certificate") && !strings.Contains(err.Error(), "tls") {
+					t.Errorf("GET %s: %s, want a TLS error", srv.URL, err)
+				}
+			}
+		})
+	}
+}
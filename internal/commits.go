@@ -0,0 +1,104 @@
+package dox
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// commitInfo describes the last commit to change a source.
+type commitInfo struct {
+	Hash      string
+	ShortHash string
+	Subject   string
+	Author    string
+	Date      time.Time
+}
+
+// hasCommits reports whether the repo is a git repo with a commit, so the
+// commits of its sources can be looked up.
+func hasCommits(repoRoot string) bool {
+	_, err := git(repoRoot, "rev-parse", "--verify", "-q", "HEAD^{commit}")
+
+	return err == nil
+}
+
+// lastCommit returns the last commit to change file, or nil if it has never
+// been committed.
+func lastCommit(repoRoot string, file string) (*commitInfo, error) {
+	out, err := git(repoRoot, "log", "-1", "--format=%H%x1f%h%x1f%s%x1f%an%x1f%aI", "--", file)
+	if err != nil || out == "" {
+		return nil, err
+	}
+
+	fields := strings.Split(out, "\x1f")
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("unexpected output of git log: %q", out)
+	}
+
+	date, err := time.Parse(time.RFC3339, fields[4])
+	if err != nil {
+		return nil, err
+	}
+
+	return &commitInfo{
+		Hash:      fields[0],
+		ShortHash: fields[1],
+		Subject:   fields[2],
+		Author:    fields[3],
+		Date:      date,
+	}, nil
+}
+
+// versionMessage returns the message for a version of a page published from
+// the commit.
+func (c *commitInfo) versionMessage() string {
+	return fmt.Sprintf("dox: %s %s", c.ShortHash, c.Subject)
+}
+
+// commitURL returns the URL of the commit, using commit_url in config, or
+// else following browse_url_base to the commit as on GitHub and GitLab. It
+// returns "" if neither gives a URL.
+func (c *commitInfo) commitURL() string {
+	if format := viper.GetString("commit_url"); format != "" {
+		if strings.Contains(format, "%s") {
+			return fmt.Sprintf(format, c.Hash)
+		}
+		return strings.TrimSuffix(format, "/") + "/" + c.Hash
+	}
+
+	if u := browseRepoURL(); u != "" {
+		return u + "/commit/" + c.Hash
+	}
+
+	return ""
+}
+
+// browseRepoURL returns the URL of the repo on the site of browse_url_base,
+// if it browses files at /blob/ as on GitHub and GitLab, or else "".
+func browseRepoURL() string {
+	if i := strings.Index(browseUrlBase, "/blob/"); i >= 0 {
+		return browseUrlBase[:i]
+	}
+
+	return ""
+}
+
+// footer returns a footer for a page, telling who last changed its source.
+func (c *commitInfo) footer() string {
+	commit := html.EscapeString(c.ShortHash)
+	if u := c.commitURL(); u != "" {
+		commit = fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(u), commit)
+	}
+
+	return fmt.Sprintf(
+		"\n<hr />\n<p><em>Last changed by %s on %s in %s: %s</em></p>",
+		html.EscapeString(c.Author),
+		c.Date.Format("2006-01-02"),
+		commit,
+		html.EscapeString(c.Subject),
+	)
+}
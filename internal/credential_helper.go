@@ -0,0 +1,96 @@
+package dox
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+type credentials struct {
+	username string
+	password string
+	token    string
+}
+
+// credentials from the helper are cached by host for the rest of the run,
+// so a helper that prompts or unlocks a vault is only run once
+var credentialHelperCache = map[string]*credentials{}
+var credentialHelperMu sync.Mutex
+
+// getHelperCredentials runs the credential helper command and returns the
+// credentials it prints for host.
+//
+// The protocol is the one used by git credential helpers, so tools like
+// pass, 1Password's op or git itself can be adapted with a short script. The
+// helper is given attributes on stdin, one key=value per line followed by a
+// blank line:
+//
+//	protocol=https
+//	host=confluence.example.com
+//
+// and prints the credentials it has in the same format. Any of username,
+// password and token may be printed; unknown keys are ignored. A helper that
+// prints nothing has no credentials for host, and one that prints quit=true
+// stops dox from looking any further.
+func getHelperCredentials(helper string, protocol string, host string) (*credentials, error) {
+	credentialHelperMu.Lock()
+	defer credentialHelperMu.Unlock()
+
+	if c, ok := credentialHelperCache[host]; ok {
+		return c, nil
+	}
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", helper)
+	} else {
+		cmd = exec.Command("sh", "-c", helper)
+	}
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("protocol=%s\nhost=%s\n\n", protocol, host))
+	cmd.Stderr = os.Stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("credential helper failed: %s", err)
+	}
+
+	c := &credentials{}
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		line := s.Text()
+		if line == "" {
+			break
+		}
+
+		i := strings.Index(line, "=")
+		if i < 0 {
+			continue
+		}
+
+		switch line[:i] {
+		case "username":
+			c.username = line[i+1:]
+		case "password":
+			c.password = line[i+1:]
+		case "token":
+			c.token = line[i+1:]
+		case "quit":
+			// as git does
+			if v := line[i+1:]; v == "true" || v == "1" {
+				return nil, fmt.Errorf("credential helper quit without credentials for %s", host)
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	credentialHelperCache[host] = c
+
+	return c, nil
+}
@@ -0,0 +1,104 @@
+//go:build !windows
+// +build !windows
+
+package dox
+
+import (
+	"crypto/x509"
+	"net/http"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// Unexported functions tested from dox_test.
+var (
+	ConfluenceAnchorForSlug = confluenceAnchorForSlug
+	NewHTTPClient           = newHTTPClient
+	ReplaceRelativeLinks    = replaceRelativeLinks
+)
+
+// NetrcEntry returns the login and password of the entry for host in the
+// netrc file at path, and whether there is one.
+func NetrcEntry(path string, host string) (string, string, bool, error) {
+	e, err := getNetrcEntry(path, host)
+	if err != nil || e == nil {
+		return "", "", false, err
+	}
+
+	return e.login, e.password, true, nil
+}
+
+// Authorization returns the Authorization header that requests to uri are
+// sent with, as set in config.
+func Authorization(uri string, client *http.Client) (string, error) {
+	auth, err := getAuthorizer(uri, client)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+	if err != nil {
+		return "", err
+	}
+	if err := auth.authorize(req); err != nil {
+		return "", err
+	}
+
+	return req.Header.Get("Authorization"), nil
+}
+
+// SetSystemCAs makes certs the CAs trusted by the system, until the returned
+// function is called.
+func SetSystemCAs(certs ...*x509.Certificate) func() {
+	saved := systemCertPool
+	systemCertPool = func() (*x509.CertPool, error) {
+		// a new pool each time, as the CAs of ca_file are added to it
+		pool := x509.NewCertPool()
+		for _, cert := range certs {
+			pool.AddCert(cert)
+		}
+		return pool, nil
+	}
+
+	return func() { systemCertPool = saved }
+}
+
+// SetLockTicker renews held locks on each of ticks, until the returned
+// function is called. stopped is called once a lock stops being renewed,
+// whether it was released or lost.
+func SetLockTicker(ticks <-chan time.Time, stopped func()) func() {
+	saved := lockTicker
+	lockTicker = func(time.Duration) (<-chan time.Time, func()) {
+		return ticks, stopped
+	}
+
+	return func() { lockTicker = saved }
+}
+
+// StartWatch republishes sources as files in the repo change, as Watch
+// does, until the returned function is called. published is called with the
+// changed files after each publish, and what publishing them returned.
+func StartWatch(fs afero.Fs, repoRoot string, published func(changed []string, err error)) (func() error, error) {
+	w, err := newWatcher(fs, repoRoot, false, false)
+	if err != nil {
+		return nil, err
+	}
+
+	saved := watchPublish
+	watchPublish = func(fs afero.Fs, files []string, changed []string, repoRoot string, verbose bool, dryRun bool) error {
+		err := PublishChanged(fs, files, changed, repoRoot, verbose, dryRun)
+		published(changed, err)
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- w.run() }()
+
+	return func() error {
+		w.files.Close()
+		err := <-done
+		watchPublish = saved
+		return err
+	}, nil
+}
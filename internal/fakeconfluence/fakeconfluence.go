@@ -0,0 +1,939 @@
+// Package fakeconfluence is an in-memory stand-in for the Confluence Server
+// v1 REST API, for testing dox end to end without a live wiki.
+//
+// Only the parts of the API dox relies on are implemented: content, with
+// versions, ancestors and children; attachments; labels; content properties
+// and a small subset of CQL search. Like Confluence, it rejects updates that
+// are not based on the current version, duplicate titles in a space and
+// attachment uploads without the XSRF header.
+package fakeconfluence
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Page is a snapshot of a page stored by the server.
+type Page struct {
+	ID      string
+	Space   string
+	Title   string
+	Body    string
+	Version int
+	// Message is the message of the current version.
+	Message  string
+	ParentID string
+	Labels   []string
+	// Attachments maps the name of each attachment to its contents.
+	Attachments map[string][]byte
+	// Properties maps the key of each content property to its JSON value.
+	Properties map[string]json.RawMessage
+}
+
+type attachment struct {
+	id      string
+	name    string
+	data    []byte
+	version int
+}
+
+type property struct {
+	id      string
+	key     string
+	value   json.RawMessage
+	version int
+}
+
+type content struct {
+	id          string
+	space       string
+	title       string
+	body        string
+	version     int
+	message     string
+	parentID    string
+	labels      []string
+	attachments []*attachment
+	properties  map[string]*property
+}
+
+// Server is a fake Confluence site served over HTTP on a local port.
+type Server struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	pages   map[string]*content
+	nextID  int
+	pageLen int
+	auth    string
+}
+
+// New starts a server with no pages. The URL of the server is the base URI
+// of the site. Every request must have an Authorization header, but any
+// credentials are accepted.
+func New() *Server {
+	s := &Server{
+		pages:   map[string]*content{},
+		nextID:  1000,
+		pageLen: 25,
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+
+	return s
+}
+
+// SetPageLength sets the number of results in each page of a list, so
+// clients are made to follow links to the next page.
+func (s *Server) SetPageLength(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pageLen = n
+}
+
+// Authorization returns the Authorization header of the last request
+// authenticated, so tests can check the credentials a client sent.
+func (s *Server) Authorization() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.auth
+}
+
+// AddPage stores a page as if it had been created by someone else, and
+// returns its ID.
+func (s *Server) AddPage(space string, title string, body string, parentID string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := &content{
+		id:         s.newID(),
+		space:      space,
+		title:      title,
+		body:       body,
+		version:    1,
+		parentID:   parentID,
+		properties: map[string]*property{},
+	}
+	s.pages[c.id] = c
+
+	return c.id
+}
+
+// EditPage changes the body of a page as if someone else had edited it,
+// making a new version.
+func (s *Server) EditPage(id string, body string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.pages[id]
+	if !ok {
+		return
+	}
+	c.body = body
+	c.version++
+	c.message = ""
+}
+
+// AddLabel labels the page with the given ID, as someone might by hand.
+func (s *Server) AddLabel(id string, label string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.pages[id]
+	if !ok {
+		return
+	}
+	c.labels = append(c.labels, label)
+}
+
+// SetProperty stores a content property on the page with the given ID, as
+// another client might, making a new version of it.
+func (s *Server) SetProperty(id string, key string, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.pages[id]
+	if !ok {
+		return
+	}
+	p, ok := c.properties[key]
+	if !ok {
+		p = &property{id: s.newID(), key: key}
+		c.properties[key] = p
+	}
+	p.value = json.RawMessage(value)
+	p.version++
+}
+
+// Page returns the page with the given ID, or nil if there is no such page.
+func (s *Server) Page(id string) *Page {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.pages[id]
+	if !ok {
+		return nil
+	}
+
+	return c.snapshot()
+}
+
+// Pages returns every page, ordered by ID.
+func (s *Server) Pages() []*Page {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var pages []*Page
+	for _, c := range s.sortedPages() {
+		pages = append(pages, c.snapshot())
+	}
+
+	return pages
+}
+
+// Children returns the pages whose parent is the page with the given ID,
+// ordered by title.
+func (s *Server) Children(id string) []*Page {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var pages []*Page
+	for _, c := range s.sortedPages() {
+		if c.parentID == id {
+			pages = append(pages, c.snapshot())
+		}
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i].Title < pages[j].Title })
+
+	return pages
+}
+
+func (c *content) snapshot() *Page {
+	p := &Page{
+		ID:          c.id,
+		Space:       c.space,
+		Title:       c.title,
+		Body:        c.body,
+		Version:     c.version,
+		Message:     c.message,
+		ParentID:    c.parentID,
+		Labels:      append([]string(nil), c.labels...),
+		Attachments: map[string][]byte{},
+		Properties:  map[string]json.RawMessage{},
+	}
+	for _, a := range c.attachments {
+		p.Attachments[a.name] = append([]byte(nil), a.data...)
+	}
+	for k, v := range c.properties {
+		p.Properties[k] = append(json.RawMessage(nil), v.value...)
+	}
+
+	return p
+}
+
+func (s *Server) newID() string {
+	s.nextID++
+	return strconv.Itoa(s.nextID)
+}
+
+func (s *Server) sortedPages() []*content {
+	var pages []*content
+	for _, c := range s.pages {
+		pages = append(pages, c)
+	}
+	sort.Slice(pages, func(i, j int) bool {
+		a, _ := strconv.Atoi(pages[i].id)
+		b, _ := strconv.Atoi(pages[j].id)
+		return a < b
+	})
+
+	return pages
+}
+
+// errorf responds with an error in the format Confluence uses.
+func errorf(w http.ResponseWriter, status int, format string, a ...interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"statusCode": status,
+		"message":    fmt.Sprintf(format, a...),
+	})
+}
+
+func respond(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") == "" {
+		errorf(w, http.StatusUnauthorized, "authentication required")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.auth = r.Header.Get("Authorization")
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case len(parts) == 4 && parts[0] == "download" && parts[1] == "attachments":
+		s.serveDownload(w, r, parts[2], parts[3])
+	case len(parts) >= 3 && parts[0] == "rest" && parts[1] == "api" && parts[2] == "content":
+		s.serveContent(w, r, parts[3:])
+	default:
+		errorf(w, http.StatusNotFound, "no such endpoint %s", r.URL.Path)
+	}
+}
+
+// route returns the method and endpoint of a request for content, with the
+// IDs and keys in its path replaced by placeholders.
+func route(method string, parts []string) string {
+	pattern := append([]string(nil), parts...)
+	if len(pattern) > 0 && pattern[0] != "search" {
+		pattern[0] = "{id}"
+	}
+	if len(pattern) >= 4 && pattern[1] == "child" && pattern[2] == "attachment" {
+		pattern[3] = "{attachmentId}"
+	}
+	if len(pattern) == 3 && pattern[1] == "property" {
+		pattern[2] = "{key}"
+	}
+
+	return strings.TrimSpace(method + " " + strings.Join(pattern, "/"))
+}
+
+func (s *Server) serveContent(w http.ResponseWriter, r *http.Request, parts []string) {
+	route := route(r.Method, parts)
+
+	if route == "GET" {
+		s.list(w, r, s.find(r.URL.Query().Get("spaceKey"), r.URL.Query().Get("title")))
+		return
+	}
+	if route == "POST" {
+		s.createPage(w, r)
+		return
+	}
+	if route == "GET search" {
+		s.search(w, r)
+		return
+	}
+
+	c, ok := s.pages[parts[0]]
+	if !ok {
+		errorf(w, http.StatusNotFound, "no content with id %s", parts[0])
+		return
+	}
+
+	switch route {
+	case "GET {id}":
+		respond(w, http.StatusOK, s.contentJSON(c))
+	case "PUT {id}":
+		s.updatePage(w, r, c)
+	case "DELETE {id}":
+		// like Confluence, children of a deleted page move up to its parent
+		for _, child := range s.pages {
+			if child.parentID == c.id {
+				child.parentID = c.parentID
+			}
+		}
+		delete(s.pages, c.id)
+		w.WriteHeader(http.StatusNoContent)
+	case "GET {id}/child/page":
+		var children []*content
+		for _, child := range s.sortedPages() {
+			if child.parentID == c.id {
+				children = append(children, child)
+			}
+		}
+		s.list(w, r, children)
+	case "GET {id}/child/attachment":
+		s.listAttachments(w, r, c)
+	case "POST {id}/child/attachment":
+		s.uploadAttachment(w, r, c, nil)
+	case "POST {id}/child/attachment/{attachmentId}/data":
+		for _, a := range c.attachments {
+			if a.id == parts[3] {
+				s.uploadAttachment(w, r, c, a)
+				return
+			}
+		}
+		errorf(w, http.StatusNotFound, "no attachment with id %s", parts[3])
+	case "GET {id}/label":
+		s.listLabels(w, r, c)
+	case "POST {id}/label":
+		s.addLabels(w, r, c)
+	case "DELETE {id}/label":
+		s.removeLabel(w, r, c)
+	case "POST {id}/property":
+		s.createProperty(w, r, c)
+	case "GET {id}/property/{key}":
+		p, ok := c.properties[parts[2]]
+		if !ok {
+			errorf(w, http.StatusNotFound, "no property found with key: %s", parts[2])
+			return
+		}
+		respond(w, http.StatusOK, propertyJSON(p))
+	case "PUT {id}/property/{key}":
+		s.updateProperty(w, r, c, parts[2])
+	case "DELETE {id}/property/{key}":
+		if _, ok := c.properties[parts[2]]; !ok {
+			errorf(w, http.StatusNotFound, "no property found with key: %s", parts[2])
+			return
+		}
+		delete(c.properties, parts[2])
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		errorf(w, http.StatusNotFound, "no such endpoint %s %s", r.Method, r.URL.Path)
+	}
+}
+
+type contentRequest struct {
+	ID    string `json:"id"`
+	Type  string `json:"type"`
+	Title string `json:"title"`
+	Space struct {
+		Key string `json:"key"`
+	} `json:"space"`
+	Version struct {
+		Number  int    `json:"number"`
+		Message string `json:"message"`
+	} `json:"version"`
+	Ancestors []struct {
+		ID string `json:"id"`
+	} `json:"ancestors"`
+	Body struct {
+		Storage struct {
+			Value string `json:"value"`
+		} `json:"storage"`
+	} `json:"body"`
+}
+
+func decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		errorf(w, http.StatusBadRequest, "could not parse request body: %s", err)
+		return false
+	}
+
+	return true
+}
+
+// titleTaken reports whether a page other than id has title in space.
+func (s *Server) titleTaken(space string, title string, id string) bool {
+	for _, c := range s.pages {
+		if c.id != id && c.space == space && c.title == title {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Server) createPage(w http.ResponseWriter, r *http.Request) {
+	var req contentRequest
+	if !decode(w, r, &req) {
+		return
+	}
+
+	if req.Type != "page" {
+		errorf(w, http.StatusBadRequest, "unsupported content type %q", req.Type)
+		return
+	}
+	if req.Space.Key == "" || req.Title == "" {
+		errorf(w, http.StatusBadRequest, "a page needs a space and a title")
+		return
+	}
+	if s.titleTaken(req.Space.Key, req.Title, "") {
+		errorf(w, http.StatusBadRequest, "a page with this title already exists: %s", req.Title)
+		return
+	}
+
+	c := &content{
+		id:         s.newID(),
+		space:      req.Space.Key,
+		title:      req.Title,
+		body:       req.Body.Storage.Value,
+		version:    1,
+		properties: map[string]*property{},
+	}
+	if len(req.Ancestors) > 0 {
+		parentID := req.Ancestors[len(req.Ancestors)-1].ID
+		if _, ok := s.pages[parentID]; !ok {
+			errorf(w, http.StatusBadRequest, "no parent with id %s", parentID)
+			return
+		}
+		c.parentID = parentID
+	}
+	s.pages[c.id] = c
+
+	respond(w, http.StatusOK, s.contentJSON(c))
+}
+
+func (s *Server) updatePage(w http.ResponseWriter, r *http.Request, c *content) {
+	var req contentRequest
+	if !decode(w, r, &req) {
+		return
+	}
+
+	if req.Version.Number != c.version+1 {
+		errorf(w, http.StatusConflict, "version must be incremented on update; current version is %d", c.version)
+		return
+	}
+	if s.titleTaken(c.space, req.Title, c.id) {
+		errorf(w, http.StatusBadRequest, "a page with this title already exists: %s", req.Title)
+		return
+	}
+
+	if len(req.Ancestors) > 0 {
+		parentID := req.Ancestors[len(req.Ancestors)-1].ID
+		parent, ok := s.pages[parentID]
+		if !ok {
+			errorf(w, http.StatusBadRequest, "no parent with id %s", parentID)
+			return
+		}
+		for _, id := range append(s.ancestors(parent), parentID) {
+			if id == c.id {
+				errorf(w, http.StatusBadRequest, "a page can not be moved below itself")
+				return
+			}
+		}
+		c.parentID = parentID
+	}
+	c.title = req.Title
+	c.body = req.Body.Storage.Value
+	c.version = req.Version.Number
+	c.message = req.Version.Message
+
+	respond(w, http.StatusOK, s.contentJSON(c))
+}
+
+// ancestors returns the IDs of the ancestors of c, starting at the top.
+func (s *Server) ancestors(c *content) []string {
+	var ids []string
+	for id := c.parentID; id != ""; {
+		ids = append([]string{id}, ids...)
+		parent, ok := s.pages[id]
+		if !ok {
+			break
+		}
+		id = parent.parentID
+	}
+
+	return ids
+}
+
+func (s *Server) contentJSON(c *content) map[string]interface{} {
+	var ancestors []map[string]interface{}
+	for _, id := range s.ancestors(c) {
+		ancestors = append(ancestors, map[string]interface{}{"id": id, "type": "page"})
+	}
+
+	return map[string]interface{}{
+		"id":        c.id,
+		"type":      "page",
+		"status":    "current",
+		"title":     c.title,
+		"space":     map[string]interface{}{"key": c.space},
+		"version":   map[string]interface{}{"number": c.version},
+		"ancestors": ancestors,
+		"body": map[string]interface{}{
+			"storage": map[string]interface{}{
+				"value":          c.body,
+				"representation": "storage",
+			},
+		},
+		"_links": map[string]interface{}{
+			"webui": "/pages/viewpage.action?pageId=" + c.id,
+		},
+	}
+}
+
+// find returns the pages matching a space and title, either of which may be
+// empty to match any.
+func (s *Server) find(space string, title string) []*content {
+	var found []*content
+	for _, c := range s.sortedPages() {
+		if (space == "" || c.space == space) && (title == "" || c.title == title) {
+			found = append(found, c)
+		}
+	}
+
+	return found
+}
+
+// list responds with one page of pages, linking to the next.
+func (s *Server) list(w http.ResponseWriter, r *http.Request, pages []*content) {
+	var results []interface{}
+	for _, c := range pages {
+		results = append(results, s.contentJSON(c))
+	}
+	s.paginate(w, r, results)
+}
+
+// paginate responds with the page of results selected by the start and limit
+// parameters of r.
+func (s *Server) paginate(w http.ResponseWriter, r *http.Request, results []interface{}) {
+	q := r.URL.Query()
+	start, _ := strconv.Atoi(q.Get("start"))
+	limit, err := strconv.Atoi(q.Get("limit"))
+	if err != nil || limit > s.pageLen || limit <= 0 {
+		limit = s.pageLen
+	}
+
+	if start > len(results) {
+		start = len(results)
+	}
+	end := start + limit
+	if end > len(results) {
+		end = len(results)
+	}
+
+	page := results[start:end]
+	if page == nil {
+		page = []interface{}{}
+	}
+	links := map[string]interface{}{
+		"base":    s.URL,
+		"context": "",
+	}
+	if end < len(results) {
+		q.Set("start", strconv.Itoa(end))
+		q.Set("limit", strconv.Itoa(limit))
+		links["next"] = r.URL.Path + "?" + q.Encode()
+	}
+
+	respond(w, http.StatusOK, map[string]interface{}{
+		"results": page,
+		"start":   start,
+		"limit":   limit,
+		"size":    len(page),
+		"_links":  links,
+	})
+}
+
+func (s *Server) search(w http.ResponseWriter, r *http.Request) {
+	clauses, err := parseCQL(r.URL.Query().Get("cql"))
+	if err != nil {
+		errorf(w, http.StatusBadRequest, "could not parse cql: %s", err)
+		return
+	}
+
+	var found []*content
+	for _, c := range s.sortedPages() {
+		if s.matches(c, clauses) {
+			found = append(found, c)
+		}
+	}
+
+	var results []interface{}
+	for _, c := range found {
+		results = append(results, map[string]interface{}{
+			"content": s.contentJSON(c),
+			"title":   c.title,
+			"url":     "/pages/viewpage.action?pageId=" + c.id,
+		})
+	}
+	s.paginate(w, r, results)
+}
+
+type cqlClause struct {
+	field string
+	value string
+}
+
+// parseCQL parses the subset of CQL made of field = value clauses joined by
+// AND.
+func parseCQL(cql string) ([]cqlClause, error) {
+	var clauses []cqlClause
+	for _, expr := range splitAnd(cql) {
+		i := strings.Index(expr, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("unsupported expression %q", expr)
+		}
+		field := strings.ToLower(strings.TrimSpace(expr[:i]))
+		value := strings.TrimSpace(expr[i+1:])
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+
+		switch field {
+		case "type", "space", "title", "parent", "ancestor", "label", "id":
+		default:
+			return nil, fmt.Errorf("unsupported field %q", field)
+		}
+		clauses = append(clauses, cqlClause{field, value})
+	}
+
+	return clauses, nil
+}
+
+func splitAnd(cql string) []string {
+	var exprs []string
+	lower := strings.ToLower(cql)
+	for {
+		i := strings.Index(lower, " and ")
+		if i < 0 {
+			break
+		}
+		exprs = append(exprs, cql[:i])
+		cql, lower = cql[i+5:], lower[i+5:]
+	}
+	if strings.TrimSpace(cql) != "" {
+		exprs = append(exprs, cql)
+	}
+
+	return exprs
+}
+
+func (s *Server) matches(c *content, clauses []cqlClause) bool {
+	for _, clause := range clauses {
+		switch clause.field {
+		case "type":
+			if clause.value != "page" {
+				return false
+			}
+		case "space":
+			if c.space != clause.value {
+				return false
+			}
+		case "title":
+			if c.title != clause.value {
+				return false
+			}
+		case "id":
+			if c.id != clause.value {
+				return false
+			}
+		case "parent":
+			if c.parentID != clause.value {
+				return false
+			}
+		case "ancestor":
+			found := false
+			for _, id := range s.ancestors(c) {
+				if id == clause.value {
+					found = true
+				}
+			}
+			if !found {
+				return false
+			}
+		case "label":
+			found := false
+			for _, l := range c.labels {
+				if l == clause.value {
+					found = true
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func (s *Server) attachmentJSON(c *content, a *attachment) map[string]interface{} {
+	return map[string]interface{}{
+		"id":      a.id,
+		"type":    "attachment",
+		"status":  "current",
+		"title":   a.name,
+		"version": map[string]interface{}{"number": a.version},
+		"_links": map[string]interface{}{
+			"download": fmt.Sprintf("/download/attachments/%s/%s?version=%d&api=v2", c.id, url.PathEscape(a.name), a.version),
+		},
+	}
+}
+
+func (s *Server) listAttachments(w http.ResponseWriter, r *http.Request, c *content) {
+	filename := r.URL.Query().Get("filename")
+
+	var results []interface{}
+	for _, a := range c.attachments {
+		if filename == "" || a.name == filename {
+			results = append(results, s.attachmentJSON(c, a))
+		}
+	}
+	s.paginate(w, r, results)
+}
+
+// uploadAttachment creates an attachment, or updates a if it is not nil.
+func (s *Server) uploadAttachment(w http.ResponseWriter, r *http.Request, c *content, a *attachment) {
+	if r.Header.Get("X-Atlassian-Token") != "nocheck" {
+		errorf(w, http.StatusForbidden, "XSRF check failed")
+		return
+	}
+
+	f, header, err := r.FormFile("file")
+	if err != nil {
+		errorf(w, http.StatusBadRequest, "could not read attachment: %s", err)
+		return
+	}
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		errorf(w, http.StatusBadRequest, "could not read attachment: %s", err)
+		return
+	}
+
+	if a == nil {
+		for _, existing := range c.attachments {
+			if existing.name == header.Filename {
+				errorf(w, http.StatusBadRequest, "cannot add a new attachment with same file name as an existing attachment: %s", header.Filename)
+				return
+			}
+		}
+
+		a = &attachment{id: "att" + s.newID(), name: header.Filename}
+		c.attachments = append(c.attachments, a)
+	}
+	a.data = data
+	a.version++
+
+	respond(w, http.StatusOK, map[string]interface{}{
+		"results": []interface{}{s.attachmentJSON(c, a)},
+		"size":    1,
+	})
+}
+
+func (s *Server) serveDownload(w http.ResponseWriter, r *http.Request, id string, name string) {
+	c, ok := s.pages[id]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	for _, a := range c.attachments {
+		if a.name == name {
+			w.Write(a.data)
+			return
+		}
+	}
+
+	http.NotFound(w, r)
+}
+
+func (s *Server) listLabels(w http.ResponseWriter, r *http.Request, c *content) {
+	var results []interface{}
+	for i, l := range c.labels {
+		results = append(results, map[string]interface{}{
+			"prefix": "global",
+			"name":   l,
+			"id":     strconv.Itoa(i + 1),
+			"label":  l,
+		})
+	}
+	s.paginate(w, r, results)
+}
+
+func (s *Server) addLabels(w http.ResponseWriter, r *http.Request, c *content) {
+	var labels []struct {
+		Prefix string `json:"prefix"`
+		Name   string `json:"name"`
+	}
+	if !decode(w, r, &labels) {
+		return
+	}
+
+	for _, l := range labels {
+		if l.Name == "" || strings.ContainsAny(l.Name, " \t") {
+			errorf(w, http.StatusBadRequest, "invalid label %q", l.Name)
+			return
+		}
+		exists := false
+		for _, existing := range c.labels {
+			if existing == l.Name {
+				exists = true
+			}
+		}
+		if !exists {
+			c.labels = append(c.labels, l.Name)
+		}
+	}
+
+	s.listLabels(w, r, c)
+}
+
+func (s *Server) removeLabel(w http.ResponseWriter, r *http.Request, c *content) {
+	name := r.URL.Query().Get("name")
+	for i, l := range c.labels {
+		if l == name {
+			c.labels = append(c.labels[:i], c.labels[i+1:]...)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	errorf(w, http.StatusNotFound, "no label %q", name)
+}
+
+type propertyRequest struct {
+	Key     string          `json:"key"`
+	Value   json.RawMessage `json:"value"`
+	Version struct {
+		Number int `json:"number"`
+	} `json:"version"`
+}
+
+func propertyJSON(p *property) map[string]interface{} {
+	return map[string]interface{}{
+		"id":      p.id,
+		"key":     p.key,
+		"value":   p.value,
+		"version": map[string]interface{}{"number": p.version},
+	}
+}
+
+func (s *Server) createProperty(w http.ResponseWriter, r *http.Request, c *content) {
+	var req propertyRequest
+	if !decode(w, r, &req) {
+		return
+	}
+
+	if _, ok := c.properties[req.Key]; ok {
+		errorf(w, http.StatusConflict, "a property with key %s already exists", req.Key)
+		return
+	}
+
+	p := &property{id: s.newID(), key: req.Key, value: req.Value, version: 1}
+	c.properties[p.key] = p
+
+	respond(w, http.StatusOK, propertyJSON(p))
+}
+
+func (s *Server) updateProperty(w http.ResponseWriter, r *http.Request, c *content, key string) {
+	var req propertyRequest
+	if !decode(w, r, &req) {
+		return
+	}
+
+	p, ok := c.properties[key]
+	if !ok {
+		errorf(w, http.StatusNotFound, "no property found with key: %s", key)
+		return
+	}
+	if req.Version.Number != p.version+1 {
+		errorf(w, http.StatusConflict, "version must be incremented on update; current version is %d", p.version)
+		return
+	}
+
+	p.value = req.Value
+	p.version = req.Version.Number
+
+	respond(w, http.StatusOK, propertyJSON(p))
+}
@@ -0,0 +1,144 @@
+//go:build !windows
+// +build !windows
+
+package fakeconfluence_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/jesselang/dox/internal/backend"
+	"github.com/jesselang/dox/internal/fakeconfluence"
+)
+
+type basicAuth struct{}
+
+func (basicAuth) RoundTrip(r *http.Request) (*http.Response, error) {
+	// a RoundTripper must not modify the request it was given
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.Header = make(http.Header, len(r.Header))
+	for k, v := range r.Header {
+		r2.Header[k] = append([]string(nil), v...)
+	}
+	r2.SetBasicAuth("user", "password")
+	return http.DefaultTransport.RoundTrip(r2)
+}
+
+func newBackend(t *testing.T, srv *fakeconfluence.Server) backend.Backend {
+	b, err := backend.New("confluence", backend.Opts{
+		URI:    srv.URL,
+		Space:  "DOX",
+		API:    "v1",
+		Client: &http.Client{Transport: basicAuth{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func TestLabelsArePaginated(t *testing.T) {
+	srv := fakeconfluence.New()
+	defer srv.Close()
+	srv.SetPageLength(1)
+	b := newBackend(t, srv)
+
+	id := srv.AddPage("DOX", "Home", "", "")
+	want := []string{"a", "b", "c"}
+	if err := b.SetLabels(id, want); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := b.GetLabels(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("labels are %v, want %v", got, want)
+	}
+}
+
+func TestStaleUpdatesConflict(t *testing.T) {
+	srv := fakeconfluence.New()
+	defer srv.Close()
+	b := newBackend(t, srv)
+
+	id := srv.AddPage("DOX", "Home", "", "")
+
+	page, err := b.GetPage(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page.Body = "<p>one</p>"
+	page.Version++
+	if _, err := b.UpdatePage(page); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.UpdatePage(page); err == nil {
+		t.Error("updating a page from a stale version succeeded")
+	}
+
+	p, err := b.SetProperty(id, &backend.Property{Key: "dox", Value: json.RawMessage(`1`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.SetProperty(id, p); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.SetProperty(id, p); err != backend.ErrConflict {
+		t.Errorf("updating a property from a stale version returned %v, want ErrConflict", err)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	srv := fakeconfluence.New()
+	defer srv.Close()
+
+	home := srv.AddPage("DOX", "Home", "", "")
+	guide := srv.AddPage("DOX", "Guide", "", home)
+	srv.AddPage("DOX", "Install", "", guide)
+	srv.AddPage("OPS", "Install", "", "")
+
+	for cql, want := range map[string][]string{
+		`space = DOX and title = "Install"`: {"Install"},
+		`ancestor = ` + home:                {"Guide", "Install"},
+		`parent = ` + home:                  {"Guide"},
+		`title = "Install"`:                 {"Install", "Install"},
+	} {
+		req, err := http.NewRequest("GET", srv.URL+"/rest/api/content/search?cql="+url.QueryEscape(cql), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.SetBasicAuth("user", "password")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var results struct {
+			Results []struct {
+				Title string `json:"title"`
+			} `json:"results"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&results)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		for _, r := range results.Results {
+			got = append(got, r.Title)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s found %v, want %v", cql, got, want)
+		}
+	}
+}
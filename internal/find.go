@@ -2,53 +2,257 @@ package dox
 
 import (
 	"errors"
+	"fmt"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 
 	"github.com/jesselang/dox/internal/source"
 	"github.com/spf13/afero"
+	"github.com/spf13/viper"
 )
 
-var fileArray [64]string
-var fileList []string
+// Entry is a markdown file, or a directory, found by discovery.
+type Entry struct {
+	// File is the path of the file in the working tree, though it is read
+	// from git when discovering from git.
+	File string
+	// Path is the file relative to the repo root, with forward slashes.
+	Path  string
+	IsDir bool
+	// Excluded is why the file is not a source, or empty if it is one.
+	// Directories are only found when they are excluded, and the files in
+	// them are not found at all.
+	Excluded string
+}
+
+// DiscoverOpts are the options of Discover.
+type DiscoverOpts struct {
+	// Git lists the files tracked by git, rather than walking the working
+	// tree, so untracked files are never sources and .gitignore does not
+	// apply. Their content is as staged in the index, as read through
+	// SourcesFs.
+	Git bool
+	// Ref lists the files of a commit, rather than those in the index, and
+	// their content is as committed. Ref implies Git.
+	Ref string
+	// Include and Exclude are globs, relative to the project, selecting the
+	// files that are sources.
+	Include []string
+	Exclude []string
+	// Project is the directory of the project whose sources are found,
+	// which defaults to the repo root.
+	Project string
+}
 
-func walk(path string, info os.FileInfo, err error) error {
+// Discover finds the markdown files of the repo at path, in lexical order,
+// and whether each is a source. Files are excluded by .gitignore when
+// walking the working tree, by .doxignore, and by the globs in opts. Only
+// the files of the project in opts are found, and the directories of the
+// projects nested in it are excluded.
+func Discover(fs afero.Fs, path string, opts DiscoverOpts) ([]Entry, error) {
+	repoRoot, err := FindRepoRoot(fs, path)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	name := info.Name()
+	ig, root, err := discoveryIgnorer(fs, repoRoot, opts)
+	if err != nil {
+		return nil, err
+	}
 
-	if name == ".git" {
-		return filepath.SkipDir
+	if opts.Git || opts.Ref != "" {
+		return discoverGit(fs, repoRoot, root, opts.Ref, ig)
 	}
 
-	if info.IsDir() {
-		return nil
+	return discoverWalk(fs, root, ig)
+}
+
+// discoveryIgnorer returns the ignorer of discovery with opts in the repo at
+// repoRoot, and the directory discovery starts from, which is the project.
+func discoveryIgnorer(fs afero.Fs, repoRoot string, opts DiscoverOpts) (*ignorer, string, error) {
+	root := repoRoot
+	if opts.Project != "" {
+		var err error
+		root, err = filepath.Abs(opts.Project)
+		if err != nil {
+			return nil, "", err
+		}
+		if !inDir(repoRoot, root) {
+			return nil, "", fmt.Errorf("project %s is not in the repo at %s", opts.Project, repoRoot)
+		}
 	}
 
-	for _, v := range source.Extensions() {
-		if filepath.Ext(name) == v {
-			fileList = append(fileList, path)
+	ignoreFiles := []string{".gitignore", ".doxignore"}
+	if opts.Git || opts.Ref != "" {
+		ignoreFiles = []string{".doxignore"}
+	}
+
+	ig, err := newIgnorer(fs, repoRoot, root, ignoreFiles, opts.Include, opts.Exclude)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return ig, root, nil
+}
+
+// discoverOpts returns the options of discovery in config, for the repo at
+// path. The project is the one the config belongs to.
+func discoverOpts(fs afero.Fs, path string) (DiscoverOpts, error) {
+	repoRoot, err := FindRepoRoot(fs, path)
+	if err != nil {
+		return DiscoverOpts{}, err
+	}
+
+	opts := DiscoverOpts{
+		Ref:     viper.GetString("ref"),
+		Include: viper.GetStringSlice("include"),
+		Exclude: viper.GetStringSlice("exclude"),
+		Project: configProject(repoRoot),
+	}
+
+	switch d := viper.GetString("discover"); d {
+	case "", "walk":
+	case "git":
+		opts.Git = true
+	default:
+		return opts, fmt.Errorf("unsupported discover %q; use one of walk, git", d)
+	}
+
+	return opts, nil
+}
+
+// FindAll returns the files of every source in the repo at path, discovered
+// as set in config.
+func FindAll(fs afero.Fs, path string) ([]string, error) {
+	opts, err := discoverOpts(fs, path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := Discover(fs, path, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, e := range entries {
+		if e.Excluded == "" {
+			files = append(files, e.File)
 		}
 	}
 
-	return nil
+	return files, nil
+}
+
+func discoverWalk(fs afero.Fs, root string, ig *ignorer) ([]Entry, error) {
+	var entries []Entry
+	err := afero.Walk(fs, root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+
+		if info.IsDir() {
+			if file != root {
+				reason := nestedProject(fs, root, file)
+				if reason == "" {
+					reason = ig.excluded(file, true)
+				}
+				if reason != "" {
+					entries = append(entries, ig.entry(file, true, reason))
+					return filepath.SkipDir
+				}
+			}
+			return ig.enter(file)
+		}
+
+		if isSourceFile(file) {
+			entries = append(entries, ig.entry(file, false, ig.excluded(file, false)))
+		}
+
+		return nil
+	})
+
+	return entries, err
 }
 
-func FindAll(fs afero.Fs, path string) (files []string, err error) {
-	fileList = fileArray[0:0]
-	path, err = FindRepoRoot(fs, path)
+func discoverGit(fs afero.Fs, repoRoot string, root string, ref string, ig *ignorer) ([]Entry, error) {
+	gfs, err := newGitFs(fs, repoRoot, ref)
 	if err != nil {
-		return
+		return nil, err
 	}
-	if err = afero.Walk(fs, path, walk); err != nil {
-		return
+
+	base := ig.rel(root)
+	var paths []string
+	for _, p := range gfs.paths() {
+		if isSourceFile(p) && (base == "." || strings.HasPrefix(p, base+"/")) {
+			paths = append(paths, p)
+		}
 	}
 
-	files = fileList
+	var entries []Entry
+	// dirs holds whether each directory seen is excluded
+	dirs := map[string]bool{base: false}
+	var included func(dir string) (bool, error)
+	included = func(dir string) (bool, error) {
+		if excluded, ok := dirs[dir]; ok {
+			return !excluded, nil
+		}
 
-	return
+		ok, err := included(path.Dir(dir))
+		if err != nil || !ok {
+			dirs[dir] = true
+			return false, err
+		}
+
+		file := filepath.Join(repoRoot, filepath.FromSlash(dir))
+		// a project is nested if git has its config
+		reason := nestedProject(gfs, root, file)
+		if reason == "" {
+			reason = ig.excluded(file, true)
+		}
+		if reason != "" {
+			dirs[dir] = true
+			entries = append(entries, ig.entry(file, true, reason))
+			return false, nil
+		}
+		dirs[dir] = false
+
+		return true, ig.enter(file)
+	}
+	if err := ig.enter(root); err != nil {
+		return nil, err
+	}
+
+	for _, p := range paths {
+		ok, err := included(path.Dir(p))
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		file := filepath.Join(repoRoot, filepath.FromSlash(p))
+		entries = append(entries, ig.entry(file, false, ig.excluded(file, false)))
+	}
+
+	return entries, nil
+}
+
+func isSourceFile(name string) bool {
+	for _, v := range source.Extensions() {
+		if filepath.Ext(name) == v {
+			return true
+		}
+	}
+
+	return false
 }
 
 func FindRepoRoot(fs afero.Fs, path string) (root string, err error) {
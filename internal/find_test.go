@@ -4,12 +4,17 @@
 package dox_test
 
 import (
+	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/jesselang/dox/internal"
 	"github.com/spf13/afero"
+	"github.com/spf13/viper"
 )
 
 var mockRepoRoot = filepath.Clean(filepath.FromSlash("/project/repo"))
@@ -81,3 +86,262 @@ func TestFindAll(t *testing.T) {
 		}
 	}
 }
+
+func TestFindAllIgnores(t *testing.T) {
+	defer viper.Reset()
+
+	fs := afero.NewMemMapFs()
+	for name, content := range map[string]string{
+		".gitignore":                   "# dependencies\nnode_modules/\n*.draft.md\n!keep.draft.md\n",
+		".doxignore":                   "testdata\n",
+		".git/info/exclude":            "/scratch.md\n",
+		"README.md":                    "",
+		"scratch.md":                   "",
+		"docs/scratch.md":              "",
+		"docs/a.draft.md":              "",
+		"docs/keep.draft.md":           "",
+		"docs/.gitignore":              "/generated\n",
+		"docs/generated/api.md":        "",
+		"docs/guides/generated/faq.md": "",
+		"node_modules/pkg/README.md":   "",
+		"internal/testdata/case.md":    "",
+		"vendor/lib/README.md":         "",
+	} {
+		if err := afero.WriteFile(fs, filepath.Join(mockRepoRoot, filepath.FromSlash(name)), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	viper.Set("exclude", []string{"vendor/"})
+
+	files, err := dox.FindAll(fs, mockRepoRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, f := range files {
+		rel, _ := filepath.Rel(mockRepoRoot, f)
+		got = append(got, filepath.ToSlash(rel))
+	}
+	want := []string{
+		"README.md",
+		"docs/guides/generated/faq.md",
+		"docs/keep.draft.md",
+		"docs/scratch.md",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("found %v, want %v", got, want)
+	}
+
+	entries, err := dox.Discover(fs, mockRepoRoot, dox.DiscoverOpts{Exclude: []string{"vendor/"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reasons := map[string]string{}
+	for _, e := range entries {
+		if e.Excluded != "" {
+			reasons[e.Path] = e.Excluded
+		}
+	}
+	for file, reason := range map[string]string{
+		"docs/a.draft.md":   ".gitignore:3: *.draft.md",
+		"docs/generated":    "docs/.gitignore:1: /generated",
+		"internal/testdata": ".doxignore:1: testdata",
+		"node_modules":      ".gitignore:2: node_modules/",
+		"scratch.md":        ".git/info/exclude:1: /scratch.md",
+		"vendor":            "exclude: vendor/",
+	} {
+		if reasons[file] != reason {
+			t.Errorf("%s is excluded by %q, want %q", file, reasons[file], reason)
+		}
+	}
+	if len(reasons) != 6 {
+		t.Errorf("excluded %v", reasons)
+	}
+
+	viper.Set("include", []string{"docs/guides"})
+	files, err = dox.FindAll(fs, mockRepoRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || filepath.Base(files[0]) != "faq.md" {
+		t.Errorf("found %v with include, want only faq.md", files)
+	}
+}
+
+func TestDiscoverProject(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	for name, content := range map[string]string{
+		".git/HEAD":                "",
+		".dox.yaml":                "",
+		"README.md":                "",
+		"docs/.gitignore":          "*.draft.md\n",
+		"docs/svc/.dox.yaml":       "",
+		"docs/svc/a.md":            "",
+		"docs/svc/b.draft.md":      "",
+		"docs/svc/vendor/x.md":     "",
+		"docs/svc/inner/.dox.json": "",
+		"docs/svc/inner/c.md":      "",
+	} {
+		if err := afero.WriteFile(fs, filepath.Join(mockRepoRoot, filepath.FromSlash(name)), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	projects, err := dox.FindProjects(fs, docsRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, p := range projects {
+		paths = append(paths, p.Path)
+	}
+	if want := []string{".", "docs/svc", "docs/svc/inner"}; !reflect.DeepEqual(paths, want) {
+		t.Fatalf("found projects %v, want %v", paths, want)
+	}
+
+	p, err := dox.ProjectOf(projects, filepath.Join(mockRepoRoot, "docs/svc/vendor/x.md"))
+	if err != nil || p.Path != "docs/svc" {
+		t.Errorf("x.md is in project %q (%v), want docs/svc", p.Path, err)
+	}
+
+	for _, tc := range []struct {
+		project string
+		want    map[string]string
+	}{
+		{
+			project: "",
+			want: map[string]string{
+				"README.md": "",
+				"docs/svc":  "has its own .dox.yaml",
+			},
+		},
+		{
+			project: "docs/svc",
+			want: map[string]string{
+				"docs/svc/a.md":       "",
+				"docs/svc/b.draft.md": "docs/.gitignore:1: *.draft.md",
+				"docs/svc/inner":      "has its own .dox.json",
+				"docs/svc/vendor":     "exclude: vendor/",
+			},
+		},
+	} {
+		opts := dox.DiscoverOpts{Exclude: []string{"vendor/"}}
+		if tc.project != "" {
+			opts.Project = filepath.Join(mockRepoRoot, tc.project)
+		}
+		entries, err := dox.Discover(fs, mockRepoRoot, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := map[string]string{}
+		for _, e := range entries {
+			got[e.Path] = e.Excluded
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("project %q: found %v, want %v", tc.project, got, tc.want)
+		}
+	}
+}
+
+// git runs git in dir, failing the test if it fails.
+func git(t *testing.T, dir string, args ...string) {
+	c := exec.Command("git", append([]string{"-c", "user.name=dox", "-c", "user.email=dox@example.com", "-c", "commit.gpgsign=false"}, args...)...)
+	c.Dir = dir
+	if out, err := c.CombinedOutput(); err != nil {
+		t.Fatalf("git %s: %s\n%s", strings.Join(args, " "), err, out)
+	}
+}
+
+func TestDiscoverGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "dox-discover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs := afero.NewOsFs()
+	for name, content := range map[string]string{
+		".gitignore":    "generated/\n",
+		".doxignore":    "drafts/\n",
+		"README.md":     "",
+		"docs/guide.md": "",
+		"drafts/new.md": "",
+	} {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := fs.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := afero.WriteFile(fs, file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git(t, dir, "init", "-q")
+	git(t, dir, "add", ".")
+	git(t, dir, "commit", "-q", "-m", "first")
+
+	paths := func(opts dox.DiscoverOpts) string {
+		entries, err := dox.Discover(fs, dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var paths []string
+		for _, e := range entries {
+			if e.Excluded == "" {
+				paths = append(paths, e.Path)
+			}
+		}
+		return strings.Join(paths, ", ")
+	}
+
+	if got, want := paths(dox.DiscoverOpts{Ref: "HEAD"}), "README.md, docs/guide.md"; got != want {
+		t.Errorf("HEAD has %s, want %s", got, want)
+	}
+
+	// a file ignored by git, but tracked anyway, and an untracked file
+	if err := fs.Mkdir(filepath.Join(dir, "generated"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"generated/api.md", "scratch.md"} {
+		if err := afero.WriteFile(fs, filepath.Join(dir, filepath.FromSlash(name)), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git(t, dir, "add", "-f", "generated/api.md")
+
+	if got, want := paths(dox.DiscoverOpts{}), "README.md, docs/guide.md, scratch.md"; got != want {
+		t.Errorf("walking found %s, want %s", got, want)
+	}
+	if got, want := paths(dox.DiscoverOpts{Git: true}), "README.md, docs/guide.md, generated/api.md"; got != want {
+		t.Errorf("the index has %s, want %s", got, want)
+	}
+	// the staged file is not in HEAD until it is committed
+	if got, want := paths(dox.DiscoverOpts{Ref: "HEAD"}), "README.md, docs/guide.md"; got != want {
+		t.Errorf("HEAD has %s, want %s", got, want)
+	}
+	git(t, dir, "commit", "-q", "-m", "second")
+	if got, want := paths(dox.DiscoverOpts{Ref: "HEAD"}), "README.md, docs/guide.md, generated/api.md"; got != want {
+		t.Errorf("HEAD has %s, want %s", got, want)
+	}
+	if got, want := paths(dox.DiscoverOpts{Ref: "HEAD~1"}), "README.md, docs/guide.md"; got != want {
+		t.Errorf("HEAD~1 has %s, want %s", got, want)
+	}
+
+	// files removed from the working tree are still in git
+	if err := fs.Remove(filepath.Join(dir, "docs", "guide.md")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := paths(dox.DiscoverOpts{Ref: "HEAD"}), "README.md, docs/guide.md, generated/api.md"; got != want {
+		t.Errorf("HEAD has %s, want %s", got, want)
+	}
+
+	if _, err := dox.Discover(fs, dir, dox.DiscoverOpts{Ref: "no-such-ref"}); err == nil {
+		t.Error("discovering from a missing ref succeeded")
+	}
+}
@@ -0,0 +1,376 @@
+package dox
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// gitFs reads the files tracked by git in a repo from git, at a ref or in
+// the index, rather than from the working tree. Files git does not track are
+// not found, unless dox writes them, and paths outside the repo and in .git
+// are those of the working tree.
+//
+// Writes go to the working tree. A tracked file is only written if it is
+// as git has it, so that changes not in git are never overwritten with what
+// git has, and is read from the working tree from then on.
+type gitFs struct {
+	base     afero.Fs
+	repoRoot string
+	// ref is the ref the files are read at, or "" for the index
+	ref string
+
+	// files holds each tracked file, and dirs each directory with tracked
+	// files in it, by path relative to the repo root, with forward slashes
+	files map[string]gitFile
+	dirs  map[string]bool
+
+	// mu guards mem and loaded, which hold the files read from git so far,
+	// and written, which holds the paths written to the working tree
+	mu      sync.Mutex
+	mem     afero.Fs
+	loaded  map[string]bool
+	written map[string]bool
+}
+
+type gitFile struct {
+	object string
+	mode   os.FileMode
+}
+
+// SourcesFs returns the filesystem to read the sources of the repo at path
+// from, as discovered in config: fs itself when walking the working tree,
+// otherwise one that reads the files tracked by git from git, at the ref or
+// in the index.
+func SourcesFs(fs afero.Fs, path string) (afero.Fs, error) {
+	opts, err := discoverOpts(fs, path)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.Git && opts.Ref == "" {
+		return fs, nil
+	}
+
+	repoRoot, err := FindRepoRoot(fs, path)
+	if err != nil {
+		return nil, err
+	}
+
+	return newGitFs(fs, repoRoot, opts.Ref)
+}
+
+// newGitFs lists the files tracked at ref, or in the index if ref is empty,
+// to read them from git.
+func newGitFs(fs afero.Fs, repoRoot string, ref string) (*gitFs, error) {
+	if g, ok := fs.(*gitFs); ok && g.repoRoot == repoRoot && g.ref == ref {
+		return g, nil
+	}
+
+	args := []string{"ls-files", "-z", "--stage"}
+	if ref != "" {
+		if _, err := git(repoRoot, "rev-parse", "--verify", "-q", ref+"^{commit}"); err != nil {
+			return nil, fmt.Errorf("%s is not a commit", ref)
+		}
+		args = []string{"ls-tree", "-r", "-z", "--full-tree", ref}
+	}
+	out, err := git(repoRoot, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &gitFs{
+		base:     fs,
+		repoRoot: repoRoot,
+		ref:      ref,
+		files:    map[string]gitFile{},
+		dirs:     map[string]bool{".": true},
+		mem:      afero.NewMemMapFs(),
+		loaded:   map[string]bool{},
+		written:  map[string]bool{},
+	}
+	for _, line := range strings.Split(out, "\x00") {
+		tab := strings.IndexByte(line, '\t')
+		if tab < 0 {
+			continue
+		}
+		// "<mode> <object> <stage>" in the index, and "<mode> <type>
+		// <object>" in a tree
+		fields := strings.Fields(line[:tab])
+		if len(fields) != 3 {
+			continue
+		}
+		f := gitFile{object: fields[1]}
+		if ref != "" {
+			f.object = fields[2]
+		} else if fields[2] != "0" {
+			// the file has merge conflicts
+			continue
+		}
+		// only regular files, rather than symlinks or submodules
+		switch fields[0] {
+		case "100644":
+			f.mode = 0644
+		case "100755":
+			f.mode = 0755
+		default:
+			continue
+		}
+
+		p := line[tab+1:]
+		g.files[p] = f
+		for dir := path.Dir(p); !g.dirs[dir]; dir = path.Dir(dir) {
+			g.dirs[dir] = true
+		}
+	}
+	for dir := range g.dirs {
+		if err := g.mem.MkdirAll(g.abs(dir), 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	return g, nil
+}
+
+// paths returns the paths of the tracked files, relative to the repo root
+// with forward slashes, in lexical order.
+func (g *gitFs) paths() []string {
+	var paths []string
+	for p := range g.files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	return paths
+}
+
+func (g *gitFs) abs(rel string) string {
+	return filepath.Join(g.repoRoot, filepath.FromSlash(rel))
+}
+
+// describe names where the files are read from, for errors.
+func (g *gitFs) describe() string {
+	if g.ref == "" {
+		return "the index"
+	}
+
+	return g.ref
+}
+
+// rel returns name relative to the repo root, with forward slashes, and
+// whether it is read from git rather than the working tree.
+func (g *gitFs) rel(name string) (string, bool) {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return "", false
+	}
+	rel, err := filepath.Rel(g.repoRoot, abs)
+	if err != nil {
+		return "", false
+	}
+	rel = filepath.ToSlash(rel)
+	if rel == ".." || strings.HasPrefix(rel, "../") || rel == ".git" || strings.HasPrefix(rel, ".git/") {
+		return rel, false
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return rel, !g.written[rel]
+}
+
+// load reads the tracked file at rel from git, and if rel is a directory,
+// the tracked files in it, so that they are in mem.
+func (g *gitFs) load(rel string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var load []string
+	if _, ok := g.files[rel]; ok {
+		load = append(load, rel)
+	} else if g.dirs[rel] {
+		for p := range g.files {
+			if path.Dir(p) == rel {
+				load = append(load, p)
+			}
+		}
+	}
+
+	for _, p := range load {
+		if g.loaded[p] {
+			continue
+		}
+		buf, err := g.blob(p)
+		if err != nil {
+			return err
+		}
+		if err := afero.WriteFile(g.mem, g.abs(p), buf, g.files[p].mode); err != nil {
+			return err
+		}
+		g.loaded[p] = true
+	}
+
+	return nil
+}
+
+// blob returns the content of the tracked file at rel, as git has it.
+func (g *gitFs) blob(rel string) ([]byte, error) {
+	cmd := exec.Command("git", "cat-file", "blob", g.files[rel].object)
+	cmd.Dir = g.repoRoot
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git cat-file: %s: %s: %s", rel, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return out, nil
+}
+
+// write returns an error unless name can be written in the working tree,
+// and reads it from the working tree from then on.
+func (g *gitFs) write(name string) error {
+	rel, fromGit := g.rel(name)
+	if !fromGit {
+		return nil
+	}
+
+	if g.dirs[rel] {
+		return nil
+	}
+	if _, ok := g.files[rel]; ok {
+		want, err := g.blob(rel)
+		if err != nil {
+			return err
+		}
+		current, err := afero.ReadFile(g.base, name)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err != nil || !bytes.Equal(current, want) {
+			return fmt.Errorf("%s is not in the working tree as in %s; dox cannot write to it without losing the changes", rel, g.describe())
+		}
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	// the directories above a file created are in the working tree too
+	for p := rel; !g.dirs[p] && !g.written[p]; p = path.Dir(p) {
+		g.written[p] = true
+	}
+
+	return nil
+}
+
+func (g *gitFs) Name() string {
+	return "gitFs"
+}
+
+func (g *gitFs) Stat(name string) (os.FileInfo, error) {
+	rel, fromGit := g.rel(name)
+	if !fromGit {
+		return g.base.Stat(name)
+	}
+	if err := g.load(rel); err != nil {
+		return nil, err
+	}
+
+	return g.mem.Stat(g.abs(rel))
+}
+
+func (g *gitFs) Open(name string) (afero.File, error) {
+	return g.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (g *gitFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0 {
+		if err := g.write(name); err != nil {
+			return nil, err
+		}
+	}
+
+	rel, fromGit := g.rel(name)
+	if !fromGit {
+		return g.base.OpenFile(name, flag, perm)
+	}
+	if err := g.load(rel); err != nil {
+		return nil, err
+	}
+
+	return g.mem.OpenFile(g.abs(rel), flag, perm)
+}
+
+func (g *gitFs) Create(name string) (afero.File, error) {
+	return g.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (g *gitFs) Mkdir(name string, perm os.FileMode) error {
+	if err := g.write(name); err != nil {
+		return err
+	}
+
+	return g.base.Mkdir(name, perm)
+}
+
+func (g *gitFs) MkdirAll(name string, perm os.FileMode) error {
+	if err := g.write(name); err != nil {
+		return err
+	}
+
+	return g.base.MkdirAll(name, perm)
+}
+
+func (g *gitFs) Remove(name string) error {
+	if err := g.write(name); err != nil {
+		return err
+	}
+
+	return g.base.Remove(name)
+}
+
+func (g *gitFs) RemoveAll(name string) error {
+	if rel, fromGit := g.rel(name); fromGit && g.dirs[rel] {
+		return &os.PathError{Op: "removeall", Path: name, Err: syscall.EPERM}
+	}
+	if err := g.write(name); err != nil {
+		return err
+	}
+
+	return g.base.RemoveAll(name)
+}
+
+func (g *gitFs) Rename(oldname string, newname string) error {
+	if err := g.write(oldname); err != nil {
+		return err
+	}
+	if err := g.write(newname); err != nil {
+		return err
+	}
+
+	return g.base.Rename(oldname, newname)
+}
+
+func (g *gitFs) Chmod(name string, mode os.FileMode) error {
+	if err := g.write(name); err != nil {
+		return err
+	}
+
+	return g.base.Chmod(name, mode)
+}
+
+func (g *gitFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	if err := g.write(name); err != nil {
+		return err
+	}
+
+	return g.base.Chtimes(name, atime, mtime)
+}
@@ -0,0 +1,120 @@
+//go:build !windows
+// +build !windows
+
+package dox_test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/jesselang/dox/internal"
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+)
+
+func TestSourcesFs(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "dox-sources")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer viper.Reset()
+
+	writeFiles(t, dir, map[string]string{
+		"README.md":     "# Readme\n",
+		"docs/guide.md": "# Guide\n",
+		"logo.png":      "logo",
+	})
+	git(t, dir, "init", "-q")
+	git(t, dir, "add", ".")
+	git(t, dir, "commit", "-q", "-m", "first")
+
+	// a change staged, then changed again, a change not staged, and an
+	// untracked file
+	writeFiles(t, dir, map[string]string{"docs/guide.md": "# Guide\n\nStaged.\n"})
+	git(t, dir, "add", "docs/guide.md")
+	writeFiles(t, dir, map[string]string{
+		"docs/guide.md": "# Guide\n\nNot staged.\n",
+		"README.md":     "# Readme\n\nNot staged.\n",
+		"scratch.md":    "# Scratch\n",
+	})
+
+	osFs := afero.NewOsFs()
+	fs, err := dox.SourcesFs(osFs, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fs != osFs {
+		t.Error("expected sources to be read from the working tree when walking it")
+	}
+
+	read := func(fs afero.Fs, name string) string {
+		buf, err := afero.ReadFile(fs, filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			return "(none)"
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf)
+	}
+
+	viper.Set("discover", "git")
+	index, err := dox.SourcesFs(osFs, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"README.md":     "# Readme\n",
+		"docs/guide.md": "# Guide\n\nStaged.\n",
+		"scratch.md":    "(none)",
+	} {
+		if got := read(index, name); got != want {
+			t.Errorf("the index has %s as %q, want %q", name, got, want)
+		}
+	}
+	infos, err := afero.ReadDir(index, filepath.Join(dir, "docs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Name() != "guide.md" || infos[0].Size() != int64(len("# Guide\n\nStaged.\n")) {
+		t.Errorf("expected docs to hold guide.md as staged, got %v", infos)
+	}
+
+	viper.Set("ref", "HEAD")
+	head, err := dox.SourcesFs(osFs, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := read(head, "docs/guide.md"), "# Guide\n"; got != want {
+		t.Errorf("HEAD has docs/guide.md as %q, want %q", got, want)
+	}
+
+	// a file changed in the working tree is not overwritten with what git
+	// has, but one unchanged is written, and read back from the working tree
+	if err := afero.WriteFile(head, filepath.Join(dir, "README.md"), []byte("# Readme\n\nWritten.\n"), 0644); err == nil {
+		t.Error("expected writing a file changed in the working tree to fail")
+	}
+	if got, want := read(osFs, "README.md"), "# Readme\n\nNot staged.\n"; got != want {
+		t.Errorf("expected README.md to be left as %q, got %q", want, got)
+	}
+	for _, name := range []string{"logo.png", "site/index.html"} {
+		file := filepath.Join(dir, name)
+		if err := head.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := afero.WriteFile(head, file, []byte("written"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := read(head, name); got != "written" {
+			t.Errorf("expected %s to be read back as written, got %q", name, got)
+		}
+	}
+}
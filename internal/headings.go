@@ -0,0 +1,150 @@
+package dox
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html"
+)
+
+type heading struct {
+	level int
+	text  string
+}
+
+func headingLevel(tag string) int {
+	if len(tag) == 2 && tag[0] == 'h' && tag[1] >= '1' && tag[1] <= '6' {
+		return int(tag[1] - '0')
+	}
+
+	return 0
+}
+
+func getHeadingsFromHTML(content string) ([]heading, error) {
+	var headings []heading
+	var current *heading
+	z := html.NewTokenizer(strings.NewReader(content))
+	for {
+		tokenType := z.Next()
+		token := z.Token()
+
+		switch tokenType {
+		case html.ErrorToken:
+			if z.Err() != io.EOF {
+				return nil, z.Err()
+			} else {
+				return headings, nil
+			}
+		case html.StartTagToken:
+			if level := headingLevel(token.Data); level > 0 {
+				current = &heading{level: level}
+			}
+		case html.TextToken:
+			if current != nil {
+				current.text += token.Data
+			}
+		case html.EndTagToken:
+			if current != nil && headingLevel(token.Data) == current.level {
+				current.text = strings.TrimSpace(current.text)
+				headings = append(headings, *current)
+				current = nil
+			}
+		}
+	}
+}
+
+// headingSlug returns the anchor name GitHub generates for a heading, which is
+// what authors use when linking to a heading in markdown.
+func headingSlug(text string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(strings.TrimSpace(text)) {
+		switch {
+		case unicode.IsLetter(r), unicode.IsDigit(r), r == '-', r == '_':
+			b.WriteRune(r)
+		case r == ' ':
+			b.WriteRune('-')
+		}
+	}
+
+	return b.String()
+}
+
+// headingSlugs returns the anchor name of each heading, numbering repeated
+// anchor names the way GitHub does.
+func headingSlugs(headings []heading) []string {
+	var slugs []string
+	seen := map[string]int{}
+	for _, h := range headings {
+		slug := headingSlug(h.text)
+		if n := seen[slug]; n > 0 {
+			seen[slug]++
+			slug = fmt.Sprintf("%s-%d", slug, n)
+		} else {
+			seen[slug] = 1
+		}
+		slugs = append(slugs, slug)
+	}
+
+	return slugs
+}
+
+// confluenceAnchor returns the anchor Confluence generates for a heading,
+// which is the page title and heading text with whitespace removed, joined
+// by a hyphen.
+func confluenceAnchor(title string, text string) string {
+	return stripSpace(title) + "-" + stripSpace(text)
+}
+
+// confluenceAnchors returns the anchor Confluence generates for each heading
+// of a page with the given title. Confluence numbers repeated anchors with a
+// suffix of .1, .2 and so on, counting the title as a heading.
+func confluenceAnchors(title string, headings []heading) []string {
+	var anchors []string
+	seen := map[string]int{confluenceAnchor(title, title): 1}
+	for _, h := range headings {
+		anchor := confluenceAnchor(title, h.text)
+		if n := seen[anchor]; n > 0 {
+			seen[anchor]++
+			anchor = fmt.Sprintf("%s.%d", anchor, n)
+		} else {
+			seen[anchor] = 1
+		}
+		anchors = append(anchors, anchor)
+	}
+
+	return anchors
+}
+
+// confluenceAnchorForSlug returns the Confluence anchor for the heading in
+// content whose GitHub anchor name is slug. The title of the page is treated
+// as a heading, and linking to it returns an empty anchor since the title is
+// the top of the page.
+func confluenceAnchorForSlug(title string, content string, slug string) (string, bool, error) {
+	headings, err := getHeadingsFromHTML(content)
+	if err != nil {
+		return "", false, err
+	}
+
+	anchors := confluenceAnchors(title, headings)
+	for i, s := range headingSlugs(append([]heading{{level: 1, text: title}}, headings...)) {
+		if s == slug {
+			if i == 0 {
+				return "", true, nil
+			}
+			return anchors[i-1], true, nil
+		}
+	}
+
+	return "", false, nil
+}
+
+func stripSpace(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, s)
+}
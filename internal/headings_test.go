@@ -0,0 +1,45 @@
+//go:build !windows
+// +build !windows
+
+package dox_test
+
+import (
+	"testing"
+
+	"github.com/jesselang/dox/internal"
+)
+
+func TestConfluenceAnchorForSlug(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+		slug    string
+		anchor  string
+		found   bool
+	}{
+		{"heading", "<h2>Getting Started</h2>", "getting-started", "Guide-GettingStarted", true},
+		{"title", "<h2>Getting Started</h2>", "guide", "", true},
+		{"punctuation", "<h2>What&#39;s new? (v2.0)</h2>", "whats-new-v20", "Guide-What'snew?(v2.0)", true},
+		{"symbols", "<h2>C++ &amp; Go</h2>", "c--go", "Guide-C++&Go", true},
+		{"hyphen and underscore", "<h2>snake_case and kebab-case</h2>", "snake_case-and-kebab-case", "Guide-snake_caseandkebab-case", true},
+		{"inline markup", "<h2>The <code>dox</code> header</h2>", "the-dox-header", "Guide-Thedoxheader", true},
+		{"unicode", "<h2>Über Café</h2>", "über-café", "Guide-ÜberCafé", true},
+		{"case", "<h2>HTTP API</h2>", "http-api", "Guide-HTTPAPI", true},
+		{"first duplicate", "<h2>Usage</h2><h3>Usage</h3><h3>Usage</h3>", "usage", "Guide-Usage", true},
+		{"second duplicate", "<h2>Usage</h2><h3>Usage</h3><h3>Usage</h3>", "usage-1", "Guide-Usage.1", true},
+		{"third duplicate", "<h2>Usage</h2><h3>Usage</h3><h3>Usage</h3>", "usage-2", "Guide-Usage.2", true},
+		{"duplicate slugs of different headings", "<h2>Set up</h2><h2>Set-up</h2>", "set-up-1", "Guide-Set-up", true},
+		{"not a heading", "<p>Getting Started</p>", "getting-started", "", false},
+		{"missing", "<h2>Getting Started</h2>", "nowhere", "", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			anchor, found, err := dox.ConfluenceAnchorForSlug("Guide", tc.content, tc.slug)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if anchor != tc.anchor || found != tc.found {
+				t.Errorf("anchor for #%s is %q, %v, want %q, %v", tc.slug, anchor, found, tc.anchor, tc.found)
+			}
+		})
+	}
+}
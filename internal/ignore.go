@@ -0,0 +1,329 @@
+package dox
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// ignorePattern is one pattern of an ignore file, with the syntax of
+// .gitignore.
+type ignorePattern struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+	// base is the directory, relative to the repo root, that the pattern
+	// applies within
+	base string
+	// source describes where the pattern came from, such as
+	// "docs/.gitignore:3: build/"
+	source string
+}
+
+// parseIgnorePattern parses a line of an ignore file in the directory base.
+// It returns nil for blank lines and comments.
+func parseIgnorePattern(line string, base string, source string) (*ignorePattern, error) {
+	line = strings.TrimRight(line, "\r")
+	// trailing spaces are ignored unless escaped
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+
+	p := &ignorePattern{base: base, source: source}
+	if strings.HasPrefix(line, "!") {
+		p.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return nil, nil
+	}
+
+	// patterns with a slash, other than at the end, are relative to base;
+	// others match a name at any depth
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+
+	expr := globRegexp(line)
+	if anchored {
+		expr = "^" + expr + "$"
+	} else {
+		expr = "(^|/)" + expr + "$"
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid pattern: %s", source, err)
+	}
+	p.re = re
+
+	return p, nil
+}
+
+// globRegexp returns a regular expression matching the same paths as the
+// glob, where * and ? match within a path element and ** matches any number
+// of elements.
+func globRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "/**") && i+3 == len(glob):
+			b.WriteString("/.*")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			b.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	return b.String()
+}
+
+// match reports whether the pattern matches the file at rel, relative to the
+// repo root.
+func (p *ignorePattern) match(rel string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	if p.base != "" {
+		if !strings.HasPrefix(rel, p.base+"/") {
+			return false
+		}
+		rel = strings.TrimPrefix(rel, p.base+"/")
+	}
+
+	return p.re.MatchString(rel)
+}
+
+// ignorer decides which files in a repo are excluded from discovery, by the
+// ignore files found while walking it and by the include and exclude globs in
+// config.
+type ignorer struct {
+	fs       afero.Fs
+	repoRoot string
+	// root is the directory discovery starts from, which the include and
+	// exclude globs are relative to
+	root string
+	// files are the names of the ignore files read in each directory, in
+	// order, so patterns in later files override those in earlier ones
+	files []string
+	// patterns holds the patterns of every ignore file read so far, with
+	// those of deeper directories, which take precedence, after those of the
+	// directories above them
+	patterns []*ignorePattern
+	include  []*ignorePattern
+	exclude  []*ignorePattern
+}
+
+// newIgnorer returns an ignorer for discovery starting from root, a directory
+// of the repo. The ignore files of the directories above root are read, but
+// not those of root itself, which is entered like any other directory.
+func newIgnorer(fs afero.Fs, repoRoot string, root string, files []string, include []string, exclude []string) (*ignorer, error) {
+	ig := &ignorer{fs: fs, repoRoot: repoRoot, root: root, files: files}
+	base := ig.rel(root)
+	if base == "." {
+		base = ""
+	}
+
+	var err error
+	ig.include, err = configPatterns("include", include, base)
+	if err != nil {
+		return nil, err
+	}
+	ig.exclude, err = configPatterns("exclude", exclude, base)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range files {
+		if name != ".gitignore" {
+			continue
+		}
+		// patterns only for this clone of the repo
+		if err := ig.read(filepath.Join(repoRoot, ".git", "info", "exclude"), ""); err != nil {
+			return nil, err
+		}
+	}
+
+	if base != "" {
+		dir := repoRoot
+		for _, name := range strings.Split(base, "/") {
+			if err := ig.enter(dir); err != nil {
+				return nil, err
+			}
+			dir = filepath.Join(dir, name)
+		}
+	}
+
+	return ig, nil
+}
+
+func configPatterns(key string, globs []string, base string) ([]*ignorePattern, error) {
+	var patterns []*ignorePattern
+	for _, glob := range globs {
+		p, err := parseIgnorePattern(glob, base, fmt.Sprintf("%s: %s", key, glob))
+		if err != nil {
+			return nil, err
+		}
+		if p != nil {
+			patterns = append(patterns, p)
+		}
+	}
+
+	return patterns, nil
+}
+
+// enter reads the ignore files of dir, which must not be excluded.
+func (ig *ignorer) enter(dir string) error {
+	rel := ig.rel(dir)
+	if rel == "." {
+		rel = ""
+	}
+
+	for _, name := range ig.files {
+		if err := ig.read(filepath.Join(dir, name), rel); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// read reads the patterns of an ignore file, if it exists.
+func (ig *ignorer) read(file string, base string) error {
+	f, err := ig.fs.Open(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	name := ig.rel(file)
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		p, err := parseIgnorePattern(line, base, fmt.Sprintf("%s:%d: %s", name, n, strings.TrimSpace(line)))
+		if err != nil {
+			return err
+		}
+		if p != nil {
+			ig.patterns = append(ig.patterns, p)
+		}
+	}
+
+	return s.Err()
+}
+
+// excluded returns why file is excluded, or "" if it is not. Files in
+// excluded directories are never visited, as with git.
+func (ig *ignorer) excluded(file string, isDir bool) string {
+	if reason := ig.ignored(file, isDir); reason != "" {
+		return reason
+	}
+
+	rel := ig.rel(file)
+	if !isDir && len(ig.include) > 0 {
+		// a file is included by a pattern matching it or its directory
+		for dir, dirRel := false, rel; dirRel != "."; dir, dirRel = true, path.Dir(dirRel) {
+			for _, p := range ig.include {
+				if p.match(dirRel, dir) && !p.negate {
+					return ""
+				}
+			}
+		}
+		return "not matched by include"
+	}
+
+	return ""
+}
+
+// ignored returns why file is excluded by the ignore files or the exclude
+// globs, or "" if it is not. Unlike excluded, it does not apply the include
+// globs, which only choose the markdown files that are sources, so it also
+// decides which of the other files of the repo, such as images, are ignored.
+func (ig *ignorer) ignored(file string, isDir bool) string {
+	if isDir && isStaticSite(ig.fs, file) {
+		return "static site rendered by dox"
+	}
+
+	rel := ig.rel(file)
+
+	reason := ""
+	for _, p := range ig.patterns {
+		if p.match(rel, isDir) {
+			reason = p.source
+			if p.negate {
+				reason = ""
+			}
+		}
+	}
+	if reason != "" {
+		return reason
+	}
+
+	for _, p := range ig.exclude {
+		if p.match(rel, isDir) && !p.negate {
+			return p.source
+		}
+	}
+
+	return ""
+}
+
+func (ig *ignorer) entry(file string, isDir bool, excluded string) Entry {
+	return Entry{
+		File:     file,
+		Path:     ig.rel(file),
+		IsDir:    isDir,
+		Excluded: excluded,
+	}
+}
+
+func (ig *ignorer) rel(file string) string {
+	rel, err := filepath.Rel(ig.repoRoot, file)
+	if err != nil {
+		return file
+	}
+
+	return filepath.ToSlash(rel)
+}
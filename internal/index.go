@@ -0,0 +1,308 @@
+package dox
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/jesselang/dox/internal/backend"
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+)
+
+// indexProperty is the key of the content property on the landing page that
+// lists the repos publishing under it.
+const indexProperty = "dox-index"
+
+// indexAnchor is the name of the anchor that starts the list of repos in the
+// body of the landing page. Everything after it is replaced when the list is
+// rendered, and everything before it is left alone.
+const indexAnchor = "dox-index"
+
+// indexAttempts is how many times the index is read and changed again when
+// another repo changes it at the same time.
+const indexAttempts = 5
+
+// indexEntry is a repo listed on the landing page.
+type indexEntry struct {
+	Name string `json:"name"`
+	URL  string `json:"url,omitempty"`
+	// PageID is the ID of the root page of the repo, which identifies the
+	// entry.
+	PageID string `json:"page_id"`
+	Title  string `json:"title"`
+}
+
+type repoIndex struct {
+	Repos []indexEntry `json:"repos"`
+}
+
+// Index lists the repo of files on the landing page, which is the parent page
+// in config, or with remove, takes it off the list. The list is kept in a
+// content property of the landing page, so that repos indexing at the same
+// time do not lose each other's changes.
+func Index(fs afero.Fs, files []string, repoRoot string, remove bool, verbose bool, dryRun bool) error {
+	err := getConfigVars()
+	if err != nil {
+		return err
+	}
+
+	b, err := newBackend(fs)
+	if err != nil {
+		return err
+	}
+
+	landing, err := parentPage(b)
+	if err != nil {
+		return err
+	}
+	if landing == nil {
+		return errors.New("parent must be set in config to index the repo")
+	}
+
+	rootID, err := rootPageID(fs, files)
+	if err != nil {
+		return err
+	}
+	if rootID == "" {
+		return errors.New("the root page has not been published yet")
+	}
+	root, err := b.GetPage(rootID)
+	if err != nil {
+		return err
+	}
+
+	entry := indexEntry{
+		Name:   repoName(repoRoot),
+		URL:    repoURL(),
+		PageID: rootID,
+		Title:  root.Title,
+	}
+
+	changed, err := updateIndex(b, landing.ID, entry, remove, dryRun)
+	if err != nil {
+		return err
+	}
+	if verbose || dryRun {
+		action := "listed"
+		if remove {
+			action = "removed"
+		}
+		if changed {
+			fmt.Printf("%s %s on %q\n", action, entry.Name, landing.Title)
+		} else {
+			fmt.Printf("%s is already %s on %q\n", entry.Name, action, landing.Title)
+		}
+	}
+	if dryRun {
+		return nil
+	}
+
+	// rendering an unchanged index would only add a version to the page,
+	// unless it has not been rendered there yet
+	if !changed && strings.Contains(landing.Body, anchorParam()) {
+		return nil
+	}
+
+	return renderIndex(b, landing.ID)
+}
+
+// repoName returns the name of the repo shown on the landing page, which is
+// index.name in config, or else the name of the directory of the project.
+func repoName(repoRoot string) string {
+	if name := viper.GetString("index.name"); name != "" {
+		return name
+	}
+
+	dir := configProject(repoRoot)
+	if dir == "" {
+		dir = repoRoot
+	}
+
+	return filepath.Base(dir)
+}
+
+// repoURL returns the URL of the repo, using index.url in config, or else
+// following browse_url_base to the repo as on GitHub and GitLab. It returns
+// "" if neither gives a URL.
+func repoURL() string {
+	if u := viper.GetString("index.url"); u != "" {
+		return u
+	}
+
+	return browseRepoURL()
+}
+
+// updateIndex adds entry to the index on the landing page, or replaces the
+// entry with the same page ID, or with remove, removes it. It returns whether
+// the index changed, and retries if the index is changed by someone else in
+// the meantime.
+func updateIndex(b backend.Backend, landingID string, entry indexEntry, remove bool, dryRun bool) (bool, error) {
+	for attempt := 1; ; attempt++ {
+		prop, idx, err := getIndex(b, landingID)
+		if err != nil {
+			return false, err
+		}
+
+		var repos []indexEntry
+		for _, e := range idx.Repos {
+			if e.PageID != entry.PageID {
+				repos = append(repos, e)
+			}
+		}
+		if !remove {
+			repos = append(repos, entry)
+		}
+		sort.Slice(repos, func(i, j int) bool {
+			if repos[i].Name != repos[j].Name {
+				return repos[i].Name < repos[j].Name
+			}
+			return repos[i].PageID < repos[j].PageID
+		})
+
+		value, err := json.Marshal(repoIndex{Repos: repos})
+		if err != nil {
+			return false, err
+		}
+		if prop != nil && jsonEqual(prop.Value, value) {
+			return false, nil
+		}
+		if prop == nil && remove {
+			return false, nil
+		}
+		if dryRun {
+			return true, nil
+		}
+
+		if prop == nil {
+			prop = &backend.Property{Key: indexProperty}
+		}
+		prop.Value = value
+		_, err = b.SetProperty(landingID, prop)
+		if err == backend.ErrConflict && attempt < indexAttempts {
+			continue
+		}
+		if err != nil {
+			return false, fmt.Errorf("page %s: could not update the index: %s", landingID, err)
+		}
+
+		return true, nil
+	}
+}
+
+// renderIndex lists the repos in the index on the landing page, if they are
+// not listed already. The page is rendered from the index as it is when the
+// page is updated, so whichever repo updates the page last lists every repo.
+func renderIndex(b backend.Backend, landingID string) error {
+	for attempt := 1; ; attempt++ {
+		page, err := b.GetPage(landingID)
+		if err != nil {
+			return err
+		}
+		_, idx, err := getIndex(b, landingID)
+		if err != nil {
+			return err
+		}
+
+		body := indexBody(page.Body, idx, b)
+		if body == page.Body {
+			return nil
+		}
+
+		page.Body = body
+		page.Version++
+		page.Message = "dox: update index"
+		_, err = b.UpdatePage(page)
+		if err == backend.ErrConflict && attempt < indexAttempts {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("page %s: could not update the index: %s", landingID, err)
+		}
+
+		return nil
+	}
+}
+
+func getIndex(b backend.Backend, landingID string) (*backend.Property, *repoIndex, error) {
+	prop, err := b.GetProperty(landingID, indexProperty)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	idx := &repoIndex{}
+	if prop == nil {
+		return nil, idx, nil
+	}
+	if err := json.Unmarshal(prop.Value, idx); err != nil {
+		return nil, nil, fmt.Errorf("page %s: invalid %s property: %s", landingID, indexProperty, err)
+	}
+
+	return prop, idx, nil
+}
+
+// indexBody returns body with the list of repos in idx after the index
+// anchor, adding the anchor to the end if body has none.
+func indexBody(body string, idx *repoIndex, b backend.Backend) string {
+	param := anchorParam()
+	if i := strings.Index(body, param); i >= 0 {
+		cut := strings.LastIndex(body[:i], "<ac:structured-macro")
+		if cut < 0 {
+			cut = i
+		}
+		// Confluence wraps macros in paragraphs
+		if before := strings.TrimRight(body[:cut], " \n"); strings.HasSuffix(before, "<p>") {
+			cut = len(before) - len("<p>")
+		}
+		body = body[:cut]
+	}
+
+	var s strings.Builder
+	if body = strings.TrimRight(body, " \n"); body != "" {
+		s.WriteString(body + "\n")
+	}
+	fmt.Fprintf(&s, `<p><ac:structured-macro ac:name="anchor" ac:schema-version="1">%s</ac:structured-macro></p>`+"\n", param)
+
+	if len(idx.Repos) == 0 {
+		s.WriteString("<p><em>No repos are listed yet.</em></p>")
+		return s.String()
+	}
+
+	s.WriteString("<table>\n<tbody>\n<tr><th>Repo</th><th>Docs</th></tr>\n")
+	for _, e := range idx.Repos {
+		name := html.EscapeString(e.Name)
+		if e.URL != "" {
+			name = fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(e.URL), name)
+		}
+		fmt.Fprintf(
+			&s,
+			"<tr><td>%s</td><td><a href=\"%s\">%s</a></td></tr>\n",
+			name,
+			html.EscapeString(b.PageURL(e.PageID)),
+			html.EscapeString(e.Title),
+		)
+	}
+	s.WriteString("</tbody>\n</table>")
+
+	return s.String()
+}
+
+// anchorParam returns the parameter of the anchor macro that starts the index.
+func anchorParam() string {
+	return fmt.Sprintf(`<ac:parameter ac:name="">%s</ac:parameter>`, indexAnchor)
+}
+
+// jsonEqual reports whether two JSON documents hold the same values.
+func jsonEqual(a []byte, b []byte) bool {
+	var va, vb interface{}
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(va, vb)
+}
@@ -0,0 +1,188 @@
+package dox
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/jesselang/dox/internal/backend"
+	"github.com/jesselang/dox/internal/source"
+	"github.com/spf13/viper"
+)
+
+// labelsProperty is the key of the content property recording the labels dox
+// manages on a page, so labels added by hand are left alone.
+const labelsProperty = "dox-labels"
+
+type managedLabels struct {
+	Labels []string `json:"labels"`
+}
+
+// labelRule labels every source in a directory of the repo.
+type labelRule struct {
+	Path   string
+	Labels []string
+}
+
+// desiredLabels returns the labels the page of src should have: those of the
+// source, those in config for every page, and those of the label rules for
+// the directory of the source.
+func (p *planner) desiredLabels(src source.Source) ([]string, error) {
+	labels := append([]string(nil), src.Labels()...)
+	labels = append(labels, viper.GetStringSlice("labels")...)
+
+	var rules []labelRule
+	if err := viper.UnmarshalKey("label_rules", &rules); err != nil {
+		return nil, fmt.Errorf("label_rules: %s", err)
+	}
+	if file := p.rel(src.File()); file != "" {
+		for _, rule := range rules {
+			dir := path.Clean(strings.Trim(rule.Path, "/"))
+			if dir == "." || strings.HasPrefix(file, dir+"/") {
+				labels = append(labels, rule.Labels...)
+			}
+		}
+	}
+
+	seen := map[string]bool{}
+	var desired []string
+	for _, l := range labels {
+		// confluence stores labels in lower case
+		l = strings.ToLower(strings.TrimSpace(l))
+		if l == "" || seen[l] {
+			continue
+		}
+		if strings.ContainsAny(l, " \t") {
+			return nil, fmt.Errorf("%s: invalid label %q; labels cannot contain spaces", src.File(), l)
+		}
+		seen[l] = true
+		desired = append(desired, l)
+	}
+	sort.Strings(desired)
+
+	return desired, nil
+}
+
+// labels plans adding the labels the page of src should have, and removing
+// those dox added before that it should no longer have.
+func (p *planner) labels(src source.Source) error {
+	id := p.ids[src.File()]
+
+	desired, err := p.desiredLabels(src)
+	if err != nil {
+		return err
+	}
+
+	var current, managed []string
+	if !isPendingID(id) {
+		current, err = p.b.GetLabels(id)
+		if err != nil {
+			return err
+		}
+		managed, err = getManagedLabels(p.b, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	has := toSet(current)
+	want := toSet(desired)
+
+	changed := len(managed) != len(desired)
+	for _, l := range desired {
+		if !has[l] {
+			changed = true
+		}
+	}
+	var remove []string
+	for _, l := range managed {
+		if !want[l] {
+			changed = true
+			if has[l] {
+				remove = append(remove, l)
+			}
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	p.labelOps = append(p.labelOps, Operation{
+		Op:           OpLabel,
+		Source:       p.rel(src.File()),
+		PageID:       id,
+		Title:        src.Title(),
+		Labels:       desired,
+		RemoveLabels: remove,
+	})
+
+	return nil
+}
+
+// label adds the labels of op to a page and removes its labels to remove,
+// leaving any other labels of the page, and records the labels dox manages.
+func (a *applier) label(id string, op Operation) error {
+	current, err := a.b.GetLabels(id)
+	if err != nil {
+		return err
+	}
+
+	remove := toSet(op.RemoveLabels)
+	var labels []string
+	for _, l := range current {
+		if !remove[l] {
+			labels = append(labels, l)
+		}
+	}
+	labels = append(labels, op.Labels...)
+
+	if err := a.b.SetLabels(id, labels); err != nil {
+		return err
+	}
+
+	return setManagedLabels(a.b, id, op.Labels)
+}
+
+func getManagedLabels(b backend.Backend, pageID string) ([]string, error) {
+	prop, err := b.GetProperty(pageID, labelsProperty)
+	if err != nil || prop == nil {
+		return nil, err
+	}
+
+	var m managedLabels
+	if err := json.Unmarshal(prop.Value, &m); err != nil {
+		return nil, fmt.Errorf("page %s: invalid %s property: %s", pageID, labelsProperty, err)
+	}
+
+	return m.Labels, nil
+}
+
+func setManagedLabels(b backend.Backend, pageID string, labels []string) error {
+	value, err := json.Marshal(managedLabels{Labels: labels})
+	if err != nil {
+		return err
+	}
+
+	prop, err := b.GetProperty(pageID, labelsProperty)
+	if err != nil {
+		return err
+	}
+	if prop == nil {
+		prop = &backend.Property{Key: labelsProperty}
+	}
+	prop.Value = value
+
+	_, err = b.SetProperty(pageID, prop)
+	return err
+}
+
+func toSet(list []string) map[string]bool {
+	set := map[string]bool{}
+	for _, s := range list {
+		set[s] = true
+	}
+
+	return set
+}
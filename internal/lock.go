@@ -0,0 +1,344 @@
+package dox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"os/user"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jesselang/dox/internal/backend"
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+)
+
+// lockProperty is the key of the content property on the root page that
+// locks it while dox changes the pages under it.
+const lockProperty = "dox-lock"
+
+// defaultLockTTL is how long a lock is held for if it is not renewed, such as
+// when dox is killed.
+const defaultLockTTL = 10 * time.Minute
+
+// lockPollInterval is how often a held lock is checked while waiting for it.
+var lockPollInterval = 5 * time.Second
+
+// lockTicker returns the ticks on which a held lock is renewed, every d, and
+// a function to stop them. Tests replace it to renew the lock when they
+// choose.
+var lockTicker = func(d time.Duration) (<-chan time.Time, func()) {
+	t := time.NewTicker(d)
+	return t.C, t.Stop
+}
+
+type lockValue struct {
+	Owner    string    `json:"owner"`
+	Acquired time.Time `json:"acquired"`
+	TTL      string    `json:"ttl"`
+	// Expires is when the lock is no longer held, unless it is renewed. It
+	// is set to the time it is released.
+	Expires time.Time `json:"expires"`
+}
+
+func (v *lockValue) held(now time.Time) bool {
+	return v.Owner != "" && now.Before(v.Expires)
+}
+
+// publishLock is an advisory lock on a page, held while publishing under it
+// so that runs of dox at the same time, such as from CI jobs, do not undo or
+// duplicate each other's changes.
+type publishLock struct {
+	b      backend.Backend
+	pageID string
+	ttl    time.Duration
+
+	// mu guards the property and lost, which renew changes
+	mu    sync.Mutex
+	prop  *backend.Property
+	value lockValue
+	// lost is set if the lock expired or was taken by someone else while
+	// it was held
+	lost error
+	// held is cancelled when the lock is lost
+	held   context.Context
+	cancel context.CancelFunc
+
+	stop        chan struct{}
+	stopped     chan struct{}
+	signals     chan os.Signal
+	releaseOnce sync.Once
+	releaseErr  error
+}
+
+// withLock calls fn while holding the lock on the page, which is left
+// unlocked if pageID is empty. The context passed to fn is cancelled if the
+// lock is lost, such as when it could not be renewed before it expired, and
+// fn should then stop changing pages.
+func withLock(b backend.Backend, pageID string, verbose bool, fn func(ctx context.Context) error) (err error) {
+	if pageID == "" {
+		return fn(context.Background())
+	}
+
+	l, err := acquireLock(b, pageID, verbose)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if releaseErr := l.release(); err == nil {
+			err = releaseErr
+		}
+	}()
+
+	err = fn(l.held)
+	if lost := l.lostErr(); lost != nil {
+		// whatever fn returned, it was cut short by losing the lock
+		return lost
+	}
+
+	return err
+}
+
+// lockPageID returns the page to lock while publishing files: the root page,
+// or the parent page in config if the root page has not been created yet. It
+// returns "" if neither exists, in which case only one run can create the
+// root page, since titles are unique within a space.
+func lockPageID(fs afero.Fs, b backend.Backend, files []string) (string, error) {
+	id, err := rootPageID(fs, files)
+	if err != nil || id != "" {
+		return id, err
+	}
+
+	parent, err := parentPage(b)
+	if err != nil || parent == nil {
+		return "", err
+	}
+
+	return parent.ID, nil
+}
+
+// lockOwner describes who holds a lock, to tell whoever waits for it.
+func lockOwner() string {
+	if owner := viper.GetString("lock.owner"); owner != "" {
+		return owner
+	}
+
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+
+	return fmt.Sprintf("%s@%s (pid %d)", name, host, os.Getpid())
+}
+
+// acquireLock takes the lock on the page, waiting for up to lock.wait in
+// config for whoever holds it to release it. The lock is renewed until it is
+// released, and released if dox is interrupted.
+func acquireLock(b backend.Backend, pageID string, verbose bool) (*publishLock, error) {
+	ttl := viper.GetDuration("lock.ttl")
+	if ttl <= 0 {
+		ttl = defaultLockTTL
+	}
+	wait := viper.GetDuration("lock.wait")
+	deadline := time.Now().Add(wait)
+
+	l := &publishLock{
+		b:      b,
+		pageID: pageID,
+		ttl:    ttl,
+	}
+
+	waiting := false
+	for {
+		prop, err := b.GetProperty(pageID, lockProperty)
+		if err != nil {
+			return nil, err
+		}
+
+		var current lockValue
+		if prop != nil {
+			if err := json.Unmarshal(prop.Value, &current); err != nil {
+				return nil, fmt.Errorf("page %s: invalid %s property: %s", pageID, lockProperty, err)
+			}
+		}
+
+		now := time.Now()
+		if current.held(now) {
+			if !now.Before(deadline) {
+				return nil, fmt.Errorf(
+					"page %s is locked by %s since %s, until %s; wait for it with --lock-wait",
+					pageID,
+					current.Owner,
+					current.Acquired.Format(time.RFC3339),
+					current.Expires.Format(time.RFC3339),
+				)
+			}
+			if !waiting {
+				fmt.Printf("waiting for the lock held by %s since %s\n", current.Owner, current.Acquired.Format(time.RFC3339))
+				waiting = true
+			}
+			// check again no later than when the lock expires
+			sleep := lockPollInterval
+			if d := current.Expires.Sub(now); d < sleep {
+				sleep = d
+			}
+			if d := deadline.Sub(now); d < sleep {
+				sleep = d
+			}
+			time.Sleep(sleep)
+			continue
+		}
+
+		if prop == nil {
+			prop = &backend.Property{Key: lockProperty}
+		}
+		l.prop = prop
+		l.value = lockValue{
+			Owner:    lockOwner(),
+			Acquired: now.UTC().Truncate(time.Second),
+			TTL:      ttl.String(),
+		}
+		err = l.store(now.Add(ttl))
+		if err == backend.ErrConflict {
+			// someone else took the lock first
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+
+	if verbose {
+		fmt.Printf("locked page %s\n", pageID)
+	}
+
+	l.held, l.cancel = context.WithCancel(context.Background())
+	l.stop = make(chan struct{})
+	l.stopped = make(chan struct{})
+	go l.renew()
+
+	l.signals = make(chan os.Signal, 1)
+	signal.Notify(l.signals, os.Interrupt, syscall.SIGTERM)
+	go l.releaseOnSignal()
+
+	return l, nil
+}
+
+// store stores the lock with the given expiry, as the next version of the
+// property.
+func (l *publishLock) store(expires time.Time) error {
+	l.value.Expires = expires.UTC()
+	value, err := json.Marshal(l.value)
+	if err != nil {
+		return err
+	}
+
+	prop := *l.prop
+	prop.Value = value
+	stored, err := l.b.SetProperty(l.pageID, &prop)
+	if err != nil {
+		return err
+	}
+	l.prop = stored
+
+	return nil
+}
+
+// renew extends the lock before it expires, until it is released or lost.
+// A renewal that fails is retried at the next tick, until the lock expires.
+func (l *publishLock) renew() {
+	defer close(l.stopped)
+
+	ticks, stop := lockTicker(l.ttl / 3)
+	defer stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticks:
+		}
+
+		l.mu.Lock()
+		expires := l.value.Expires
+		err := l.store(time.Now().Add(l.ttl))
+		switch {
+		case err == backend.ErrConflict:
+			l.lost = fmt.Errorf("page %s: the lock was taken by someone else while publishing", l.pageID)
+		case err != nil && !time.Now().Before(expires):
+			l.lost = fmt.Errorf("page %s: the lock expired while publishing, as it could not be renewed: %s", l.pageID, err)
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "warning: could not renew the lock on page %s: %s\n", l.pageID, err)
+		}
+		lost := l.lost != nil
+		l.mu.Unlock()
+
+		if lost {
+			l.cancel()
+			return
+		}
+	}
+}
+
+// lostErr returns why the lock was lost, or nil if it is still held.
+func (l *publishLock) lostErr() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.lost
+}
+
+// releaseOnSignal releases the lock and exits when dox is interrupted.
+func (l *publishLock) releaseOnSignal() {
+	sig, ok := <-l.signals
+	if !ok {
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "%s: releasing the lock on page %s\n", sig, l.pageID)
+	if err := l.release(); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+	}
+
+	code := 1
+	if s, ok := sig.(syscall.Signal); ok {
+		code = 128 + int(s)
+	}
+	os.Exit(code)
+}
+
+// release releases the lock, if it is still held. It is safe to call more
+// than once, and at the same time.
+func (l *publishLock) release() error {
+	l.releaseOnce.Do(func() {
+		// renew is stopped before taking mu, which it takes for each renewal
+		close(l.stop)
+		<-l.stopped
+		l.cancel()
+		// no signals are delivered once Stop returns, so closing the
+		// channel ends releaseOnSignal
+		signal.Stop(l.signals)
+		close(l.signals)
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.lost != nil {
+			// someone else holds it now
+			return
+		}
+		err := l.store(time.Now())
+		if err == backend.ErrConflict {
+			err = fmt.Errorf("page %s: the lock expired and was taken by someone else while publishing", l.pageID)
+		}
+		l.releaseErr = err
+	})
+
+	return l.releaseErr
+}
@@ -0,0 +1,165 @@
+package dox
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+type netrcEntry struct {
+	login    string
+	password string
+}
+
+// netrcPath returns the path of the user's netrc file, which can be changed
+// with the NETRC environment variable.
+func netrcPath() string {
+	if path := os.Getenv("NETRC"); path != "" {
+		return path
+	}
+
+	// os.UserHomeDir needs Go 1.12
+	home := os.Getenv("HOME")
+	if home == "" {
+		u, err := user.Current()
+		if err != nil {
+			return ""
+		}
+		home = u.HomeDir
+	}
+
+	return filepath.Join(home, ".netrc")
+}
+
+// getNetrcEntry returns the entry for host in the netrc file at path,
+// falling back to the default entry. A nil entry is returned if the file
+// does not exist or has no matching entry.
+func getNetrcEntry(path string, host string) (*netrcEntry, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var match, fallback *netrcEntry
+	var current *netrcEntry
+	inMacro := false
+	// key is the keyword the next token is the value of, which may be on
+	// the next line
+	key := ""
+
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+
+		// macro definitions run until the next blank line
+		if inMacro {
+			if strings.TrimSpace(line) == "" {
+				inMacro = false
+			}
+			continue
+		}
+
+		tokens, err := netrcTokens(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, n, err)
+		}
+		for _, token := range tokens {
+			if key != "" {
+				switch key {
+				case "machine":
+					if token == host && match == nil {
+						match = &netrcEntry{}
+						current = match
+					}
+				case "login":
+					if current != nil {
+						current.login = token
+					}
+				case "password":
+					if current != nil {
+						current.password = token
+					}
+				}
+				key = ""
+				continue
+			}
+
+			switch token {
+			case "machine":
+				current = nil
+				key = token
+			case "default":
+				current = nil
+				if fallback == nil {
+					fallback = &netrcEntry{}
+					current = fallback
+				}
+			case "login", "password", "account":
+				key = token
+			case "macdef":
+				// the rest of the line names the macro, and its
+				// definition follows
+				inMacro = true
+			}
+			if inMacro {
+				break
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	if match != nil {
+		return match, nil
+	}
+
+	return fallback, nil
+}
+
+// netrcTokens splits a line of a netrc file into tokens, which are separated
+// by whitespace. A token in double quotes may contain whitespace, and a
+// backslash in it escapes the next character.
+func netrcTokens(line string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(line); {
+		if line[i] == ' ' || line[i] == '\t' || line[i] == '\r' {
+			i++
+			continue
+		}
+
+		var b strings.Builder
+		if line[i] != '"' {
+			for ; i < len(line) && line[i] != ' ' && line[i] != '\t' && line[i] != '\r'; i++ {
+				b.WriteByte(line[i])
+			}
+			tokens = append(tokens, b.String())
+			continue
+		}
+
+		closed := false
+		for i++; i < len(line); i++ {
+			if line[i] == '\\' && i+1 < len(line) {
+				i++
+			} else if line[i] == '"' {
+				closed = true
+				i++
+				break
+			}
+			b.WriteByte(line[i])
+		}
+		if !closed {
+			return nil, errors.New("unterminated quoted string")
+		}
+		tokens = append(tokens, b.String())
+	}
+
+	return tokens, nil
+}
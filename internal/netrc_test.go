@@ -0,0 +1,86 @@
+//go:build !windows
+// +build !windows
+
+package dox_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jesselang/dox/internal"
+)
+
+func TestNetrcEntry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dox-netrc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		name     string
+		netrc    string
+		login    string
+		password string
+		found    bool
+	}{
+		{"one line", "machine wiki.example.com login user password secret\n", "user", "secret", true},
+		{"one token per line", "machine wiki.example.com\n  login user\n  password secret\n", "user", "secret", true},
+		{"value on the next line", "machine\nwiki.example.com login\nuser password\nsecret\n", "user", "secret", true},
+		{"no trailing newline", "machine wiki.example.com login user password secret", "user", "secret", true},
+		{"tabs", "machine\twiki.example.com\tlogin\tuser\tpassword\tsecret\n", "user", "secret", true},
+		{"crlf", "machine wiki.example.com\r\nlogin user\r\npassword secret\r\n", "user", "secret", true},
+		{"multiple machines", "machine git.example.com login git password one\nmachine wiki.example.com login user password two\nmachine ci.example.com login ci password three\n", "user", "two", true},
+		{"first match", "machine wiki.example.com login first password one\nmachine wiki.example.com login second password two\n", "first", "one", true},
+		{"host is not a prefix", "machine wiki.example.com.evil login evil password evil\n", "", "", false},
+		{"account", "machine wiki.example.com login user account team password secret\n", "user", "secret", true},
+		{"default", "machine git.example.com login git password one\ndefault login anonymous password guest\n", "anonymous", "guest", true},
+		{"machine before default", "machine wiki.example.com login user password secret\ndefault login anonymous password guest\n", "user", "secret", true},
+		{"login only", "machine wiki.example.com login user\n", "user", "", true},
+		{"no match", "machine git.example.com login git password one\n", "", "", false},
+		{"empty", "", "", "", false},
+		{"macdef", "macdef init\nmachine wiki.example.com login evil password evil\n\nmachine wiki.example.com login user password secret\n", "user", "secret", true},
+		{"macdef after machine", "machine git.example.com login git password one macdef init\ncd /pub\nmachine wiki.example.com login evil password evil\n\nmachine wiki.example.com login user password secret\n", "user", "secret", true},
+		{"quoted", `machine wiki.example.com login "first last" password "pass word"` + "\n", "first last", "pass word", true},
+		{"quoted escapes", `machine wiki.example.com login user password "a \"quoted\" \\ value"` + "\n", "user", `a "quoted" \ value`, true},
+		{"quoted empty", `machine wiki.example.com login user password ""` + "\n", "user", "", true},
+		{"quoted keyword", `machine wiki.example.com login user password "machine"` + "\n", "user", "machine", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, "netrc")
+			if err := ioutil.WriteFile(path, []byte(tc.netrc), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			login, password, found, err := dox.NetrcEntry(path, "wiki.example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if login != tc.login || password != tc.password || found != tc.found {
+				t.Errorf("entry is %q, %q, %v, want %q, %q, %v", login, password, found, tc.login, tc.password, tc.found)
+			}
+		})
+	}
+}
+
+func TestNetrcEntryErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dox-netrc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, _, found, err := dox.NetrcEntry(filepath.Join(dir, "missing"), "wiki.example.com"); found || err != nil {
+		t.Errorf("missing netrc file returned %v, %v", found, err)
+	}
+
+	path := filepath.Join(dir, "netrc")
+	if err := ioutil.WriteFile(path, []byte("machine wiki.example.com\nlogin user password \"secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := dox.NetrcEntry(path, "wiki.example.com"); err == nil || err.Error() != path+":2: unterminated quoted string" {
+		t.Errorf("unterminated quote returned %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package dox
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jesselang/dox/internal/backend"
+	"github.com/spf13/viper"
+)
+
+var pageIDRegexp = regexp.MustCompile(`^\d+$`)
+
+// parentPage returns the page set by parent in config, which the root page is
+// published under, or nil if the root page is at the top of the space. The
+// parent is given by its page ID, or by a path of titles, as a list or
+// separated by slashes. Since titles are unique within a space, the first
+// title may be that of any page, and each title after it is that of a child
+// of the page before.
+func parentPage(b backend.Backend) (*backend.Page, error) {
+	var titles []string
+	switch parent := viper.Get("parent").(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		for _, title := range parent {
+			titles = append(titles, fmt.Sprint(title))
+		}
+	case []string:
+		titles = parent
+	default:
+		value := strings.TrimSpace(fmt.Sprint(parent))
+		if value == "" {
+			return nil, nil
+		}
+		if pageIDRegexp.MatchString(value) {
+			page, err := b.GetPage(value)
+			if err != nil {
+				return nil, fmt.Errorf("parent page %s: %s", value, err)
+			}
+			return page, nil
+		}
+		for _, title := range strings.Split(value, "/") {
+			titles = append(titles, strings.TrimSpace(title))
+		}
+	}
+
+	if len(titles) == 0 {
+		return nil, nil
+	}
+
+	page, err := b.FindPage(titles[0])
+	if err != nil {
+		return nil, err
+	}
+	if page == nil {
+		return nil, fmt.Errorf("parent page %q not found in space %s", titles[0], space)
+	}
+
+	for i, title := range titles[1:] {
+		children, err := b.GetChildren(page.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		var child *backend.Page
+		for _, c := range children {
+			if c.Title == title {
+				child = c
+			}
+		}
+		if child == nil {
+			return nil, fmt.Errorf("parent page %q not found under %q", title, strings.Join(titles[:i+1], "/"))
+		}
+		page = child
+	}
+
+	return page, nil
+}
@@ -0,0 +1,531 @@
+package dox
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/jesselang/dox/internal/backend"
+	"github.com/jesselang/dox/internal/source"
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+)
+
+// The kinds of operation in a plan.
+const (
+	OpCreate = "create"
+	OpMove   = "move"
+	OpUpload = "upload"
+	OpUpdate = "update"
+	OpLabel  = "label"
+	OpPrune  = "prune"
+)
+
+// stubBody is the body of a page when it is created, before its content is
+// published.
+const stubBody = "This is a page stub created by dox."
+
+// Operation is one change to the wiki.
+type Operation struct {
+	Op string `json:"op"`
+	// Source is the file of the source the page is published from, relative
+	// to the repo root. It is empty for the dox default root page and for
+	// pages that are pruned.
+	Source string `json:"source,omitempty"`
+	// PageID is the ID of the page, or a pending ID for a page created by an
+	// earlier operation.
+	PageID   string `json:"page_id"`
+	Title    string `json:"title"`
+	ParentID string `json:"parent_id,omitempty"`
+	// ParentTitle is the title of the parent, to show where pages go.
+	ParentTitle string `json:"parent_title,omitempty"`
+	// Version is the version of the page the operation was planned from.
+	// Pages are updated to the version after it.
+	Version int    `json:"version,omitempty"`
+	Body    string `json:"body,omitempty"`
+	// Message is the version message of an update.
+	Message string `json:"message,omitempty"`
+	// File is the file uploaded as an attachment, relative to the repo root.
+	File string `json:"file,omitempty"`
+	// Labels are the labels the page has after the operation, and
+	// RemoveLabels are those dox added before that it no longer has.
+	Labels       []string `json:"labels,omitempty"`
+	RemoveLabels []string `json:"remove_labels,omitempty"`
+}
+
+// Plan is the set of changes publishing would make to the wiki, in the order
+// they are made.
+type Plan struct {
+	URI   string `json:"uri"`
+	Space string `json:"space"`
+	// Project is the directory of the project the plan is for, relative to
+	// the repo root, unless it is the repo root.
+	Project string `json:"project,omitempty"`
+	// Target is the name of the target in config the plan is for, if any.
+	Target string `json:"target,omitempty"`
+	// LockID is the ID of the page locked while the plan is applied: the
+	// root page, or its parent until the root page is created.
+	LockID     string      `json:"lock_id,omitempty"`
+	Operations []Operation `json:"operations"`
+}
+
+// pendingID returns the ID standing in for the nth page created by a plan,
+// until the page is created and its real ID is known.
+func pendingID(n int) string {
+	return fmt.Sprintf("{pending:%d}", n)
+}
+
+func isPendingID(id string) bool {
+	return strings.HasPrefix(id, "{pending:")
+}
+
+// ReadPlan reads a plan written by Plan.Write.
+func ReadPlan(path string) (*Plan, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var p Plan
+	if err := json.Unmarshal(buf, &p); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	return &p, nil
+}
+
+// Write writes the plan as JSON to path.
+func (p *Plan) Write(path string) error {
+	buf, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, append(buf, '\n'), 0644)
+}
+
+// String describes each operation of the plan on a line of its own.
+func (p *Plan) String() string {
+	if len(p.Operations) == 0 {
+		return "no changes\n"
+	}
+
+	var b strings.Builder
+	for _, op := range p.Operations {
+		b.WriteString(op.String())
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(&b, "%d changes\n", len(p.Operations))
+
+	return b.String()
+}
+
+func (op Operation) String() string {
+	page := fmt.Sprintf("%q (%s)", op.Title, op.PageID)
+
+	switch op.Op {
+	case OpCreate:
+		s := fmt.Sprintf("create %s", page)
+		if op.ParentID != "" {
+			s += fmt.Sprintf(" under %q", op.ParentTitle)
+		}
+		if op.Source != "" {
+			s += " from " + op.Source
+		}
+		return s
+	case OpMove:
+		return fmt.Sprintf("move %s under %q", page, op.ParentTitle)
+	case OpUpload:
+		return fmt.Sprintf("upload %s to %s", op.File, page)
+	case OpUpdate:
+		if isPendingID(op.PageID) {
+			return fmt.Sprintf("update %s", page)
+		}
+		return fmt.Sprintf("update %s from version %d", page, op.Version)
+	case OpLabel:
+		s := fmt.Sprintf("label %s", page)
+		if len(op.Labels) > 0 {
+			s += " with " + strings.Join(op.Labels, ", ")
+		}
+		if len(op.RemoveLabels) > 0 {
+			s += ", removing " + strings.Join(op.RemoveLabels, ", ")
+		}
+		return s
+	case OpPrune:
+		return fmt.Sprintf("prune %s", page)
+	default:
+		return fmt.Sprintf("%s %s", op.Op, page)
+	}
+}
+
+// planner works out the operations that publish sources.
+type planner struct {
+	fs       afero.Fs
+	b        backend.Backend
+	repoRoot string
+	// commits is set if the commits of sources can be looked up in git
+	commits bool
+
+	// ids maps the file of each source to the ID of its page, which is
+	// pending for pages that are created by the plan
+	ids     map[string]string
+	pending int
+	// pages caches the pages fetched from the wiki by ID
+	pages map[string]*backend.Page
+
+	creates  []Operation
+	moves    []Operation
+	uploads  []Operation
+	updates  []Operation
+	labelOps []Operation
+	prunes   []Operation
+}
+
+// makePlan plans publishing every source when changed is nil, otherwise only
+// the sources affected by the changed files. Pages under the root that are
+// not published from a source are pruned if prune is set. Nothing is
+// changed, in the wiki or in the repo.
+func makePlan(fs afero.Fs, b backend.Backend, files []string, changed []string, repoRoot string, prune bool) (*Plan, error) {
+	p := &planner{
+		fs:       fs,
+		b:        b,
+		repoRoot: repoRoot,
+		commits:  hasCommits(repoRoot),
+		ids:      map[string]string{},
+		pages:    map[string]*backend.Page{},
+	}
+
+	// make sources out of each file
+	var sources []source.Source
+	for _, file := range files {
+		opts := sourceOpts(fs)
+		opts.StripComments = true
+		opts.TrimSpace = true
+		opts.DoxNoticeFileUrl = fileBrowseUrl(browseUrlBase, repoRoot, file)
+		src, err := source.New(file, opts)
+		if err != nil {
+			return nil, err
+		}
+		if src.Ignore() {
+			continue
+		}
+		sources = append(sources, src)
+	}
+
+	// try to find root page
+	rootPageSrc, err := getRootPageSrc(sources)
+	if err != nil {
+		return nil, err
+	}
+
+	if rootPageSrc == nil {
+		// create dox default root page
+		rootPageSrc, err = source.New("", sourceOpts(fs))
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, rootPageSrc)
+	}
+
+	parentID, parentTitle := "", ""
+	parent, err := parentPage(b)
+	if err != nil {
+		return nil, err
+	}
+	if parent != nil {
+		parentID, parentTitle = parent.ID, parent.Title
+	}
+
+	rootID, err := p.stub(rootPageSrc, parentID, parentTitle)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, src := range sources {
+		if src == rootPageSrc {
+			continue
+		}
+		if _, err := p.stub(src, rootID, rootPageSrc.Title()); err != nil {
+			return nil, err
+		}
+	}
+
+	if changed != nil {
+		affected, err := affectedSources(sources, changed)
+		if err != nil {
+			return nil, err
+		}
+
+		// new sources are published whether or not they changed
+		isAffected := map[source.Source]bool{}
+		for _, src := range affected {
+			isAffected[src] = true
+		}
+		var publish []source.Source
+		for _, src := range sources {
+			if isAffected[src] || isPendingID(p.ids[src.File()]) {
+				publish = append(publish, src)
+			}
+		}
+		sources = publish
+	}
+
+	for _, src := range sources {
+		if err := p.content(src); err != nil {
+			return nil, err
+		}
+		if err := p.labels(src); err != nil {
+			return nil, err
+		}
+	}
+
+	if prune && !isPendingID(rootID) {
+		if err := p.prune(rootID, rootPageSrc.Title()); err != nil {
+			return nil, err
+		}
+	}
+
+	lockID := rootID
+	if isPendingID(rootID) {
+		lockID = parentID
+	}
+
+	var ops []Operation
+	ops = append(ops, p.creates...)
+	ops = append(ops, p.moves...)
+	ops = append(ops, p.uploads...)
+	ops = append(ops, p.updates...)
+	ops = append(ops, p.labelOps...)
+	ops = append(ops, p.prunes...)
+
+	return &Plan{
+		URI:        uri,
+		Space:      space,
+		Project:    projectPath(repoRoot),
+		Target:     viper.GetString("target"),
+		LockID:     lockID,
+		Operations: ops,
+	}, nil
+}
+
+// stub plans creating the page of src under parentID if it does not exist
+// yet, or moving it back under parentID if it has been moved elsewhere, and
+// returns the ID of the page.
+func (p *planner) stub(src source.Source, parentID string, parentTitle string) (string, error) {
+	if id := src.ID(); id != "" {
+		p.ids[src.File()] = id
+		if parentID == "" {
+			return id, nil
+		}
+
+		page, err := p.page(id)
+		if err != nil {
+			return "", err
+		}
+		if page.ParentID != parentID {
+			p.moves = append(p.moves, Operation{
+				Op:          OpMove,
+				Source:      p.rel(src.File()),
+				PageID:      id,
+				Title:       page.Title,
+				ParentID:    parentID,
+				ParentTitle: parentTitle,
+				Version:     page.Version,
+			})
+			// moving the page updates it
+			page.Version++
+			page.ParentID = parentID
+		}
+
+		return id, nil
+	}
+
+	p.pending++
+	id := pendingID(p.pending)
+	p.ids[src.File()] = id
+	p.creates = append(p.creates, Operation{
+		Op:          OpCreate,
+		Source:      p.rel(src.File()),
+		PageID:      id,
+		Title:       src.Title(),
+		ParentID:    parentID,
+		ParentTitle: parentTitle,
+	})
+
+	return id, nil
+}
+
+// content plans uploading the images of src and updating its page with the
+// content of src, if it has changed.
+func (p *planner) content(src source.Source) error {
+	id := p.ids[src.File()]
+
+	page := &backend.Page{ID: id, Title: src.Title(), Body: stubBody, Version: 1}
+	if !isPendingID(id) {
+		var err error
+		page, err = p.page(id)
+		if err != nil {
+			// TODO: handle 404 where dox id exists in source, but published page does not
+			return err
+		}
+	}
+
+	sourceOutput := src.Output()
+
+	imageSrcFiles, err := getImageSrcFiles(p.fs, sourceOutput, src.File())
+	if err != nil {
+		return err
+	}
+
+	uploaded := map[string]bool{}
+	for _, imageSrcFile := range imageSrcFiles {
+		path := filepath.Join(filepath.Dir(src.File()), imageSrcFile)
+		if uploaded[path] {
+			continue
+		}
+		uploaded[path] = true
+
+		changed, err := p.attachmentChanged(id, path)
+		if err != nil {
+			return err
+		}
+		if changed {
+			p.uploads = append(p.uploads, Operation{
+				Op:     OpUpload,
+				Source: p.rel(src.File()),
+				PageID: id,
+				Title:  src.Title(),
+				File:   p.rel(path),
+			})
+		}
+	}
+
+	pageContent := replaceImagesWithAttachments(imageSrcFiles, sourceOutput, id, p.b)
+
+	pageContent, err = replaceRelativeLinks(p.fs, src.File(), pageContent, p.b, browseUrlBase, p.repoRoot, p.ids)
+	if err != nil {
+		return err
+	}
+
+	var commit *commitInfo
+	if p.commits && src.File() != "" {
+		commit, err = lastCommit(p.repoRoot, src.File())
+		if err != nil {
+			return err
+		}
+	}
+	message := ""
+	if commit != nil {
+		message = commit.versionMessage()
+		if viper.GetBool("commit_footer") {
+			pageContent += commit.footer()
+		}
+	}
+
+	// TODO: Confluence assigns a unique macro id to each macro in page. If a page contains macros,
+	//       this condition will always be true since dox source does not contain macro ids.
+	if page.Body != pageContent || page.Title != src.Title() {
+		p.updates = append(p.updates, Operation{
+			Op:       OpUpdate,
+			Source:   p.rel(src.File()),
+			PageID:   id,
+			Title:    src.Title(),
+			ParentID: page.ParentID,
+			Version:  page.Version,
+			Body:     pageContent,
+			Message:  message,
+		})
+	}
+
+	return nil
+}
+
+// attachmentChanged reports whether the file at path differs from the
+// attachment of the page with the same name.
+func (p *planner) attachmentChanged(pageID string, path string) (bool, error) {
+	if isPendingID(pageID) {
+		return true, nil
+	}
+
+	data, err := p.b.GetAttachment(pageID, filepath.Base(path))
+	if err != nil {
+		return false, err
+	}
+	if data == nil {
+		return true, nil
+	}
+
+	fileSum, err := backend.FileSha256(p.fs, path)
+	if err != nil {
+		return false, err
+	}
+
+	return fileSum != backend.BytesSha256(data), nil
+}
+
+// prune plans deleting the pages under the root that were published by dox,
+// but are no longer published from a source.
+func (p *planner) prune(rootID string, rootTitle string) error {
+	published := map[string]bool{}
+	for _, id := range p.ids {
+		published[id] = true
+	}
+
+	children, err := p.b.GetChildren(rootID)
+	if err != nil {
+		return err
+	}
+
+	for _, child := range children {
+		if published[child.ID] {
+			continue
+		}
+		byDox, err := publishedByDox(p.b, child)
+		if err != nil {
+			return err
+		}
+		if !byDox {
+			continue
+		}
+		p.prunes = append(p.prunes, Operation{
+			Op:          OpPrune,
+			PageID:      child.ID,
+			Title:       child.Title,
+			ParentID:    rootID,
+			ParentTitle: rootTitle,
+			Version:     child.Version,
+		})
+	}
+
+	return nil
+}
+
+func (p *planner) page(id string) (*backend.Page, error) {
+	if page, ok := p.pages[id]; ok {
+		return page, nil
+	}
+
+	page, err := p.b.GetPage(id)
+	if err != nil {
+		return nil, err
+	}
+	p.pages[id] = page
+
+	return page, nil
+}
+
+// rel returns file relative to the repo root, as it is written in plans.
+func (p *planner) rel(file string) string {
+	if file == "" {
+		return ""
+	}
+
+	rel, err := filepath.Rel(p.repoRoot, file)
+	if err != nil {
+		return file
+	}
+
+	return filepath.ToSlash(rel)
+}
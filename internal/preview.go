@@ -0,0 +1,290 @@
+package dox
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"strings"
+
+	xhtml "golang.org/x/net/html"
+)
+
+// previewStylesheet approximates the default Confluence page theme closely
+// enough to judge how a page will look once it is published.
+const previewStylesheet = `
+body {
+  margin: 0;
+  color: #172b4d;
+  font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, "Noto Sans", Ubuntu, "Droid Sans", "Helvetica Neue", sans-serif;
+  font-size: 14px;
+  line-height: 1.714;
+}
+a { color: #0052cc; text-decoration: none; }
+a:hover { text-decoration: underline; }
+.dox-header { padding: 8px 40px; border-bottom: 1px solid #dfe1e6; background: #f4f5f7; font-size: 12px; }
+.dox-page { max-width: 760px; margin: 0 auto; padding: 24px 40px 80px; }
+.dox-title { font-size: 24px; font-weight: 500; letter-spacing: -0.01em; margin: 16px 0 24px; }
+h1 { font-size: 24px; font-weight: 500; margin: 1.667em 0 0; }
+h2 { font-size: 20px; font-weight: 500; margin: 1.8em 0 0; }
+h3 { font-size: 16px; font-weight: 600; margin: 2em 0 0; }
+h4 { font-size: 14px; font-weight: 600; margin: 1.357em 0 0; }
+h5, h6 { font-size: 12px; font-weight: 600; margin: 1.667em 0 0; }
+p { margin: 10px 0 0; }
+code { background: #f4f5f7; padding: 0 4px; font-family: SFMono-Medium, "SF Mono", Menlo, Consolas, monospace; font-size: 12px; }
+pre { background: #f4f5f7; border: 1px solid #dfe1e6; border-radius: 3px; padding: 8px 12px; overflow-x: auto; }
+pre code { padding: 0; }
+blockquote { border-left: 2px solid #dfe1e6; margin: 10px 0 0 19px; padding-left: 20px; color: #6b778c; }
+table { border-collapse: collapse; margin: 10px 0 0; }
+th, td { border: 1px solid #c1c7d0; padding: 7px 10px; vertical-align: top; text-align: left; }
+th { background: #f4f5f7; font-weight: 600; }
+img { max-width: 100%; }
+.dox-macro { border-radius: 3px; padding: 8px 12px 8px 16px; margin: 10px 0 0; }
+.dox-macro-title { font-weight: 600; margin: 0; }
+.dox-macro-info { background: #deebff; }
+.dox-macro-note { background: #eae6ff; }
+.dox-macro-tip { background: #e3fcef; }
+.dox-macro-warning { background: #ffebe6; }
+.dox-macro-unknown { border: 1px dashed #c1c7d0; }
+.dox-toc { list-style: none; padding-left: 0; }
+`
+
+// previewReloadScript polls the preview server and reloads the page once any
+// file in the repository that is not ignored has changed.
+const previewReloadScript = `
+(function() {
+  var stamp = %q;
+  setInterval(function() {
+    var req = new XMLHttpRequest();
+    req.onload = function() {
+      if (req.status === 200 && req.responseText !== stamp) {
+        window.location.reload();
+      }
+    };
+    req.open("GET", "/_dox/stamp");
+    req.send();
+  }, 1000);
+})();
+`
+
+const previewPageFmt = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>%s</title>
+<style>%s</style>
+</head>
+<body>
+<div class="dox-header"><a href="%s">%s</a></div>
+<div class="dox-page">
+<h1 class="dox-title">%s</h1>
+%s
+</div>
+<script>%s</script>
+</body>
+</html>
+`
+
+type previewLink struct {
+	title string
+	href  string
+}
+
+// previewer renders Confluence storage format as plain HTML, replacing the
+// macros dox and authors commonly use with an equivalent rendering.
+type previewer struct {
+	children []previewLink
+	headings []heading
+	// anchors are the ids given to the headings, which are the anchor names
+	// GitHub generates unless replaced
+	anchors []string
+	next    int
+}
+
+func newPreviewer(content string, children []previewLink) (*previewer, error) {
+	headings, err := getHeadingsFromHTML(content)
+	if err != nil {
+		return nil, err
+	}
+
+	return &previewer{
+		children: children,
+		headings: headings,
+		anchors:  headingSlugs(headings),
+	}, nil
+}
+
+// page renders content as a complete HTML page, with a header linking to the
+// root page at rootHref.
+func (p *previewer) page(title string, rootTitle string, rootHref string, content string, script string) (string, error) {
+	body, err := p.render(content)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf(previewPageFmt,
+		html.EscapeString(title),
+		previewStylesheet,
+		html.EscapeString(rootHref),
+		html.EscapeString(rootTitle),
+		html.EscapeString(title),
+		body,
+		script,
+	), nil
+}
+
+func (p *previewer) render(content string) (string, error) {
+	z := xhtml.NewTokenizer(strings.NewReader(content))
+	z.AllowCDATA(true)
+
+	return p.renderUntil(z, "")
+}
+
+// renderUntil copies tokens to the output until the end tag named end is
+// found, rendering any macros along the way.
+func (p *previewer) renderUntil(z *xhtml.Tokenizer, end string) (string, error) {
+	var b strings.Builder
+	for {
+		tokenType := z.Next()
+		raw := string(z.Raw())
+		token := z.Token()
+
+		switch tokenType {
+		case xhtml.ErrorToken:
+			if z.Err() != io.EOF {
+				return "", z.Err()
+			}
+			return b.String(), nil
+		case xhtml.EndTagToken:
+			if token.Data == end {
+				return b.String(), nil
+			}
+		case xhtml.StartTagToken:
+			if token.Data == "ac:structured-macro" {
+				m, err := p.renderMacro(z, token)
+				if err != nil {
+					return "", err
+				}
+				b.WriteString(m)
+				continue
+			}
+
+			if level := headingLevel(token.Data); level > 0 && p.next < len(p.anchors) {
+				raw = fmt.Sprintf(`<h%d id="%s">`, level, p.anchors[p.next])
+				p.next++
+			}
+		}
+
+		b.WriteString(raw)
+	}
+}
+
+func (p *previewer) renderMacro(z *xhtml.Tokenizer, start xhtml.Token) (string, error) {
+	var name, body string
+	params := map[string]string{}
+	for _, attr := range start.Attr {
+		if attr.Key == "ac:name" {
+			name = attr.Val
+		}
+	}
+
+	for {
+		tokenType := z.Next()
+		token := z.Token()
+
+		switch tokenType {
+		case xhtml.ErrorToken:
+			if z.Err() != io.EOF {
+				return "", z.Err()
+			}
+			return "", fmt.Errorf("unterminated %s macro", name)
+		case xhtml.EndTagToken:
+			if token.Data == "ac:structured-macro" {
+				return p.macroHTML(name, params, body), nil
+			}
+		case xhtml.StartTagToken:
+			switch token.Data {
+			case "ac:parameter":
+				var key string
+				for _, attr := range token.Attr {
+					if attr.Key == "ac:name" {
+						key = attr.Val
+					}
+				}
+				value, err := textUntil(z, "ac:parameter")
+				if err != nil {
+					return "", err
+				}
+				params[key] = value
+			case "ac:rich-text-body":
+				rendered, err := p.renderUntil(z, "ac:rich-text-body")
+				if err != nil {
+					return "", err
+				}
+				body = rendered
+			case "ac:plain-text-body":
+				text, err := textUntil(z, "ac:plain-text-body")
+				if err != nil {
+					return "", err
+				}
+				body = html.EscapeString(text)
+			}
+		}
+	}
+}
+
+func (p *previewer) macroHTML(name string, params map[string]string, body string) string {
+	switch name {
+	case "info", "note", "tip", "warning":
+		var title string
+		if params["title"] != "" {
+			title = fmt.Sprintf(`<p class="dox-macro-title">%s</p>`, html.EscapeString(params["title"]))
+		}
+		return fmt.Sprintf(`<div class="dox-macro dox-macro-%s">%s%s</div>`, name, title, body)
+	case "code":
+		var class string
+		if params["language"] != "" {
+			class = fmt.Sprintf(` class="language-%s"`, html.EscapeString(params["language"]))
+		}
+		return fmt.Sprintf(`<pre><code%s>%s</code></pre>`, class, body)
+	case "children":
+		var b strings.Builder
+		b.WriteString(`<ul class="dox-children">`)
+		for _, c := range p.children {
+			fmt.Fprintf(&b, `<li><a href="%s">%s</a></li>`, html.EscapeString(c.href), html.EscapeString(c.title))
+		}
+		b.WriteString(`</ul>`)
+		return b.String()
+	case "toc":
+		var b strings.Builder
+		b.WriteString(`<ul class="dox-toc">`)
+		for i, h := range p.headings {
+			fmt.Fprintf(&b, `<li style="margin-left: %dem"><a href="#%s">%s</a></li>`, (h.level-1)*2, p.anchors[i], html.EscapeString(h.text))
+		}
+		b.WriteString(`</ul>`)
+		return b.String()
+	}
+
+	return fmt.Sprintf(`<div class="dox-macro dox-macro-unknown"><p class="dox-macro-title">%s macro</p>%s</div>`, html.EscapeString(name), body)
+}
+
+func textUntil(z *xhtml.Tokenizer, end string) (string, error) {
+	var b strings.Builder
+	for {
+		tokenType := z.Next()
+		token := z.Token()
+
+		switch tokenType {
+		case xhtml.ErrorToken:
+			if z.Err() != io.EOF {
+				return "", z.Err()
+			}
+			return "", fmt.Errorf("unterminated %s", end)
+		case xhtml.TextToken:
+			b.WriteString(token.Data)
+		case xhtml.EndTagToken:
+			if token.Data == end {
+				return b.String(), nil
+			}
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package dox
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+)
+
+// configName is the name of the config file of a project, without its
+// extension.
+const configName = ".dox"
+
+// Project is a directory of the repo published with its own config. It holds
+// the sources beneath it, other than those of the projects nested in it.
+type Project struct {
+	// Dir is the directory holding the config of the project.
+	Dir string
+	// Path is Dir relative to the repo root, with forward slashes.
+	Path   string
+	Config string
+}
+
+// FindProjects returns the projects of the repo at path, in lexical order: the
+// directories with a config file, other than those excluded by .gitignore or
+// .doxignore.
+func FindProjects(fs afero.Fs, path string) ([]Project, error) {
+	repoRoot, err := FindRepoRoot(fs, path)
+	if err != nil {
+		return nil, err
+	}
+
+	ig, err := newIgnorer(fs, repoRoot, repoRoot, []string{".gitignore", ".doxignore"}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var projects []Project
+	err = afero.Walk(fs, repoRoot, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+
+		if info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if file != repoRoot && ig.excluded(file, true) != "" {
+			return filepath.SkipDir
+		}
+
+		if config := projectConfig(fs, file); config != "" {
+			projects = append(projects, Project{
+				Dir:    file,
+				Path:   ig.rel(file),
+				Config: config,
+			})
+		}
+
+		return ig.enter(file)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return projects, nil
+}
+
+// projectConfig returns the config file in dir, or "" if it has none.
+func projectConfig(fs afero.Fs, dir string) string {
+	for _, ext := range viper.SupportedExts {
+		file := filepath.Join(dir, configName+"."+ext)
+		if info, err := fs.Stat(file); err == nil && !info.IsDir() {
+			return file
+		}
+	}
+
+	return ""
+}
+
+// ProjectOf returns the project holding the file or directory at path, which
+// is the deepest of projects that path is in.
+func ProjectOf(projects []Project, path string) (Project, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return Project{}, err
+	}
+
+	found := -1
+	for i, p := range projects {
+		if inDir(p.Dir, path) && (found < 0 || len(p.Dir) > len(projects[found].Dir)) {
+			found = i
+		}
+	}
+	if found < 0 {
+		return Project{}, fmt.Errorf("%s is not in a project", path)
+	}
+
+	return projects[found], nil
+}
+
+// UseProject reads the config of the project in place of the config in use,
+// until the returned function is called, which reads the config used before
+// again. A project without a config leaves the config as it is.
+func UseProject(p Project) (func(), error) {
+	if p.Config == "" {
+		return func() {}, nil
+	}
+
+	prev := viper.ConfigFileUsed()
+	if err := readConfig(p.Config); err != nil {
+		return nil, err
+	}
+
+	return func() {
+		if prev != "" {
+			readConfig(prev)
+		}
+	}, nil
+}
+
+func readConfig(file string) error {
+	viper.SetConfigFile(file)
+	// the root page ID saved while publishing another project would
+	// otherwise be kept
+	viper.Set("root_id", nil)
+
+	if err := viper.ReadInConfig(); err != nil {
+		return fmt.Errorf("%s: %s", file, err)
+	}
+
+	return nil
+}
+
+// configProject returns the directory of the config file in use, if it is in
+// the repo at repoRoot, or "" if it is not.
+func configProject(repoRoot string) string {
+	file := viper.ConfigFileUsed()
+	if file == "" {
+		return ""
+	}
+
+	dir, err := filepath.Abs(filepath.Dir(file))
+	if err != nil || !inDir(repoRoot, dir) {
+		return ""
+	}
+
+	return dir
+}
+
+// projectPath returns the directory of the config file in use relative to
+// the repo root, or "" if it is the repo root or not in the repo.
+func projectPath(repoRoot string) string {
+	dir := configProject(repoRoot)
+	if dir == "" || dir == repoRoot {
+		return ""
+	}
+
+	rel, err := filepath.Rel(repoRoot, dir)
+	if err != nil {
+		return ""
+	}
+
+	return filepath.ToSlash(rel)
+}
+
+// nestedProject returns why dir, a directory below the project at root, is
+// excluded from it, or "" if it is not.
+func nestedProject(fs afero.Fs, root string, dir string) string {
+	if dir == root {
+		return ""
+	}
+
+	if config := projectConfig(fs, dir); config != "" {
+		return "has its own " + filepath.Base(config)
+	}
+
+	return ""
+}
+
+// inDir reports whether path is dir or is in it.
+func inDir(dir string, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
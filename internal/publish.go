@@ -1,21 +1,21 @@
 package dox
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"os"
+	"net/http"
 	"strings"
 
+	"github.com/jesselang/dox/internal/backend"
 	"github.com/jesselang/dox/internal/source"
-	"github.com/jesselang/go-confluence"
+	"github.com/spf13/afero"
 	"github.com/spf13/viper"
 )
 
 var uri string
 var space string
 var browseUrlBase string
-var username string
-var password string
 
 func getConfigVars() error {
 	uri = viper.GetString("uri")
@@ -33,186 +33,116 @@ func getConfigVars() error {
 		return errors.New("browse_url_base must be set in config")
 	}
 
-	username = os.Getenv("DOX_USERNAME")
-	if len(username) == 0 {
-		return errors.New("DOX_USERNAME must be set")
-	}
-
-	password = os.Getenv("DOX_PASSWORD")
-	if len(password) == 0 {
-		return errors.New("DOX_PASSWORD must be set")
-	}
-
 	return nil
 }
 
-func Publish(files []string, repoRoot string, verbose bool, dryRun bool) error {
-	err := getConfigVars()
+func newBackend(fs afero.Fs) (backend.Backend, error) {
+	client, err := newHTTPClient()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	wiki, err := confluence.NewWiki(
-		uri,
-		confluence.BasicAuth(
-			username,
-			password,
-		),
-	)
+	auth, err := getAuthorizer(uri, client)
 	if err != nil {
-		return err
-	}
-
-	// make sources out of each file
-	var sources []source.Source
-	for _, file := range files {
-		src, err := source.New(file, source.Opts{
-			StripComments:    true,
-			TrimSpace:        true,
-			DoxNoticeFileUrl: fileBrowseUrl(browseUrlBase, repoRoot, file),
-		})
-		if err != nil {
-			return err
-		}
-		if src.Ignore() {
-			continue
-		}
-		sources = append(sources, src)
-	}
-
-	// try to find root page
-	rootPageSrc, err := getRootPageSrc(sources)
-	if err != nil {
-		return err
-	}
-
-	if rootPageSrc == nil {
-		// create dox default root page
-		rootPageSrc, err = source.New("", source.Opts{})
-		if err != nil {
-			return err
-		}
-		sources = append(sources, rootPageSrc)
-	}
-
-	// createStub only, we require root page's ID
-	rootID, err := createStub(wiki, rootPageSrc, "", dryRun)
-	if err != nil {
-		return err
-	}
-
-	// TODO: this prints even if we did not stub the page
-	if verbose {
-		fmt.Printf("root page stubbed to %s\n", rootID)
-	}
-
-	for _, src := range sources {
-		_, err := createStub(wiki, src, rootID, dryRun)
-		if err != nil {
-			return err
-		}
-	}
-
-	for _, src := range sources {
-		id, err := updateContent(wiki, src, repoRoot, dryRun)
-		if err != nil {
-			return err
-		}
-		if verbose {
-			srcFile := src.File()
-			if srcFile == "" {
-				srcFile = "root"
-			}
-			fmt.Printf("%s published to %s\n", srcFile, id)
-		}
-	}
-	return nil
+		return nil, err
+	}
+
+	name := viper.GetString("backend")
+	if name == "" {
+		name = "confluence"
+	}
+
+	return backend.New(name, backend.Opts{
+		URI:   uri,
+		Space: space,
+		API:   viper.GetString("api"),
+		Client: &http.Client{
+			Transport: &authTransport{
+				base: client.Transport,
+				auth: auth,
+			},
+			Timeout: client.Timeout,
+		},
+		Fs: fs,
+	})
 }
 
-func createStub(wiki *confluence.Wiki, src source.Source, rootID string, dryRun bool) (id string, err error) {
-	if src.Ignore() {
-		return "", fmt.Errorf("should not publish an ignored page")
-	}
+// Publish publishes every source, reading files from fs and writing the dox
+// headers of new pages there.
+func Publish(fs afero.Fs, files []string, repoRoot string, verbose bool, dryRun bool) error {
+	return publish(fs, files, nil, repoRoot, verbose, dryRun)
+}
 
-	if dryRun || src.ID() != "" {
-		return src.ID(), nil
+// PublishChanged publishes only the sources affected by the changed files,
+// which are the changed sources and any sources linking to or embedding a
+// changed file. New sources are stubbed as usual.
+func PublishChanged(fs afero.Fs, files []string, changed []string, repoRoot string, verbose bool, dryRun bool) error {
+	if changed == nil {
+		changed = []string{}
 	}
 
-	// NEW
-	c := &confluence.Content{
-		ID:    src.ID(),
-		Type:  "page",
-		Title: src.Title(),
-	}
+	return publish(fs, files, changed, repoRoot, verbose, dryRun)
+}
 
-	if rootID != "" {
-		c.Ancestors = []confluence.ContentAncestor{{ID: rootID}}
+// MakePlan plans publishing every source, without changing anything.
+func MakePlan(fs afero.Fs, files []string, repoRoot string) (*Plan, error) {
+	if IsStatic() {
+		return nil, errors.New("a static site has no plan, as it is rendered anew each time")
 	}
-	c.Body.Storage.Value = "This is a page stub created by dox."
-	c.Body.Storage.Representation = "storage"
-	c.Space.Key = space
-	c.Version.Number = 1
 
-	c, err = wiki.CreateContent(c)
+	err := getConfigVars()
 	if err != nil {
-		// TODO: confluence does not support duplicate title in a space
-		return "", err
+		return nil, err
 	}
 
-	err = src.SetID(c.ID)
+	b, err := newBackend(fs)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return src.ID(), nil
+	return makePlan(fs, b, files, nil, repoRoot, viper.GetBool("prune"))
 }
 
-func updateContent(wiki *confluence.Wiki, src source.Source, repoRoot string, dryRun bool) (id string, err error) {
-	if src.Ignore() {
-		return "", fmt.Errorf("should not publish an ignored page")
-	}
-
-	if dryRun {
-		return src.ID(), nil
+// publish publishes every source when changed is nil, otherwise only the
+// sources affected by the changed files, holding the lock on the root page
+// from planning until the plan is applied. In dry-run mode the plan is
+// printed instead. A static site is rendered whole.
+func publish(fs afero.Fs, files []string, changed []string, repoRoot string, verbose bool, dryRun bool) error {
+	if IsStatic() {
+		return publishStatic(fs, files, repoRoot, verbose, dryRun)
 	}
 
-	c, err := wiki.GetContent(src.ID(),
-		[]string{"body.storage", "space", "version"})
-	if err != nil {
-		// TODO: handle 404 where dox id exists in source, but published page does not
-		return "", err
-	}
-
-	sourceOutput := src.Output()
-
-	imageSrcFiles, err := getImageSrcFiles(sourceOutput, src.File())
+	err := getConfigVars()
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	pageContent, err := replaceImagesWithAttachments(imageSrcFiles, src.File(), sourceOutput, c.ID, wiki, uri)
+	b, err := newBackend(fs)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	pageContent, err = replaceRelativeLinks(src.File(), pageContent, uri, browseUrlBase, repoRoot)
-	if err != nil {
-		return "", err
+	lockID := ""
+	if !dryRun {
+		lockID, err = lockPageID(fs, b, files)
+		if err != nil {
+			return err
+		}
 	}
 
-	// TODO: Confluence assigns a unique macro id to each macro in page. If a page contains macros,
-	//       this condition will always be true since dox source does not contain macro ids.
-	if c.Body.Storage.Value != pageContent {
-		c.Body.Storage.Value = pageContent
-		c.Version.Number += 1
-
-		c, err = wiki.UpdateContent(c)
+	return withLock(b, lockID, verbose, func(ctx context.Context) error {
+		plan, err := makePlan(fs, b, files, changed, repoRoot, viper.GetBool("prune"))
 		if err != nil {
-			return "", err
+			return err
+		}
+
+		if dryRun {
+			fmt.Print(plan)
+			return nil
 		}
-	}
 
-	return c.ID, nil
+		return applyPlan(ctx, fs, b, plan, repoRoot, verbose)
+	})
 }
 
 func getRootPageSrc(sources []source.Source) (source.Source, error) {
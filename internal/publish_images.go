@@ -1,8 +1,6 @@
 package dox
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
 	"fmt"
 	"io"
 	"net/url"
@@ -10,7 +8,7 @@ import (
 	"path/filepath"
 	"strings"
 
-	"github.com/jesselang/go-confluence"
+	"github.com/spf13/afero"
 	"golang.org/x/net/html"
 )
 
@@ -42,7 +40,7 @@ func getImageSrcsFromHTML(content string) ([]string, error) {
 	// return imageSrcs, nil
 }
 
-func getImageSrcFiles(content string, file string) ([]string, error) {
+func getImageSrcFiles(fs afero.Fs, content string, file string) ([]string, error) {
 	fileDir := filepath.Dir(file)
 	imageSrcs, err := getImageSrcsFromHTML(content)
 	if err != nil {
@@ -58,7 +56,7 @@ func getImageSrcFiles(content string, file string) ([]string, error) {
 		}
 
 		imageSrcPath := filepath.Join(fileDir, imageSrc)
-		if _, err := os.Stat(imageSrcPath); !os.IsNotExist(err) {
+		if _, err := fs.Stat(imageSrcPath); !os.IsNotExist(err) {
 			imageSrcFiles = append(imageSrcFiles, imageSrc)
 		} else {
 			fmt.Printf("warn: could not find image file %s\n", imageSrcPath)
@@ -68,65 +66,13 @@ func getImageSrcFiles(content string, file string) ([]string, error) {
 	return imageSrcFiles, nil
 }
 
-func replaceImagesWithAttachments(imageSrcFiles []string, file string, pageContent string, pageID string, wiki *confluence.Wiki, uri string) (string, error) {
-	fileDir := filepath.Dir(file)
+// replaceImagesWithAttachments points the images in pageContent at the
+// attachments of the page they are uploaded as.
+func replaceImagesWithAttachments(imageSrcFiles []string, pageContent string, pageID string, b pageURLs) string {
 	for _, imageSrcFile := range imageSrcFiles {
-		imageSrcPath := filepath.Join(fileDir, imageSrcFile)
-		imageSrcFilename := filepath.Base(imageSrcPath)
-
-		results, err := wiki.GetAttachment(pageID, imageSrcFilename)
-		if err != nil {
-			return "", err
-		}
-
-		if len(results.Results) == 0 {
-			// create new attachment
-			_, err := wiki.CreateAttachment(pageID, imageSrcPath)
-			if err != nil {
-				return "", err
-			}
-		} else {
-			// update existing attachment
-			imageData, err := wiki.GetAttachmentData(pageID, imageSrcFilename)
-			if err != nil {
-				return "", err
-			}
-
-			attachmentSum := getBytesSha256(imageData)
-			fileSum, err := getFileSha256(imageSrcPath)
-			if err != nil {
-				return "", err
-			}
-
-			if fileSum != attachmentSum {
-				_, err := wiki.UpdateAttachment(pageID, imageSrcPath, results.Results[0].ID)
-				if err != nil {
-					return "", err
-				}
-			}
-		}
-
-		pageContent = strings.Replace(pageContent, fmt.Sprintf(`"%s"`, imageSrcFile), fmt.Sprintf(`"%s/download/attachments/%s/%s"`, uri, pageID, imageSrcFilename), -1)
-	}
-
-	return pageContent, nil
-}
-
-func getFileSha256(path string) (string, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return "", err
+		attachmentUrl := b.AttachmentURL(pageID, filepath.Base(imageSrcFile))
+		pageContent = strings.Replace(pageContent, fmt.Sprintf(`"%s"`, imageSrcFile), fmt.Sprintf(`"%s"`, attachmentUrl), -1)
 	}
-	defer f.Close()
-	h := sha256.New()
-	if _, err := io.Copy(h, f); err != nil {
-		return "", err
-	}
-	return hex.EncodeToString(h.Sum(nil)), nil
-}
 
-func getBytesSha256(b []byte) string {
-	h := sha256.New()
-	h.Write(b)
-	return hex.EncodeToString(h.Sum(nil))
+	return pageContent
 }
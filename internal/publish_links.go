@@ -9,6 +9,7 @@ import (
 	"strings"
 
 	"github.com/jesselang/dox/internal/source"
+	"github.com/spf13/afero"
 	"golang.org/x/net/html"
 )
 
@@ -40,7 +41,7 @@ func getAnchorHrefsFromHTML(content string) ([]string, error) {
 	// return anchorHrefs, nil
 }
 
-func getLocalLinkedAnchors(content string, file string) ([]string, error) {
+func getLocalLinkedAnchors(fs afero.Fs, content string, file string) ([]string, error) {
 	fileDir := filepath.Dir(file)
 	anchorHrefs, err := getAnchorHrefsFromHTML(content)
 	if err != nil {
@@ -55,12 +56,19 @@ func getLocalLinkedAnchors(content string, file string) ([]string, error) {
 			continue
 		}
 
-		anchorHrefPath := filepath.Join(fileDir, anchorHref)
-		if _, err := os.Stat(anchorHrefPath); !os.IsNotExist(err) {
+		anchorHrefPath, fragment := splitFragment(anchorHref)
+		if anchorHrefPath == "" && fragment == "" {
+			continue
+		} else if anchorHrefPath == "" {
+			// link to an anchor in this page
+			localAnchorHrefs = append(localAnchorHrefs, anchorHref)
+			continue
+		}
+
+		anchorHrefPath = filepath.Join(fileDir, anchorHrefPath)
+		if _, err := fs.Stat(anchorHrefPath); !os.IsNotExist(err) {
 			localAnchorHrefs = append(localAnchorHrefs, anchorHref)
-		} else if !strings.HasPrefix(anchorHref, "#") {
-			// URL fragments are not parsed above, so only warn if anchorHref
-			// can not URL fragment.
+		} else {
 			fmt.Printf("warn: could not find file %s\n", anchorHrefPath)
 		}
 	}
@@ -68,33 +76,108 @@ func getLocalLinkedAnchors(content string, file string) ([]string, error) {
 	return localAnchorHrefs, nil
 }
 
-func replaceRelativeLinks(file string, pageContent string, uri string, browseUrlBase string, repoRoot string) (string, error) {
+// pageURLs makes the URLs of pages and their attachments, which the links and
+// images of published content point at. Besides the backend, the preview
+// server makes them, to render pages the way they are published.
+type pageURLs interface {
+	PageURL(id string) string
+	AttachmentURL(pageID string, filename string) string
+}
+
+// replaceRelativeLinks points the links in pageContent, which is from file, at
+// the pages of the sources they link to, or at the repo for other files. ids
+// maps the files of sources to the IDs of their pages, for sources that do not
+// have an ID yet.
+func replaceRelativeLinks(fs afero.Fs, file string, pageContent string, b pageURLs, browseUrlBase string, repoRoot string, ids map[string]string) (string, error) {
 
-	localAnchorHrefs, err := getLocalLinkedAnchors(pageContent, file)
+	localAnchorHrefs, err := getLocalLinkedAnchors(fs, pageContent, file)
 	if err != nil {
 		return "", err
 	}
 
+	opts := sourceOpts(fs)
+	opts.StripComments = true
+	opts.TrimSpace = true
+
 	fileDir := filepath.Dir(file)
 	for _, localAnchorHref := range localAnchorHrefs {
-		localAnchorHrefPath := filepath.Join(fileDir, localAnchorHref)
+		hrefPath, fragment := splitFragment(localAnchorHref)
 
-		src, err := source.New(localAnchorHrefPath, source.Opts{StripComments: true, TrimSpace: true})
+		if hrefPath == "" {
+			src, err := source.New(file, opts)
+			if err != nil {
+				return "", err
+			}
+
+			anchor, err := confluenceFragment(src, fragment)
+			if err != nil {
+				return "", err
+			}
+			pageContent = strings.Replace(pageContent, fmt.Sprintf(`href="%s"`, localAnchorHref), fmt.Sprintf(`href="#%s"`, anchor), -1)
+			continue
+		}
+
+		localAnchorHrefPath := filepath.Join(fileDir, hrefPath)
+
+		src, err := source.New(localAnchorHrefPath, opts)
 		if err != nil || src.Ignore() {
 			// file exists but is not a dox source file or is a source file but
 			// is ignored, so link to source instead
 			sourceUrl := fileBrowseUrl(browseUrlBase, repoRoot, localAnchorHrefPath)
+			if fragment != "" {
+				sourceUrl += "#" + fragment
+			}
 			pageContent = strings.Replace(pageContent, fmt.Sprintf(`href="%s"`, localAnchorHref), fmt.Sprintf(`href="%s"`, sourceUrl), -1)
-		} else if src.ID() != "" {
-			pageContent = strings.Replace(pageContent, fmt.Sprintf(`href="%s"`, localAnchorHref), fmt.Sprintf(`href="%s"`, confluenceUrlForPageID(uri, src.ID())), -1)
+		} else if id := pageID(src, ids); id != "" {
+			pageUrl := b.PageURL(id)
+			if fragment != "" {
+				anchor, err := confluenceFragment(src, fragment)
+				if err != nil {
+					return "", err
+				}
+				if anchor != "" {
+					pageUrl += "#" + anchor
+				}
+			}
+			pageContent = strings.Replace(pageContent, fmt.Sprintf(`href="%s"`, localAnchorHref), fmt.Sprintf(`href="%s"`, pageUrl), -1)
 		}
 	}
 
 	return pageContent, nil
 }
 
-func confluenceUrlForPageID(uri, pageID string) string {
-	return fmt.Sprintf("%s/pages/viewpage.action?pageId=%s", uri, pageID)
+// pageID returns the ID of the page of src, which is in ids if the page is yet
+// to be created.
+func pageID(src source.Source, ids map[string]string) string {
+	if id := src.ID(); id != "" {
+		return id
+	}
+
+	return ids[src.File()]
+}
+
+// confluenceFragment returns the anchor Confluence generates for the heading
+// in src that fragment links to. Fragments that do not match a heading are
+// returned as-is.
+func confluenceFragment(src source.Source, fragment string) (string, error) {
+	anchor, found, err := confluenceAnchorForSlug(src.Title(), src.Output(), fragment)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		fmt.Printf("warn: could not find heading for #%s in %s\n", fragment, src.File())
+		return fragment, nil
+	}
+
+	return anchor, nil
+}
+
+func splitFragment(href string) (path string, fragment string) {
+	if i := strings.Index(href, "#"); i >= 0 {
+		return href[:i], href[i+1:]
+	}
+
+	return href, ""
 }
 
 func fileBrowseUrl(browseUrlBase string, repoRoot string, filepath string) string {
@@ -0,0 +1,67 @@
+//go:build !windows
+// +build !windows
+
+package dox_test
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/jesselang/dox/internal"
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+)
+
+func TestReplaceRelativeLinks(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+
+	fs := afero.NewMemMapFs()
+	root := "/repo"
+	for name, content := range map[string]string{
+		"README.md":       "<!-- dox: 1 -->\n# Readme\n\n## Usage\n\n## Usage\n",
+		"docs/install.md": "<!-- dox: 2 -->\n# Install\n\n## Set up (Linux)\n\n## Set up (Linux)\n\n## Über uns\n",
+		"docs/new.md":     "# New\n\n## Intro\n",
+		"docs/old.md":     "<!-- dox: ignore -->\n# Old\n\n## Intro\n",
+		"docs/notes.txt":  "notes\n",
+	} {
+		if err := afero.WriteFile(fs, filepath.Join(root, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b := newFakeBackend()
+	ids := map[string]string{filepath.Join(root, "docs/new.md"): "7"}
+
+	for _, tc := range []struct {
+		name string
+		href string
+		want string
+	}{
+		{"this page", "#usage", "#Readme-Usage"},
+		{"duplicate in this page", "#usage-1", "#Readme-Usage.1"},
+		{"this page title", "#readme", "#"},
+		{"page", "docs/install.md", "fake://pages/2"},
+		{"heading with punctuation", "docs/install.md#set-up-linux", "fake://pages/2#Install-Setup(Linux)"},
+		{"duplicate heading", "docs/install.md#set-up-linux-1", "fake://pages/2#Install-Setup(Linux).1"},
+		{"unicode heading", "docs/install.md#über-uns", "fake://pages/2#Install-Überuns"},
+		{"page title", "docs/install.md#install", "fake://pages/2"},
+		{"missing heading", "docs/install.md#nowhere", "fake://pages/2#nowhere"},
+		{"page to be created", "docs/new.md#intro", "fake://pages/7#New-Intro"},
+		{"ignored source", "docs/old.md#intro", "https://git.example.com/repo/blob/main/docs/old.md#intro"},
+		{"other file", "docs/notes.txt", "https://git.example.com/repo/blob/main/docs/notes.txt"},
+		{"missing file", "docs/missing.md#intro", "docs/missing.md#intro"},
+		{"url", "https://example.com/#intro", "https://example.com/#intro"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			content := fmt.Sprintf(`<p><a href="%s">link</a></p>`, tc.href)
+			got, err := dox.ReplaceRelativeLinks(fs, filepath.Join(root, "README.md"), content, b, "https://git.example.com/repo/blob/main", root, ids)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := fmt.Sprintf(`<p><a href="%s">link</a></p>`, tc.want); got != want {
+				t.Errorf("link to %s is %s, want %s", tc.href, got, want)
+			}
+		})
+	}
+}
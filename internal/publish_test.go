@@ -0,0 +1,405 @@
+//go:build !windows
+// +build !windows
+
+package dox_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jesselang/dox/internal"
+	"github.com/jesselang/dox/internal/backend"
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+)
+
+// fakeBackend stores pages in memory.
+type fakeBackend struct {
+	fs          afero.Fs
+	pages       map[string]*backend.Page
+	labels      map[string][]string
+	attachments map[string][]byte
+	nextID      int
+	// onUpdate is called before a page is updated, if set
+	onUpdate func(page *backend.Page)
+
+	// mu guards properties, which the publish lock renews in the background
+	mu         sync.Mutex
+	properties map[string]*backend.Property
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{
+		pages:       map[string]*backend.Page{},
+		labels:      map[string][]string{},
+		properties:  map[string]*backend.Property{},
+		attachments: map[string][]byte{},
+	}
+}
+
+func (b *fakeBackend) GetPage(id string) (*backend.Page, error) {
+	page, ok := b.pages[id]
+	if !ok {
+		return nil, fmt.Errorf("page %s not found", id)
+	}
+	p := *page
+	return &p, nil
+}
+
+func (b *fakeBackend) CreatePage(page *backend.Page) (*backend.Page, error) {
+	b.nextID++
+	p := *page
+	p.ID = fmt.Sprint(b.nextID)
+	p.Version = 1
+	b.pages[p.ID] = &p
+	return b.GetPage(p.ID)
+}
+
+func (b *fakeBackend) UpdatePage(page *backend.Page) (*backend.Page, error) {
+	if b.onUpdate != nil {
+		b.onUpdate(page)
+	}
+	current, ok := b.pages[page.ID]
+	if !ok {
+		return nil, fmt.Errorf("page %s not found", page.ID)
+	}
+	if page.Version != current.Version+1 {
+		return nil, backend.ErrConflict
+	}
+	p := *page
+	if p.ParentID == "" {
+		p.ParentID = current.ParentID
+	}
+	b.pages[p.ID] = &p
+	return b.GetPage(p.ID)
+}
+
+func (b *fakeBackend) MovePage(id string, parentID string) error {
+	page, ok := b.pages[id]
+	if !ok {
+		return fmt.Errorf("page %s not found", id)
+	}
+	page.ParentID = parentID
+	return nil
+}
+
+func (b *fakeBackend) DeletePage(id string) error {
+	delete(b.pages, id)
+	return nil
+}
+
+func (b *fakeBackend) GetChildren(id string) ([]*backend.Page, error) {
+	var children []*backend.Page
+	for _, page := range b.pages {
+		if page.ParentID == id {
+			p := *page
+			children = append(children, &p)
+		}
+	}
+	return children, nil
+}
+
+func (b *fakeBackend) FindPage(title string) (*backend.Page, error) {
+	for _, page := range b.pages {
+		if page.Title == title {
+			p := *page
+			return &p, nil
+		}
+	}
+	return nil, nil
+}
+
+func (b *fakeBackend) UploadAttachment(pageID string, path string) (string, error) {
+	data, err := afero.ReadFile(b.fs, path)
+	if err != nil {
+		return "", err
+	}
+	b.attachments[pageID+"/"+filepath.Base(path)] = data
+	return b.AttachmentURL(pageID, filepath.Base(path)), nil
+}
+
+func (b *fakeBackend) GetAttachment(pageID string, filename string) ([]byte, error) {
+	return b.attachments[pageID+"/"+filename], nil
+}
+
+func (b *fakeBackend) AttachmentURL(pageID string, filename string) string {
+	return fmt.Sprintf("fake://attachments/%s/%s", pageID, filename)
+}
+
+func (b *fakeBackend) GetLabels(pageID string) ([]string, error) {
+	return b.labels[pageID], nil
+}
+
+func (b *fakeBackend) SetLabels(pageID string, labels []string) error {
+	b.labels[pageID] = labels
+	return nil
+}
+
+func (b *fakeBackend) GetProperty(pageID string, key string) (*backend.Property, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p, ok := b.properties[pageID+"/"+key]
+	if !ok {
+		return nil, nil
+	}
+	property := *p
+	return &property, nil
+}
+
+func (b *fakeBackend) SetProperty(pageID string, property *backend.Property) (*backend.Property, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	current := b.properties[pageID+"/"+property.Key]
+	if (current == nil && property.Version != 0) || (current != nil && current.Version != property.Version) {
+		return nil, backend.ErrConflict
+	}
+	p := *property
+	p.Version++
+	b.properties[pageID+"/"+property.Key] = &p
+	stored := p
+	return &stored, nil
+}
+
+func (b *fakeBackend) DeleteProperty(pageID string, key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.properties, pageID+"/"+key)
+	return nil
+}
+
+func (b *fakeBackend) PageURL(id string) string {
+	return "fake://pages/" + id
+}
+
+// newPublishRepo creates a repo in memory, configured to publish to a fake
+// backend, and returns it with its sources. Callers reset viper and unset
+// DOX_PASSWORD when done.
+func newPublishRepo(t *testing.T) (afero.Fs, string, []string, *fakeBackend) {
+	fs := afero.NewMemMapFs()
+	root := "/repo"
+	sources, fake := writePublishRepo(t, fs, root)
+
+	return fs, root, sources, fake
+}
+
+// writePublishRepo writes the files of newPublishRepo to root in fs, and
+// returns its sources.
+func writePublishRepo(t *testing.T, fs afero.Fs, root string) ([]string, *fakeBackend) {
+	files := map[string]string{
+		".dox.yaml":       "",
+		"README.md":       "# Readme\n\nSee [install](docs/install.md) and ![logo](logo.png)\n",
+		"docs/install.md": "# Install\n\nRun the installer.\n",
+		"logo.png":        "",
+	}
+	var sources []string
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := fs.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := afero.WriteFile(fs, path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Ext(name) == ".md" {
+			sources = append(sources, path)
+		}
+	}
+	sort.Strings(sources)
+
+	fake := newFakeBackend()
+	backend.Register("fake", func(opts backend.Opts) (backend.Backend, error) {
+		fake.fs = opts.Fs
+		return fake, nil
+	})
+
+	viper.Reset()
+	viper.SetFs(fs)
+	viper.SetConfigFile(filepath.Join(root, ".dox.yaml"))
+	viper.Set("backend", "fake")
+	viper.Set("uri", "https://wiki.example.com")
+	viper.Set("space", "DOX")
+	viper.Set("title", "Docs")
+	viper.Set("browse_url_base", "https://git.example.com/repo/blob/main")
+	viper.Set("auth.username", "user")
+	os.Setenv("DOX_PASSWORD", "password")
+
+	return sources, fake
+}
+
+func TestPublish(t *testing.T) {
+	// the whole pipeline runs in memory, including writing dox headers and
+	// the root page ID
+	fs, root, sources, fake := newPublishRepo(t)
+	defer viper.Reset()
+	defer os.Unsetenv("DOX_PASSWORD")
+
+	if err := dox.Publish(fs, sources, root, false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fake.pages) != 3 {
+		t.Fatalf("expected 3 pages, got %d", len(fake.pages))
+	}
+
+	rootID := viper.GetString("root_id")
+	if rootID == "" {
+		t.Fatal("expected root_id to be set")
+	}
+
+	byTitle := map[string]*backend.Page{}
+	for _, page := range fake.pages {
+		byTitle[page.Title] = page
+	}
+
+	readme, install := byTitle["Readme"], byTitle["Install"]
+	if readme == nil || install == nil {
+		t.Fatalf("unexpected pages: %v", byTitle)
+	}
+	if readme.ParentID != rootID || install.ParentID != rootID {
+		t.Errorf("expected pages to be children of %s", rootID)
+	}
+	if !strings.Contains(readme.Body, `href="fake://pages/`+install.ID+`"`) {
+		t.Errorf("expected link to install page, got %s", readme.Body)
+	}
+	if !strings.Contains(readme.Body, `src="fake://attachments/`+readme.ID+`/logo.png"`) {
+		t.Errorf("expected image attachment, got %s", readme.Body)
+	}
+
+	buf, err := afero.ReadFile(fs, filepath.Join(root, "README.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header := fmt.Sprintf("<!-- dox: %s -->\n", readme.ID); !strings.HasPrefix(string(buf), header) {
+		t.Errorf("expected dox header %q, got %q", header, buf)
+	}
+
+	if _, ok := fake.attachments[readme.ID+"/logo.png"]; !ok {
+		t.Errorf("expected logo.png to be uploaded, got %v", fake.attachments)
+	}
+	config, err := afero.ReadFile(fs, filepath.Join(root, ".dox.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(config), rootID) {
+		t.Errorf("expected root_id %s in config, got %q", rootID, config)
+	}
+	if _, err := os.Stat(root); !os.IsNotExist(err) {
+		t.Errorf("expected nothing to be written to %s on disk", root)
+	}
+}
+
+// appendLine appends a line to each file, so that publishing updates its page.
+func appendLine(t *testing.T, fs afero.Fs, files []string, line string) {
+	for _, file := range files {
+		buf, err := afero.ReadFile(fs, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := afero.WriteFile(fs, file, append(buf, []byte(line+"\n")...), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLockReleasedWhileRenewing(t *testing.T) {
+	fs, root, sources, _ := newPublishRepo(t)
+	defer viper.Reset()
+	defer os.Unsetenv("DOX_PASSWORD")
+
+	if err := dox.Publish(fs, sources, root, false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// a renewal is always due, so the lock is often released while one is
+	// in progress
+	ticks := make(chan time.Time)
+	stopped := make(chan struct{}, 1)
+	defer dox.SetLockTicker(ticks, func() { stopped <- struct{}{} })()
+
+	for i := 0; i < 20; i++ {
+		appendLine(t, fs, sources, fmt.Sprintf("Change %d.", i))
+
+		done := make(chan error, 1)
+		go func() { done <- dox.Publish(fs, sources, root, false, false) }()
+		timeout := time.After(10 * time.Second)
+	renew:
+		for {
+			select {
+			case ticks <- time.Now():
+			case <-stopped:
+				break renew
+			case <-timeout:
+				t.Fatalf("publish %d did not stop renewing the lock", i)
+			}
+		}
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-timeout:
+			t.Fatalf("publish %d did not finish releasing the lock", i)
+		}
+	}
+}
+
+func TestLockLost(t *testing.T) {
+	fs, root, sources, fake := newPublishRepo(t)
+	defer viper.Reset()
+	defer os.Unsetenv("DOX_PASSWORD")
+
+	if err := dox.Publish(fs, sources, root, false, false); err != nil {
+		t.Fatal(err)
+	}
+	rootID := viper.GetString("root_id")
+	versions := map[string]int{}
+	for id, page := range fake.pages {
+		versions[id] = page.Version
+	}
+
+	// another run takes the lock while the first update is slow, as if it
+	// had expired, so the next renewal fails
+	ticks := make(chan time.Time)
+	stopped := make(chan struct{})
+	defer dox.SetLockTicker(ticks, func() { close(stopped) })()
+	stolen := false
+	fake.onUpdate = func(page *backend.Page) {
+		if stolen {
+			return
+		}
+		stolen = true
+		fake.mu.Lock()
+		p := fake.properties[rootID+"/dox-lock"]
+		p.Value = []byte(`{"owner":"ci job 2","expires":"2999-01-01T00:00:00Z"}`)
+		p.Version++
+		fake.mu.Unlock()
+
+		ticks <- time.Now()
+		<-stopped
+	}
+
+	appendLine(t, fs, sources, "More.")
+	err := dox.Publish(fs, sources, root, false, false)
+	if err == nil || !strings.Contains(err.Error(), "taken by someone else") {
+		t.Fatalf("expected publishing to stop when the lock is lost, got %v", err)
+	}
+
+	updated := 0
+	for id, page := range fake.pages {
+		if page.Version != versions[id] {
+			updated++
+		}
+	}
+	if updated != 1 {
+		t.Errorf("expected only the page being updated when the lock was lost to change, got %d", updated)
+	}
+	if p, _ := fake.GetProperty(rootID, "dox-lock"); !strings.Contains(string(p.Value), "ci job 2") {
+		t.Errorf("expected the lock to be left to its new owner, got %s", p.Value)
+	}
+}
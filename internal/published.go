@@ -0,0 +1,56 @@
+package dox
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/jesselang/dox/internal/backend"
+)
+
+// sourceProperty is the key of the content property marking the pages dox
+// publishes, recording the source each is published from. Pages are pruned by
+// it, since their bodies may not have the notice.
+const sourceProperty = "dox-source"
+
+type publishedSource struct {
+	Source string `json:"source"`
+}
+
+// markPublishedByDox records on the page that it is published by dox from
+// file, relative to the repo root, unless it already is.
+func markPublishedByDox(b backend.Backend, pageID string, file string) error {
+	value, err := json.Marshal(publishedSource{Source: file})
+	if err != nil {
+		return err
+	}
+
+	prop, err := b.GetProperty(pageID, sourceProperty)
+	if err != nil {
+		return err
+	}
+	if prop == nil {
+		prop = &backend.Property{Key: sourceProperty}
+	} else if string(prop.Value) == string(value) {
+		return nil
+	}
+	prop.Value = value
+
+	_, err = b.SetProperty(pageID, prop)
+	return err
+}
+
+// publishedByDox reports whether page was published by dox, so pages added
+// under the root by hand are never pruned. Pages published before they were
+// marked are recognized by their stub body or notice.
+func publishedByDox(b backend.Backend, page *backend.Page) (bool, error) {
+	if page.Body == stubBody || strings.Contains(page.Body, "This page was published by dox") {
+		return true, nil
+	}
+
+	prop, err := b.GetProperty(page.ID, sourceProperty)
+	if err != nil {
+		return false, err
+	}
+
+	return prop != nil, nil
+}
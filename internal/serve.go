@@ -0,0 +1,379 @@
+package dox
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jesselang/dox/internal/source"
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+)
+
+type previewServer struct {
+	fs       afero.Fs
+	repoRoot string
+	verbose  bool
+
+	// started and changes make up the stamp of the files of the repo, which
+	// open pages poll to reload when it changes
+	started time.Time
+	mu      sync.Mutex
+	changes int
+}
+
+// Serve starts an HTTP server on addr that renders each source the way it
+// would be published, reloading open pages whenever a file changes. Files
+// ignored by discovery are not watched.
+func Serve(fs afero.Fs, repoRoot string, addr string, verbose bool) error {
+	handler, stop, err := PreviewHandler(fs, repoRoot, verbose)
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	fmt.Printf("serving preview of %s at http://%s/\n", repoRoot, addr)
+
+	return http.ListenAndServe(addr, handler)
+}
+
+// PreviewHandler returns the handler of the server Serve starts, which
+// watches the files of the repo until the returned function is called.
+func PreviewHandler(fs afero.Fs, repoRoot string, verbose bool) (http.Handler, func(), error) {
+	s := &previewServer{
+		fs:       fs,
+		repoRoot: repoRoot,
+		verbose:  verbose,
+		started:  time.Now(),
+	}
+
+	files, err := newRepoWatcher(fs, repoRoot)
+	if err != nil {
+		return nil, nil, err
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		s.watch(files, done)
+		files.Close()
+	}()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_dox/stamp", s.handleStamp)
+	mux.HandleFunc(previewAttachmentsPath, s.handleAttachment)
+	mux.HandleFunc("/", s.handlePage)
+
+	return mux, func() {
+		close(done)
+		<-stopped
+	}, nil
+}
+
+func (s *previewServer) handleStamp(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, s.stamp())
+}
+
+func (s *previewServer) handlePage(w http.ResponseWriter, r *http.Request) {
+	if s.verbose {
+		fmt.Printf("%s %s\n", r.Method, r.URL.Path)
+	}
+
+	sources, err := s.sources()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rootPageSrc, err := getRootPageSrc(sources)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Path == "/" {
+		if rootPageSrc != nil {
+			http.Redirect(w, r, s.urlPath(rootPageSrc.File()), http.StatusFound)
+			return
+		}
+
+		// preview the dox default root page
+		rootPageSrc, err = source.New("", sourceOpts(s.fs))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.servePage(w, rootPageSrc, rootPageSrc, sources)
+		return
+	}
+
+	file := filepath.Join(s.repoRoot, filepath.FromSlash(path.Clean(r.URL.Path)))
+	if !s.inRepo(file) {
+		http.NotFound(w, r)
+		return
+	}
+
+	for _, src := range sources {
+		if src.File() == file {
+			if rootPageSrc == nil {
+				rootPageSrc, _ = source.New("", sourceOpts(s.fs))
+			}
+			s.servePage(w, src, rootPageSrc, sources)
+			return
+		}
+	}
+
+	// anything that is not a published source, including images, linked files
+	// and ignored sources, is served as-is so relative links keep working
+	s.serveFile(w, r, file)
+}
+
+// servePage renders src the way it is published, with its links and images
+// pointing at the preview instead of the wiki.
+func (s *previewServer) servePage(w http.ResponseWriter, src source.Source, rootPageSrc source.Source, sources []source.Source) {
+	ids := previewPageIDs(sources)
+	urls := s.pageURLs(sources, ids)
+
+	content := src.Output()
+	imageSrcFiles, err := getImageSrcFiles(s.fs, content, src.File())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	content = replaceImagesWithAttachments(imageSrcFiles, content, pageID(src, ids), urls)
+
+	// without a URL to browse the repo at, files are linked to as the
+	// preview serves them
+	browseUrlBase := viper.GetString("browse_url_base")
+	if browseUrlBase == "" {
+		browseUrlBase = "/"
+	}
+	content, err = replaceRelativeLinks(s.fs, src.File(), content, urls, browseUrlBase, s.repoRoot, ids)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var children []previewLink
+	for _, child := range sources {
+		if child.IsRootPage() {
+			continue
+		}
+		children = append(children, previewLink{
+			title: child.Title(),
+			href:  s.urlPath(child.File()),
+		})
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].title < children[j].title })
+
+	p, err := newPreviewer(content, children)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// links to headings were pointed at the anchors Confluence generates
+	p.anchors = confluenceAnchors(src.Title(), p.headings)
+
+	page, err := p.page(src.Title(), rootPageSrc.Title(), "/", content, fmt.Sprintf(previewReloadScript, s.stamp()))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, page)
+}
+
+// previewAttachmentsPath is where the preview serves the images attached to
+// each page, by page ID and file name, as Confluence does.
+const previewAttachmentsPath = "/_dox/attachments/"
+
+// handleAttachment serves the image attached to a page, which is the image
+// of its source with the name requested.
+func (s *previewServer) handleAttachment(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, previewAttachmentsPath), "/", 2)
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	id, name := parts[0], parts[1]
+
+	sources, err := s.sources()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ids := previewPageIDs(sources)
+	for _, src := range sources {
+		if pageID(src, ids) != id {
+			continue
+		}
+
+		imageSrcs, err := getImageSrcsFromHTML(src.Output())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, imageSrc := range imageSrcs {
+			file := filepath.Join(filepath.Dir(src.File()), imageSrc)
+			if filepath.Base(imageSrc) == name && s.inRepo(file) {
+				s.serveFile(w, r, file)
+				return
+			}
+		}
+	}
+
+	http.NotFound(w, r)
+}
+
+// previewPageIDs numbers the sources that have no page yet, as a plan would,
+// so they can be linked to like any other page.
+func previewPageIDs(sources []source.Source) map[string]string {
+	ids := map[string]string{}
+	n := 0
+	for _, src := range sources {
+		if src.ID() == "" {
+			n++
+			ids[src.File()] = pendingID(n)
+		}
+	}
+
+	return ids
+}
+
+// previewURLs points pages and their attachments at the preview.
+type previewURLs struct {
+	s *previewServer
+	// files maps the ID of each page to the file of its source
+	files map[string]string
+}
+
+func (s *previewServer) pageURLs(sources []source.Source, ids map[string]string) *previewURLs {
+	files := map[string]string{}
+	for _, src := range sources {
+		files[pageID(src, ids)] = src.File()
+	}
+
+	return &previewURLs{s: s, files: files}
+}
+
+func (u *previewURLs) PageURL(id string) string {
+	return u.s.urlPath(u.files[id])
+}
+
+func (u *previewURLs) AttachmentURL(pageID string, filename string) string {
+	return previewAttachmentsPath + url.PathEscape(pageID) + "/" + url.PathEscape(filename)
+}
+
+func (s *previewServer) serveFile(w http.ResponseWriter, r *http.Request, file string) {
+	f, err := s.fs.Open(file)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+func (s *previewServer) sources() ([]source.Source, error) {
+	files, err := FindAll(s.fs, s.repoRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	browseUrlBase := viper.GetString("browse_url_base")
+
+	var sources []source.Source
+	for _, file := range files {
+		opts := sourceOpts(s.fs)
+		opts.StripComments = true
+		opts.TrimSpace = true
+		if browseUrlBase != "" {
+			opts.DoxNoticeFileUrl = fileBrowseUrl(browseUrlBase, s.repoRoot, file)
+		}
+
+		src, err := source.New(file, opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warn: %s\n", err)
+			continue
+		}
+		if src.Ignore() {
+			continue
+		}
+		sources = append(sources, src)
+	}
+
+	return sources, nil
+}
+
+// watch counts the changes to the files of the repo, until done is closed.
+func (s *previewServer) watch(files *repoWatcher, done chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case event, ok := <-files.notify.Events:
+			if !ok {
+				return
+			}
+			changed, err := files.changed(event)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "warn: %s\n", err)
+			}
+			if len(changed) == 0 {
+				continue
+			}
+			if s.verbose {
+				for _, file := range changed {
+					fmt.Printf("changed: %s\n", file)
+				}
+			}
+
+			s.mu.Lock()
+			s.changes++
+			s.mu.Unlock()
+		case err, ok := <-files.notify.Errors:
+			if !ok {
+				return
+			}
+			fmt.Fprintf(os.Stderr, "warn: %s\n", err)
+		}
+	}
+}
+
+// stamp identifies the state of the files of the repo, changing whenever one
+// of them does, or the server restarts.
+func (s *previewServer) stamp() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return fmt.Sprintf("%d.%d", s.started.UnixNano(), s.changes)
+}
+
+// inRepo returns whether file is in the repo, and so may be served.
+func (s *previewServer) inRepo(file string) bool {
+	return file == s.repoRoot || strings.HasPrefix(file, s.repoRoot+string(filepath.Separator))
+}
+
+func (s *previewServer) urlPath(file string) string {
+	rel, err := filepath.Rel(s.repoRoot, file)
+	if err != nil {
+		return "/"
+	}
+
+	return "/" + filepath.ToSlash(rel)
+}
@@ -0,0 +1,195 @@
+//go:build !windows
+// +build !windows
+
+package dox_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jesselang/dox/internal"
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+)
+
+// writeFiles writes files, by path relative to root, making their
+// directories.
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func get(t *testing.T, url string) string {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: %s\n%s", url, resp.Status, body)
+	}
+
+	return string(body)
+}
+
+func TestPreviewStamp(t *testing.T) {
+	root, err := ioutil.TempDir("", "dox-serve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viper.Reset()
+	defer viper.Reset()
+
+	writeFiles(t, root, map[string]string{
+		".git/HEAD":                  "",
+		".gitignore":                 "node_modules/\n*.log\n",
+		"docs/guide.md":              "# Guide\n",
+		"node_modules/pkg/README.md": "# Package\n",
+	})
+
+	handler, stop, err := dox.PreviewHandler(afero.NewOsFs(), root, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	stamp := get(t, srv.URL+"/_dox/stamp")
+	changed := func(wait time.Duration) bool {
+		// events arrive in the background
+		deadline := time.Now().Add(wait)
+		for time.Now().Before(deadline) {
+			if s := get(t, srv.URL+"/_dox/stamp"); s != stamp {
+				stamp = s
+				return true
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		return false
+	}
+	// settle lets the events of the last change arrive, since one write can
+	// make several
+	settle := func() {
+		time.Sleep(200 * time.Millisecond)
+		stamp = get(t, srv.URL+"/_dox/stamp")
+	}
+
+	// ignored files, including those in ignored directories made after the
+	// watch started, do not change the stamp
+	writeFiles(t, root, map[string]string{
+		"node_modules/pkg/README.md":   "# Package 2\n",
+		"node_modules/other/README.md": "# Other\n",
+		"docs/build.log":               "built\n",
+		".git/index":                   "",
+	})
+	if changed(500 * time.Millisecond) {
+		t.Error("changing ignored files changed the stamp")
+	}
+
+	writeFiles(t, root, map[string]string{"docs/guide.md": "# Guide\n\nMore.\n"})
+	if !changed(2 * time.Second) {
+		t.Error("changing a source did not change the stamp")
+	}
+
+	writeFiles(t, root, map[string]string{"docs/new/page.md": "# Page\n"})
+	if !changed(2 * time.Second) {
+		t.Error("adding a source in a new directory did not change the stamp")
+	}
+	writeFiles(t, root, map[string]string{"docs/new/page.md": "# Page\n\nMore.\n"})
+	if !changed(2 * time.Second) {
+		t.Error("changing a source in a new directory did not change the stamp")
+	}
+
+	// once the ignore files change, what they ignore changes too
+	writeFiles(t, root, map[string]string{".gitignore": "node_modules/\n*.log\ndocs/new/\n"})
+	if !changed(2 * time.Second) {
+		t.Error("changing .gitignore did not change the stamp")
+	}
+	settle()
+	writeFiles(t, root, map[string]string{"docs/new/page.md": "# Page\n\nEven more.\n"})
+	if changed(500 * time.Millisecond) {
+		t.Error("changing a source newly ignored changed the stamp")
+	}
+}
+
+func TestPreviewPage(t *testing.T) {
+	root, err := ioutil.TempDir("", "dox-serve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viper.Reset()
+	defer viper.Reset()
+	viper.Set("title", "Docs")
+	viper.Set("browse_url_base", "https://git.example.com/repo/blob/main")
+
+	writeFiles(t, root, map[string]string{
+		".git/HEAD":       "",
+		"README.md":       "# Readme\n\nSee [setup](docs/install.md#setup), [the license](LICENSE) and [the intro](#intro).\n\n## Intro\n\n![logo](img/logo.png)\n",
+		"docs/install.md": "# Install\n\n## Setup\n\nRun the installer.\n",
+		"img/logo.png":    "png",
+		"LICENSE":         "MIT",
+	})
+
+	handler, stop, err := dox.PreviewHandler(afero.NewOsFs(), root, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	// links and images are rewritten as they are when published, pointing
+	// at the preview instead of the wiki
+	readme := get(t, srv.URL+"/README.md")
+	for _, want := range []string{
+		`href="/docs/install.md#Install-Setup"`,
+		`href="https://git.example.com/repo/blob/main/LICENSE"`,
+		`href="#Readme-Intro"`,
+		`id="Readme-Intro"`,
+	} {
+		if !strings.Contains(readme, want) {
+			t.Errorf("README.md does not contain %s:\n%s", want, readme)
+		}
+	}
+	if install := get(t, srv.URL+"/docs/install.md"); !strings.Contains(install, `id="Install-Setup"`) {
+		t.Errorf("docs/install.md has no heading with the anchor linked to:\n%s", install)
+	}
+
+	m := regexp.MustCompile(`src="(/_dox/attachments/[^"]+)"`).FindStringSubmatch(readme)
+	if m == nil {
+		t.Fatalf("the image of README.md is not attached:\n%s", readme)
+	}
+	if logo := get(t, srv.URL+m[1]); logo != "png" {
+		t.Errorf("%s is %q, want the image", m[1], logo)
+	}
+}
@@ -0,0 +1,288 @@
+package dox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/jesselang/dox/internal/backend"
+	"github.com/jesselang/dox/internal/source"
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+)
+
+// commitProperty is the key of the content property on the root page that
+// records the commit last published.
+const commitProperty = "dox-commit"
+
+type publishedCommit struct {
+	Commit string `json:"commit"`
+	// Uncommitted lists the files, relative to the repo root, that had
+	// changes not in Commit when it was published, to publish again whether
+	// those changes are later committed or reverted.
+	Uncommitted []string `json:"uncommitted,omitempty"`
+}
+
+// PublishSince publishes only the sources affected by the files changed in
+// git since the commit since, or since the commit recorded on the root page by
+// the last publish if since is "", then records the commit published on the
+// root page. Every source is published if since is "" and no commit has been
+// recorded yet. Files with changes not yet committed are published, and
+// recorded to be published again by the next publish since the last.
+func PublishSince(fs afero.Fs, files []string, since string, repoRoot string, verbose bool, dryRun bool) error {
+	if IsStatic() {
+		// there is no root page to record the commit on
+		return publishStatic(fs, files, repoRoot, verbose, dryRun)
+	}
+
+	err := getConfigVars()
+	if err != nil {
+		return err
+	}
+
+	b, err := newBackend(fs)
+	if err != nil {
+		return err
+	}
+
+	head, err := git(repoRoot, "rev-parse", "--verify", "HEAD^{commit}")
+	if err != nil {
+		return err
+	}
+
+	uncommitted, err := uncommittedChanges(repoRoot, files)
+	if err != nil {
+		return err
+	}
+
+	lockID := ""
+	if !dryRun {
+		lockID, err = lockPageID(fs, b, files)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the commit published is read and recorded under the lock, so that
+	// runs at the same time do not skip each other's changes
+	return withLock(b, lockID, verbose, func(ctx context.Context) error {
+		var published publishedCommit
+		if since == "" {
+			published, err = getPublishedCommit(fs, b, files)
+			if err != nil {
+				return err
+			}
+			since = published.Commit
+			if since == "" && verbose {
+				fmt.Println("no commit has been published yet; publishing every source")
+			}
+		}
+
+		var changed []string
+		if since != "" {
+			changed, err = changedSince(repoRoot, since)
+			if err != nil {
+				return err
+			}
+			if verbose {
+				fmt.Printf("%d files changed since %s\n", len(changed), since)
+			}
+			// changes published last time that were not committed may
+			// have been reverted since
+			for _, p := range published.Uncommitted {
+				changed = append(changed, filepath.Join(repoRoot, filepath.FromSlash(p)))
+			}
+		}
+
+		plan, err := makePlan(fs, b, files, changed, repoRoot, viper.GetBool("prune"))
+		if err != nil {
+			return err
+		}
+
+		if dryRun {
+			fmt.Print(plan)
+			return nil
+		}
+
+		if err := applyPlan(ctx, fs, b, plan, repoRoot, verbose); err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if len(uncommitted) > 0 {
+			fmt.Fprintf(os.Stderr, "warning: published changes not committed to %s, which will be published again: %s\n", head, listPaths(uncommitted))
+		}
+		return setPublishedCommit(fs, b, files, publishedCommit{Commit: head, Uncommitted: uncommitted})
+	})
+}
+
+// changedSince returns the files of the repo that were modified, added,
+// deleted or renamed since the commit since, including changes not yet
+// committed. Both names of renamed files are returned.
+func changedSince(repoRoot string, since string) ([]string, error) {
+	out, err := git(repoRoot, "diff", "--name-status", "-z", "-M", since, "--")
+	if err != nil {
+		return nil, fmt.Errorf("%s; publish without --since or --since-last to publish every source", err)
+	}
+
+	changed := []string{}
+	fields := strings.Split(out, "\x00")
+	for i := 0; i < len(fields); i++ {
+		status := fields[i]
+		if status == "" {
+			continue
+		}
+
+		// renames and copies are followed by the old and new names
+		n := 1
+		if strings.HasPrefix(status, "R") || strings.HasPrefix(status, "C") {
+			n = 2
+		}
+		for j := 0; j < n && i+1 < len(fields); j++ {
+			i++
+			changed = append(changed, filepath.Join(repoRoot, filepath.FromSlash(fields[i])))
+		}
+	}
+
+	return changed, nil
+}
+
+// uncommittedChanges returns the paths of the files in the repo changed since
+// HEAD, including those staged, and those of files that git does not track.
+func uncommittedChanges(repoRoot string, files []string) ([]string, error) {
+	out, err := git(repoRoot, "status", "--porcelain", "-z", "--untracked-files=all")
+	if err != nil {
+		return nil, err
+	}
+
+	sources := map[string]bool{}
+	for _, file := range files {
+		sources[file] = true
+	}
+
+	var changed []string
+	entries := strings.Split(out, "\x00")
+	for i := 0; i < len(entries); i++ {
+		// entries are a two letter status, a space and the path
+		entry := entries[i]
+		if len(entry) < 4 {
+			continue
+		}
+		status, p := entry[:2], entry[3:]
+		if status[0] == 'R' || status[0] == 'C' {
+			// followed by the old name
+			i++
+		}
+		if status == "??" && !sources[filepath.Join(repoRoot, filepath.FromSlash(p))] {
+			continue
+		}
+		changed = append(changed, p)
+	}
+
+	return changed, nil
+}
+
+// listPaths lists the first few paths, for messages.
+func listPaths(paths []string) string {
+	if len(paths) > 3 {
+		paths = append(paths[:3:3], "...")
+	}
+
+	return strings.Join(paths, ", ")
+}
+
+// getPublishedCommit returns the commit recorded on the root page, which is
+// empty if there is none or the root page has not been published.
+func getPublishedCommit(fs afero.Fs, b backend.Backend, files []string) (publishedCommit, error) {
+	var c publishedCommit
+	id, err := rootPageID(fs, files)
+	if err != nil || id == "" {
+		return c, err
+	}
+
+	prop, err := b.GetProperty(id, commitProperty)
+	if err != nil || prop == nil {
+		return c, err
+	}
+
+	if err := json.Unmarshal(prop.Value, &c); err != nil {
+		return c, fmt.Errorf("page %s: invalid %s property: %s", id, commitProperty, err)
+	}
+
+	return c, nil
+}
+
+// setPublishedCommit records commit on the root page.
+func setPublishedCommit(fs afero.Fs, b backend.Backend, files []string, commit publishedCommit) error {
+	id, err := rootPageID(fs, files)
+	if err != nil {
+		return err
+	}
+
+	value, err := json.Marshal(commit)
+	if err != nil {
+		return err
+	}
+
+	prop, err := b.GetProperty(id, commitProperty)
+	if err != nil {
+		return err
+	}
+	if prop == nil {
+		prop = &backend.Property{Key: commitProperty}
+	}
+	prop.Value = value
+
+	_, err = b.SetProperty(id, prop)
+	return err
+}
+
+// rootPageID returns the ID of the root page of files, or "" if it has not
+// been published.
+func rootPageID(fs afero.Fs, files []string) (string, error) {
+	var sources []source.Source
+	for _, file := range files {
+		src, err := source.New(file, sourceOpts(fs))
+		if err != nil {
+			return "", err
+		}
+		if !src.Ignore() {
+			sources = append(sources, src)
+		}
+	}
+
+	root, err := getRootPageSrc(sources)
+	if err != nil {
+		return "", err
+	}
+	if root == nil {
+		root, err = source.New("", sourceOpts(fs))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return root.ID(), nil
+}
+
+// git runs git in repoRoot and returns its output, without a trailing
+// newline.
+func git(repoRoot string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = repoRoot
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %s: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
@@ -4,16 +4,22 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/russross/blackfriday"
+	"github.com/spf13/afero"
+	"gopkg.in/yaml.v2"
 )
 
 const rootPageFilename = "ROOT.md"
+
+// utf8BOM is the byte order mark some editors begin UTF-8 files with.
+const utf8BOM = "\ufeff"
 const confluenceEditNotice = `<p>
   <ac:structured-macro ac:name="info" ac:schema-version="1">
     <ac:parameter ac:name="title">This page was published by dox</ac:parameter>
@@ -24,14 +30,46 @@ const confluenceEditNotice = `<p>
 </p>`
 
 type markdown struct {
-	data       []byte
-	directives []string
-	filename   string
-	id         string
-	ignore     bool
-	omitNotice bool
-	opts       Opts
-	title      string
+	data           []byte
+	directives     []string
+	directiveTitle string
+	filename       string
+	frontMatter    frontMatter
+	id             string
+	ignore         bool
+	labels         []string
+	omitNotice     bool
+	opts           Opts
+	// targetIDs maps the name of each target in config to the ID of the
+	// page published there
+	targetIDs map[string]string
+	title     string
+}
+
+// frontMatter is the YAML block, between lines of ---, that may begin a
+// markdown file after the dox header.
+type frontMatter struct {
+	Labels stringList `yaml:"labels"`
+	Title  string     `yaml:"title"`
+}
+
+// stringList is a list in YAML that may also be written as a single string.
+type stringList []string
+
+func (l *stringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err == nil {
+		*l = stringList{s}
+		return nil
+	}
+
+	var list []string
+	if err := unmarshal(&list); err != nil {
+		return err
+	}
+	*l = list
+
+	return nil
 }
 
 func (m *markdown) Extensions() []string {
@@ -53,51 +91,84 @@ func (m *markdown) File() string {
 }
 
 func (m *markdown) ID() string {
+	if target := m.opts.Target; target != "" {
+		if id := m.targetIDs[target]; id != "" || !m.opts.DefaultTarget {
+			return id
+		}
+	}
+
 	return m.id
 }
 
 func (m *markdown) SetID(ID string) (err error) {
-	if m.id != "" {
+	if m.ID() != "" {
 		return errors.New("source already has an ID")
 	}
 
-	m.directives = append([]string{ID}, m.directives...)
+	target := m.opts.Target
+	if target != "" {
+		m.directives = append(m.directives, target+SDTargetIDSeparator+ID)
+	} else {
+		m.directives = append([]string{ID}, m.directives...)
+	}
 	doxHeader := fmt.Sprintf(m.escape(doxHeaderFmt), strings.Join(m.directives, ", "))
 
-	buf, err := ioutil.ReadFile(m.filename)
+	buf, err := afero.ReadFile(m.fs(), m.filename)
 	if err != nil {
 		return
 	}
 
-	lines := strings.Split(string(buf), "\n")
+	err = writeFile(m.fs(), m.filename, m.withHeader(buf, doxHeader))
+	if err != nil {
+		return
+	}
+
+	if target != "" {
+		m.targetIDs[target] = ID
+	} else {
+		m.id = ID
+	}
 
+	return nil
+}
+
+// withHeader returns the contents of the file with its dox header replaced by
+// header, or with header added as the first line if it has none. As when
+// parsing, the dox header is looked for up to the second line that is not
+// blank. A byte order mark is kept first, and the line endings of the file
+// are kept.
+func (m *markdown) withHeader(buf []byte, header string) []byte {
+	s := string(buf)
+	bom := ""
+	if strings.HasPrefix(s, utf8BOM) {
+		bom = utf8BOM
+		s = s[len(bom):]
+	}
+
+	re := regexp.MustCompile(m.escape(doxHeaderRegexp))
+	lines := strings.SplitAfter(s, "\n")
+	count := 0
 	for i, line := range lines {
-		if i >= 2 {
-			lines = append([]string{doxHeader}, lines...)
+		if count == 2 {
 			break
 		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		count++
 
-		found := regexp.MustCompile(m.escape(doxHeaderRegexp)).MatchString(line)
-		if found {
-			lines[i] = doxHeader
-			break
+		if re.MatchString(line) {
+			lines[i] = header + line[len(strings.TrimRight(line, "\r\n")):]
+			return []byte(bom + strings.Join(lines, ""))
 		}
 	}
 
-	f, err := os.Create(m.filename)
-	if err != nil {
-		return
+	eol := "\n"
+	if strings.HasSuffix(lines[0], "\r\n") {
+		eol = "\r\n"
 	}
-	defer f.Close()
 
-	_, err = f.Write([]byte(strings.Join(lines, "\n")))
-	if err != nil {
-		return
-	}
-
-	m.id = ID
-
-	return nil
+	return []byte(bom + header + eol + s)
 }
 
 func (m *markdown) Title() string {
@@ -111,13 +182,28 @@ func (m *markdown) Output() string {
 		s = strings.TrimSpace(s)
 	}
 
-	if !m.omitNotice {
+	if !m.omitNotice && !m.opts.OmitNotice {
 		s = fmt.Sprintf(confluenceEditNotice, m.opts.DoxNoticeFileUrl) + s
 	}
 
 	return s
 }
 
+func (m *markdown) Labels() []string {
+	var labels []string
+	seen := map[string]bool{}
+	for _, l := range append(append([]string(nil), m.labels...), m.frontMatter.Labels...) {
+		l = strings.TrimSpace(l)
+		if l == "" || seen[l] {
+			continue
+		}
+		seen[l] = true
+		labels = append(labels, l)
+	}
+
+	return labels
+}
+
 func (m *markdown) Ignore() bool {
 	return m.ignore
 }
@@ -130,28 +216,64 @@ func (m *markdown) escape(input string) string {
 	return fmt.Sprintf("<!-- %s -->", input)
 }
 
+// fs returns the filesystem the source is read from and written to.
+func (m *markdown) fs() afero.Fs {
+	if m.opts.Fs == nil {
+		return afero.NewOsFs()
+	}
+
+	return m.opts.Fs
+}
+
 func (m *markdown) parse(filename string, opts Opts) (err error) {
-	f, err := os.Open(filename)
+	m.filename = filename
+	m.opts = opts
+	m.targetIDs = map[string]string{}
+
+	f, err := m.fs().Open(filename)
 	if err != nil {
 		return
 	}
 	defer f.Close()
 
-	m.filename = filename
-	m.opts = opts
-
 	r := bufio.NewReader(f)
+	if bom, err := r.Peek(len(utf8BOM)); err == nil && string(bom) == utf8BOM {
+		r.Discard(len(bom))
+	}
+
+	// next is a line read ahead to see whether it underlines a setext
+	// heading, to be handled as the next line if it does not
+	var next *string
+	readLine := func() (string, error) {
+		if next != nil {
+			line := *next
+			next = nil
+			return line, nil
+		}
+
+		line, err := r.ReadString('\n')
+		if err == io.EOF && line != "" {
+			// the last line of a file without a trailing newline
+			err = nil
+		}
+		return line, err
+	}
 
 	doxHeaderFound := false
+	// front matter may only follow the dox header
+	atStart := true
 	inComment := false
 	var line string
 	count := 0
 	for count < 2 {
-		line, err = r.ReadString('\n')
-		if err != nil {
+		line, err = readLine()
+		if err == io.EOF {
+			err = nil
+			break
+		} else if err != nil {
 			return
 		}
-		if len(line) > 1 {
+		if strings.TrimSpace(line) != "" {
 			count++
 		}
 
@@ -161,7 +283,7 @@ func (m *markdown) parse(filename string, opts Opts) (err error) {
 
 			if len(match) > 0 {
 				doxHeaderFound = true
-				m.directives = regexp.MustCompile(`,\s*`).Split(match[1], -1)
+				m.directives = splitDirectives(match[1])
 				err = m.parseDirectives()
 				if err != nil {
 					return err
@@ -170,6 +292,17 @@ func (m *markdown) parse(filename string, opts Opts) (err error) {
 			}
 		}
 
+		if atStart && strings.TrimRight(line, "\r\n") == "---" {
+			count--
+			err = m.parseFrontMatter(r)
+			if err != nil {
+				return err
+			}
+			atStart = false
+			continue
+		}
+		atStart = false
+
 		if inComment {
 			count--
 			i := strings.Index(line, "-->")
@@ -199,19 +332,54 @@ func (m *markdown) parse(filename string, opts Opts) (err error) {
 			continue
 		}
 
-		if strings.HasPrefix(line, "#") {
-			m.title = line[2 : len(line)-1]
+		if title, ok := atxHeading(line); ok {
+			m.title = title
 
 			break
-		} else {
-			m.data = append(m.data, line...)
 		}
+
+		if strings.TrimSpace(line) != "" {
+			var underline string
+			underline, err = readLine()
+			if err != nil && err != io.EOF {
+				return
+			}
+			err = nil
+			if isSetextUnderline(underline) {
+				m.title = stripInlineMarkdown(strings.TrimSpace(line))
+
+				break
+			}
+			if underline != "" {
+				next = &underline
+			}
+		}
+
+		m.data = append(m.data, line...)
+	}
+	if next != nil {
+		m.data = append(m.data, *next...)
+	}
+
+	if m.ignore {
+		return
 	}
 
-	if !m.ignore && m.title == "" {
+	if m.frontMatter.Title != "" {
+		m.title = m.frontMatter.Title
+	}
+	if m.directiveTitle != "" {
+		m.title = m.directiveTitle
+	}
+	if m.title == "" {
 		return fmt.Errorf("%s: title not found", filename)
 	}
 
+	m.title, err = configuredTitle(m.title, filename)
+	if err != nil {
+		return
+	}
+
 	rest, err := ioutil.ReadAll(r)
 	if err != nil {
 		return
@@ -222,13 +390,42 @@ func (m *markdown) parse(filename string, opts Opts) (err error) {
 	return
 }
 
+// parseFrontMatter reads front matter from r, up to and including the line
+// that closes it.
+func (m *markdown) parseFrontMatter(r *bufio.Reader) error {
+	var buf []byte
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return fmt.Errorf("%s: front matter is not closed", m.File())
+		} else if err != nil {
+			return err
+		}
+
+		trimmed := strings.TrimRight(line, "\r\n")
+		if trimmed == "---" || trimmed == "..." {
+			break
+		}
+		if err == io.EOF {
+			return fmt.Errorf("%s: front matter is not closed", m.File())
+		}
+		buf = append(buf, line...)
+	}
+
+	if err := yaml.Unmarshal(buf, &m.frontMatter); err != nil {
+		return fmt.Errorf("%s: invalid front matter: %s", m.File(), err)
+	}
+
+	return nil
+}
+
 func (m *markdown) parseDirectives() error {
 	// check that required directives are in expected position
 	for i, d := range m.directives {
 		if d == SDIgnore && i != 0 {
 			return fmt.Errorf("invalid dox header format; ignore should be first: %s\n", m.File())
 		}
-		if regexp.MustCompile(SDID).MatchString(d) && i != 0 {
+		if isIDDirective(d) && i != 0 {
 			return fmt.Errorf("invalid dox header format; Confluence ID should be first: %s\n", m.File())
 		}
 	}
@@ -239,12 +436,35 @@ func (m *markdown) parseDirectives() error {
 			m.ignore = true
 			// since file is ignored, do not continue execution
 			return nil
-		case regexp.MustCompile(SDID).MatchString(d):
+		case isIDDirective(d):
 			m.id = d
 		case d == SDOmitNotice:
 			m.omitNotice = true
+		case strings.HasPrefix(d, SDTitle):
+			title := strings.TrimPrefix(d, SDTitle)
+			if strings.HasPrefix(title, `"`) {
+				unquoted, err := strconv.Unquote(title)
+				if err != nil {
+					return fmt.Errorf("invalid dox header format; title should be quoted: %s\n", m.File())
+				}
+				title = unquoted
+			}
+			m.directiveTitle = strings.TrimSpace(title)
+		case strings.HasPrefix(d, SDLabels):
+			m.labels = append(m.labels, strings.Split(strings.TrimPrefix(d, SDLabels), ";")...)
+		case targetIDRegexp.MatchString(d):
+			match := targetIDRegexp.FindStringSubmatch(d)
+			m.targetIDs[match[1]] = match[2]
 		}
 	}
 
 	return nil
 }
+
+var targetIDRegexp = regexp.MustCompile(`^([\w.-]+)` + SDTargetIDSeparator + `(` + SDID + `)$`)
+
+// isIDDirective reports whether the directive d is a page ID, rather than a
+// directive that merely contains digits, such as a title.
+func isIDDirective(d string) bool {
+	return regexp.MustCompile(`^` + SDID + `$`).MatchString(d)
+}
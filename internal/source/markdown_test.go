@@ -0,0 +1,317 @@
+//go:build !windows
+// +build !windows
+
+package source_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jesselang/dox/internal/source"
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+)
+
+// newSource writes content to a markdown file in a temporary directory, and
+// returns it parsed as a source.
+func newSource(t *testing.T, content string) (source.Source, error) {
+	dir, err := ioutil.TempDir("", "dox-source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "doc.md")
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return source.New(file, source.Opts{StripComments: true, TrimSpace: true})
+}
+
+func TestTitle(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+		title   string
+	}{
+		{"atx", "# Title\n\ntext\n", "Title"},
+		{"atx level 2", "## Title\n\ntext\n", "Title"},
+		{"atx closing sequence", "# Title ##\n", "Title"},
+		{"atx ending in hash", "# C#\n", "C#"},
+		{"atx indented", "   # Title\n", "Title"},
+		{"setext", "Title\n=====\n\ntext\n", "Title"},
+		{"setext level 2", "Title\n---\n\ntext\n", "Title"},
+		{"crlf", "# Title\r\n\r\ntext\r\n", "Title"},
+		{"setext crlf", "Title\r\n=====\r\n", "Title"},
+		{"no trailing newline", "# Title", "Title"},
+		{"setext no trailing newline", "Title\n===", "Title"},
+		{"after dox header", "<!-- dox: 123 -->\n# Title\n", "Title"},
+		{"after comment", "<!-- a\ncomment -->\n# Title\n", "Title"},
+		{"after blank lines", "\n\n# Title\n", "Title"},
+		{"inline markup", "# The **bold** and *emphatic* `code_span` of [links](x.md)\n", "The bold and emphatic code_span of links"},
+		{"snake case", "# my_snake_case\n", "my_snake_case"},
+		{"escapes", "# 1\\. Not a list\n", "1. Not a list"},
+		{"title directive", "<!-- dox: 123, title=\"Release 2, final\" -->\n# Heading\n", "Release 2, final"},
+		{"title directive without heading", "<!-- dox: title=Overview -->\ntext\n", "Overview"},
+		{"front matter", "---\ntitle: From Front Matter\n---\n# Heading\n", "From Front Matter"},
+		{"front matter after header", "<!-- dox: 123 -->\n---\ntitle: From Front Matter\n---\n", "From Front Matter"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			src, err := newSource(t, tc.content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := src.Title(); got != tc.title {
+				t.Errorf("title is %q, want %q", got, tc.title)
+			}
+		})
+	}
+}
+
+func TestTitleNotFound(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+	}{
+		{"empty", ""},
+		{"text", "text\n\nmore text\n"},
+		{"hashtag", "#hashtag\n"},
+		{"indented code", "    # code\n"},
+		{"too late", "text\nmore text\n# Title\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := newSource(t, tc.content); err == nil || !strings.Contains(err.Error(), "title not found") {
+				t.Errorf("error is %v, want title not found", err)
+			}
+		})
+	}
+}
+
+func TestTitleIsNotOutput(t *testing.T) {
+	for _, content := range []string{
+		"# Title\n\ntext\n",
+		"Title\n=====\n\ntext\n",
+		"---\nlabels: [a]\n---\n# Title\n\ntext\n",
+	} {
+		src, err := newSource(t, "<!-- dox: 123, omit-notice -->\n"+content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := src.Output(); got != "<p>text</p>" {
+			t.Errorf("output of %q is %q, want <p>text</p>", content, got)
+		}
+	}
+}
+
+func TestConfiguredTitle(t *testing.T) {
+	defer viper.Reset()
+
+	for _, tc := range []struct {
+		name   string
+		config map[string]string
+		title  string
+	}{
+		{"prefix", map[string]string{"title_prefix": "Docs: "}, "Docs: Title"},
+		{"template", map[string]string{"title_template": "{{.Title}} ({{.Dir}})"}, "Title (guides)"},
+		{"template over prefix", map[string]string{"title_prefix": "Docs: ", "title_template": "{{.Path}}"}, "guides/doc.md"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			viper.Reset()
+			dir, err := ioutil.TempDir("", "dox-source")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			viper.SetConfigFile(filepath.Join(dir, ".dox.yaml"))
+			for k, v := range tc.config {
+				viper.Set(k, v)
+			}
+
+			file := filepath.Join(dir, "guides", "doc.md")
+			if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(file, []byte("# Title\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			src, err := source.New(file, source.Opts{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := src.Title(); got != tc.title {
+				t.Errorf("title is %q, want %q", got, tc.title)
+			}
+		})
+	}
+}
+
+func TestSetID(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		target  string
+		content string
+		want    string
+	}{
+		{"no header", "", "# Title\n\ntext\n", "<!-- dox: 42 -->\n# Title\n\ntext\n"},
+		{"one line", "", "# Title\n", "<!-- dox: 42 -->\n# Title\n"},
+		{"no trailing newline", "", "# Title", "<!-- dox: 42 -->\n# Title"},
+		{"setext", "", "Title\n=====\n", "<!-- dox: 42 -->\nTitle\n=====\n"},
+		{"front matter", "", "---\ntitle: Title\n---\n", "<!-- dox: 42 -->\n---\ntitle: Title\n---\n"},
+		{"header with directives", "", "<!-- dox: omit-notice -->\n# Title\n", "<!-- dox: 42, omit-notice -->\n# Title\n"},
+		{"header after blank line", "", "\n<!-- dox: labels=a -->\n# Title\n", "\n<!-- dox: 42, labels=a -->\n# Title\n"},
+		{"target", "prod", "<!-- dox: 7 -->\n# Title\n", "<!-- dox: 7, prod:42 -->\n# Title\n"},
+		{"second target", "prod", "<!-- dox: dev:7 -->\n# Title\n", "<!-- dox: dev:7, prod:42 -->\n# Title\n"},
+		{"crlf", "", "# Title\r\n\r\ntext\r\n", "<!-- dox: 42 -->\r\n# Title\r\n\r\ntext\r\n"},
+		{"crlf header", "", "<!-- dox: omit-notice -->\r\n# Title\r\n", "<!-- dox: 42, omit-notice -->\r\n# Title\r\n"},
+		{"mixed line endings", "", "# Title\n\ntext\r\n", "<!-- dox: 42 -->\n# Title\n\ntext\r\n"},
+		{"byte order mark", "", "\ufeff# Title\n", "\ufeff<!-- dox: 42 -->\n# Title\n"},
+		{"byte order mark header", "", "\ufeff<!-- dox: omit-notice -->\n# Title\n", "\ufeff<!-- dox: 42, omit-notice -->\n# Title\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			file := "/repo/docs/doc.md"
+			if err := afero.WriteFile(fs, file, []byte(tc.content), 0640); err != nil {
+				t.Fatal(err)
+			}
+
+			src, err := source.New(file, source.Opts{Fs: fs, Target: tc.target})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := src.SetID("42"); err != nil {
+				t.Fatal(err)
+			}
+			if got := src.ID(); got != "42" {
+				t.Errorf("ID is %q, want 42", got)
+			}
+
+			buf, err := afero.ReadFile(fs, file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(buf); got != tc.want {
+				t.Errorf("file is %q, want %q", got, tc.want)
+			}
+
+			info, err := fs.Stat(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mode := info.Mode().Perm(); mode != 0640 {
+				t.Errorf("file mode is %v, want %v", mode, os.FileMode(0640))
+			}
+			names, err := afero.ReadDir(fs, "/repo/docs")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(names) != 1 {
+				t.Errorf("directory has %d files after writing, want 1", len(names))
+			}
+
+			// the header written is read back
+			src, err = source.New(file, source.Opts{Fs: fs, Target: tc.target})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := src.ID(); got != "42" {
+				t.Errorf("ID read back is %q, want 42", got)
+			}
+		})
+	}
+}
+
+func TestTargetID(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		header        string
+		target        string
+		defaultTarget bool
+		want          string
+	}{
+		{"no target", "7, prod:8", "", false, "7"},
+		{"target", "7, prod:8", "prod", false, "8"},
+		{"target without an ID", "7", "prod", false, ""},
+		{"default target", "7, prod:8", "prod", true, "8"},
+		{"default target without an ID", "7, dev:9", "prod", true, "7"},
+		{"only other targets", "dev:9", "prod", true, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			file := "/repo/doc.md"
+			content := "<!-- dox: " + tc.header + " -->\n# Title\n"
+			if err := afero.WriteFile(fs, file, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			src, err := source.New(file, source.Opts{Fs: fs, Target: tc.target, DefaultTarget: tc.defaultTarget})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := src.ID(); got != tc.want {
+				t.Errorf("ID is %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSetIDKeepsFileOnError(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	file := "/repo/doc.md"
+	if err := afero.WriteFile(fs, file, []byte("# Title\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := source.New(file, source.Opts{Fs: afero.NewReadOnlyFs(fs)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := src.SetID("42"); err == nil {
+		t.Fatal("header was written to a read-only filesystem")
+	}
+
+	buf, err := afero.ReadFile(fs, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf); got != "# Title\n" {
+		t.Errorf("file is %q after a failed write", got)
+	}
+}
+
+func TestSetIDOverlay(t *testing.T) {
+	base := afero.NewMemMapFs()
+	file := "/repo/doc.md"
+	if err := afero.WriteFile(base, file, []byte("# Title\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// as in CI, where the checkout is read-only and changes are kept in memory
+	fs := afero.NewCopyOnWriteFs(afero.NewReadOnlyFs(base), afero.NewMemMapFs())
+
+	src, err := source.New(file, source.Opts{Fs: fs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := src.SetID("42"); err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := afero.ReadFile(fs, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf); got != "<!-- dox: 42 -->\n# Title\n" {
+		t.Errorf("overlay file is %q", got)
+	}
+	buf, err = afero.ReadFile(base, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf); got != "# Title\n" {
+		t.Errorf("base file is %q", got)
+	}
+}
@@ -2,8 +2,11 @@ package source
 
 import (
 	"errors"
+	"fmt"
 
+	"github.com/spf13/afero"
 	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
 )
 
 const rootContent = `<p>
@@ -14,7 +17,9 @@ const rootContent = `<p>
 
 <p><em>This page was generated by dox</em></p>`
 
-type root struct{}
+type root struct {
+	opts Opts
+}
 
 func (r *root) Extensions() []string {
 	return []string{}
@@ -37,6 +42,14 @@ func (r *root) SetID(ID string) error {
 		return errors.New("source already has an ID")
 	}
 
+	if target := r.opts.Target; target != "" {
+		if err := setTargetRootID(r.fs(), viper.ConfigFileUsed(), target, ID); err != nil {
+			return err
+		}
+		viper.Set("root_id", ID)
+		return nil
+	}
+
 	// XXX: storing the root page ID in the config file is cheap,
 	//      but it's adequate for now.
 	viper.Set("root_id", ID)
@@ -48,6 +61,69 @@ func (r *root) SetID(ID string) error {
 	return nil
 }
 
+// setTargetRootID records the root page ID of a target in the config file.
+// The file is rewritten directly, since the settings of the target are
+// overlaid on the rest of the config while publishing to it.
+func setTargetRootID(fs afero.Fs, configFile string, target string, ID string) error {
+	buf, err := afero.ReadFile(fs, configFile)
+	if err != nil {
+		return err
+	}
+
+	var config yaml.MapSlice
+	if err := yaml.Unmarshal(buf, &config); err != nil {
+		return fmt.Errorf("%s: %s", configFile, err)
+	}
+
+	found := false
+	for _, item := range config {
+		if item.Key != "targets" {
+			continue
+		}
+		// maps in a MapSlice are decoded as MapSlices too, keeping the order
+		// of the keys in each target
+		targets, _ := item.Value.([]interface{})
+		for i, t := range targets {
+			entry, _ := t.(yaml.MapSlice)
+			if !hasKey(entry, "name", target) {
+				continue
+			}
+			set := false
+			for j := range entry {
+				if entry[j].Key == "root_id" {
+					entry[j].Value = ID
+					set = true
+				}
+			}
+			if !set {
+				entry = append(entry, yaml.MapItem{Key: "root_id", Value: ID})
+			}
+			targets[i] = entry
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("%s: no target named %s", configFile, target)
+	}
+
+	buf, err = yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	return writeFile(fs, configFile, buf)
+}
+
+func hasKey(m yaml.MapSlice, key string, value string) bool {
+	for _, item := range m {
+		if item.Key == key && fmt.Sprint(item.Value) == value {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (r *root) Title() string {
 	// TODO: handle error here when title is not defined in config
 	return viper.GetString("title")
@@ -57,6 +133,10 @@ func (r *root) Output() string {
 	return rootContent
 }
 
+func (r *root) Labels() []string {
+	return nil
+}
+
 func (r *root) Ignore() bool {
 	return false
 }
@@ -65,6 +145,17 @@ func (r *root) IsRootPage() bool {
 	return true
 }
 
+// fs returns the filesystem the config file is written to.
+func (r *root) fs() afero.Fs {
+	if r.opts.Fs == nil {
+		return afero.NewOsFs()
+	}
+
+	return r.opts.Fs
+}
+
 func (r *root) parse(filename string, opts Opts) (err error) {
+	r.opts = opts
+
 	return nil
 }
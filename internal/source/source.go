@@ -2,6 +2,8 @@ package source
 
 import (
 	"fmt"
+
+	"github.com/spf13/afero"
 )
 
 const doxHeaderFmt = "dox: %s"
@@ -12,12 +14,31 @@ const (
 	SDID = `\d+`
 	SDIgnore = "ignore"
 	SDOmitNotice = "omit-notice"
+	SDLabels = "labels="
+	SDTitle = "title="
+	// the ID of the page in a target is given as <target>:<ID>
+	SDTargetIDSeparator = ":"
 )
 
 type Opts struct {
 	DoxNoticeFileUrl string
-	StripComments    bool
-	TrimSpace        bool
+	// Fs is the filesystem the source is read from and its dox header is
+	// written to, which is the OS filesystem if nil. The ID of the root page
+	// is written to the config file, so viper should read config from the
+	// same filesystem, as set with viper.SetFs.
+	Fs afero.Fs
+	// OmitNotice leaves out the notice, meant for readers of the wiki, that
+	// the page was published by dox and changes to it will be overwritten.
+	OmitNotice    bool
+	StripComments bool
+	// Target is the name of the target in config the source is published
+	// to, or "" without targets.
+	Target string
+	// DefaultTarget is set if Target is the first target in config, which
+	// keeps the pages published before targets were added: without an ID
+	// of its own in the dox header, the ID that names no target is used.
+	DefaultTarget bool
+	TrimSpace     bool
 }
 
 type Source interface {
@@ -26,6 +47,7 @@ type Source interface {
 	ID() string
 	Ignore() bool
 	IsRootPage() bool
+	Labels() []string
 	Matches(string) bool
 	Output() string
 	SetID(string) error
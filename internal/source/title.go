@@ -0,0 +1,177 @@
+package source
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/spf13/viper"
+)
+
+// atxHeading returns the text of line if it is an ATX heading, such as
+// "## Title ##".
+func atxHeading(line string) (string, bool) {
+	line = strings.TrimRight(line, "\r\n")
+	trimmed := strings.TrimLeft(line, " ")
+	if len(line)-len(trimmed) > 3 {
+		// indented code
+		return "", false
+	}
+
+	level := len(trimmed) - len(strings.TrimLeft(trimmed, "#"))
+	if level < 1 || level > 6 {
+		return "", false
+	}
+	text := trimmed[level:]
+	if text != "" && text[0] != ' ' && text[0] != '\t' {
+		// such as #hashtag
+		return "", false
+	}
+	text = strings.TrimSpace(text)
+
+	// an optional closing sequence of #s
+	if t := strings.TrimRight(text, "#"); t == "" || strings.HasSuffix(t, " ") || strings.HasSuffix(t, "\t") {
+		text = strings.TrimSpace(t)
+	}
+	if text == "" {
+		return "", false
+	}
+
+	return stripInlineMarkdown(text), true
+}
+
+// isSetextUnderline reports whether line underlines the line before it as a
+// setext heading.
+func isSetextUnderline(line string) bool {
+	line = strings.TrimRight(line, "\r\n")
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" || len(line)-len(strings.TrimLeft(line, " ")) > 3 {
+		return false
+	}
+
+	return strings.Trim(trimmed, "=") == "" || strings.Trim(trimmed, "-") == ""
+}
+
+var (
+	codeSpanRegexp = regexp.MustCompile("(`+)([^`]*)`+")
+	inlineRegexps  = []struct {
+		re   *regexp.Regexp
+		repl string
+	}{
+		{regexp.MustCompile(`!?\[([^\]]*)\]\([^)]*\)`), "$1"},
+		{regexp.MustCompile(`!?\[([^\]]*)\]\[[^\]]*\]`), "$1"},
+		{regexp.MustCompile(`</?[a-zA-Z][^>]*>`), ""},
+		{regexp.MustCompile(`\*\*(.+?)\*\*`), "$1"},
+		{regexp.MustCompile(`__(.+?)__`), "$1"},
+		{regexp.MustCompile(`\*(.+?)\*`), "$1"},
+		{regexp.MustCompile(`\b_(.+?)_\b`), "$1"},
+		{regexp.MustCompile(`~~(.+?)~~`), "$1"},
+		{regexp.MustCompile("\\\\([\\\\`*_{}\\[\\]()#+\\-.!~<>|])"), "$1"},
+	}
+)
+
+// stripInlineMarkdown returns the text of a heading without its inline
+// markup, as it reads when rendered.
+func stripInlineMarkdown(text string) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range codeSpanRegexp.FindAllStringSubmatchIndex(text, -1) {
+		b.WriteString(stripInlineMarkup(text[last:m[0]]))
+		b.WriteString(strings.TrimSpace(text[m[4]:m[5]]))
+		last = m[1]
+	}
+	b.WriteString(stripInlineMarkup(text[last:]))
+
+	return strings.TrimSpace(b.String())
+}
+
+// stripInlineMarkup strips markup from text outside of code spans.
+func stripInlineMarkup(text string) string {
+	for _, r := range inlineRegexps {
+		text = r.re.ReplaceAllString(text, r.repl)
+	}
+
+	return text
+}
+
+// splitDirectives splits the items of a dox header on commas that are not
+// within a quoted title.
+func splitDirectives(header string) []string {
+	var items []string
+	var item strings.Builder
+	quoted := false
+	escaped := false
+	for _, c := range header {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\' && quoted:
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == ',' && !quoted:
+			items = append(items, strings.TrimSpace(item.String()))
+			item.Reset()
+			continue
+		}
+		item.WriteRune(c)
+	}
+
+	return append(items, strings.TrimSpace(item.String()))
+}
+
+// titleData is what title_template is executed with.
+type titleData struct {
+	// Title is the title of the source.
+	Title string
+	// Path is the file of the source relative to the config file, and Dir is
+	// its directory.
+	Path string
+	Dir  string
+	// Repo is the name of the directory of the config file.
+	Repo string
+}
+
+// configuredTitle returns title as configured by title_template, or else
+// with title_prefix before it.
+func configuredTitle(title string, filename string) (string, error) {
+	text := viper.GetString("title_template")
+	if text == "" {
+		return viper.GetString("title_prefix") + title, nil
+	}
+
+	tmpl, err := template.New("title_template").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	dir := "."
+	if config := viper.ConfigFileUsed(); config != "" {
+		dir = filepath.Dir(config)
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+
+	path := filename
+	if rel, err := filepath.Rel(dir, filename); err == nil {
+		path = rel
+	}
+	path = filepath.ToSlash(path)
+
+	data := titleData{
+		Title: title,
+		Path:  path,
+		Dir:   filepath.ToSlash(filepath.Dir(path)),
+		Repo:  filepath.Base(abs),
+	}
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(b.String()), nil
+}
@@ -0,0 +1,51 @@
+package source
+
+import (
+	"path/filepath"
+
+	"github.com/spf13/afero"
+)
+
+// writeFile replaces the contents of an existing file by writing them to a
+// temporary file beside it and renaming that over it, so the file is never
+// left partly written. The mode of the file is kept.
+func writeFile(fs afero.Fs, filename string, data []byte) error {
+	// renaming over a symlink would replace it, rather than the file it
+	// links to
+	if _, ok := fs.(*afero.OsFs); ok {
+		if resolved, err := filepath.EvalSymlinks(filename); err == nil {
+			filename = resolved
+		}
+	}
+
+	info, err := fs.Stat(filename)
+	if err != nil {
+		return err
+	}
+
+	f, err := afero.TempFile(fs, filepath.Dir(filename), "."+filepath.Base(filename)+".dox-")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = fs.Chmod(tmp, info.Mode().Perm())
+	}
+	if err == nil {
+		err = fs.Rename(tmp, filename)
+	}
+	if err != nil {
+		fs.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
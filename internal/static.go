@@ -0,0 +1,337 @@
+package dox
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/jesselang/dox/internal/source"
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+)
+
+// staticBackend is the backend of a target that is a static site rendered to
+// static.output, rather than a wiki.
+const staticBackend = "static"
+
+// staticSiteMarker is the file written to the output directory of a static
+// site, so that discovery leaves the site out, and a directory dox did not
+// render is never written to.
+const staticSiteMarker = ".dox-static"
+
+// IsStatic reports whether the target in use is a static site.
+func IsStatic() bool {
+	return viper.GetString("backend") == staticBackend
+}
+
+// isStaticSite reports whether dir holds a static site rendered by dox.
+func isStaticSite(fs afero.Fs, dir string) bool {
+	_, err := fs.Stat(filepath.Join(dir, staticSiteMarker))
+
+	return err == nil
+}
+
+// publishStatic renders the static site of the target in use to
+// static.output, as a whole whatever changed, since there is nothing to
+// compare it with. In dry-run mode, where it would be rendered is printed
+// instead.
+func publishStatic(fs afero.Fs, files []string, repoRoot string, verbose bool, dryRun bool) error {
+	outDir := viper.GetString("static.output")
+	if dryRun {
+		fmt.Printf("render the site to %s\n", outDir)
+		return nil
+	}
+
+	return BuildStatic(fs, files, repoRoot, outDir, verbose)
+}
+
+// staticSite renders sources to HTML files. Each source is written to a path
+// mirroring its path in the repo, and the root page is written to index.html.
+type staticSite struct {
+	fs       afero.Fs
+	repoRoot string
+	outDir   string
+	verbose  bool
+
+	root    source.Source
+	sources []source.Source
+	// pages maps the file of each published source to its output path,
+	// relative to outDir
+	pages map[string]string
+	// copied tracks the linked files copied to outDir
+	copied map[string]bool
+}
+
+// BuildStatic renders every source to an HTML file in outDir, along with the
+// images and files they link to, so the docs can be served by any static web
+// server. A relative outDir is relative to the repo root. outDir must be
+// empty, or hold a site rendered before.
+//
+// The site is not built by a backend, since backends keep pages by ID, and
+// record those IDs in the dox headers of sources and the root page ID in
+// config, with versions and properties to track changes. A static site is
+// written anew from the paths of sources each time, with nothing to track. A
+// target is still a static site when its backend is static.
+func BuildStatic(fs afero.Fs, files []string, repoRoot string, outDir string, verbose bool) error {
+	if !filepath.IsAbs(outDir) {
+		outDir = filepath.Join(repoRoot, outDir)
+	}
+	outDir = filepath.Clean(outDir)
+
+	if infos, err := afero.ReadDir(fs, outDir); err == nil && len(infos) > 0 && !isStaticSite(fs, outDir) {
+		return fmt.Errorf("%s is not a site rendered by dox; choose an empty directory for the site", outDir)
+	}
+	if err := fs.MkdirAll(outDir, 0755); err != nil {
+		return err
+	}
+	marker := "This site was rendered by dox static, and is not published as sources.\n"
+	if err := afero.WriteFile(fs, filepath.Join(outDir, staticSiteMarker), []byte(marker), 0644); err != nil {
+		return err
+	}
+
+	site := &staticSite{
+		fs:       fs,
+		repoRoot: repoRoot,
+		outDir:   outDir,
+		verbose:  verbose,
+		pages:    map[string]string{},
+		copied:   map[string]bool{},
+	}
+
+	// the notice on published pages is for readers of the wiki
+	opts := sourceOpts(fs)
+	opts.OmitNotice = true
+	opts.StripComments = true
+	opts.TrimSpace = true
+
+	for _, file := range files {
+		// never publish the site into itself
+		if strings.HasPrefix(file, outDir+string(filepath.Separator)) {
+			continue
+		}
+
+		src, err := source.New(file, opts)
+		if err != nil {
+			return err
+		}
+		if src.Ignore() {
+			continue
+		}
+		site.sources = append(site.sources, src)
+	}
+
+	var err error
+	site.root, err = getRootPageSrc(site.sources)
+	if err != nil {
+		return err
+	}
+
+	if site.root == nil {
+		// create dox default root page
+		site.root, err = source.New("", opts)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, src := range site.sources {
+		if src == site.root {
+			continue
+		}
+
+		rel, err := filepath.Rel(repoRoot, src.File())
+		if err != nil {
+			return err
+		}
+		outPath := strings.TrimSuffix(rel, filepath.Ext(rel)) + ".html"
+		if outPath == "index.html" {
+			return fmt.Errorf("%s would replace the root page at index.html", src.File())
+		}
+		site.pages[src.File()] = outPath
+	}
+	site.pages[site.root.File()] = "index.html"
+
+	if err := site.write(site.root); err != nil {
+		return err
+	}
+	for _, src := range site.sources {
+		if src == site.root {
+			continue
+		}
+		if err := site.write(src); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *staticSite) write(src source.Source) error {
+	outPath := s.pages[src.File()]
+	outDir := filepath.Dir(outPath)
+
+	content := src.Output()
+	if src.File() != "" {
+		var err error
+		content, err = s.replaceRelativeRefs(src.File(), outDir, content)
+		if err != nil {
+			return err
+		}
+	}
+
+	var children []previewLink
+	for _, child := range s.sources {
+		if child == s.root {
+			continue
+		}
+		children = append(children, previewLink{
+			title: child.Title(),
+			href:  relURL(outDir, s.pages[child.File()]),
+		})
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].title < children[j].title })
+
+	p, err := newPreviewer(content, children)
+	if err != nil {
+		return err
+	}
+
+	page, err := p.page(src.Title(), s.root.Title(), relURL(outDir, "index.html"), content, "")
+	if err != nil {
+		return err
+	}
+
+	dest := filepath.Join(s.outDir, outPath)
+	if err := s.fs.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	if err := afero.WriteFile(s.fs, dest, []byte(page), 0644); err != nil {
+		return err
+	}
+
+	if s.verbose {
+		srcFile := src.File()
+		if srcFile == "" {
+			srcFile = "root"
+		}
+		fmt.Printf("%s written to %s\n", srcFile, dest)
+	}
+
+	return nil
+}
+
+// replaceRelativeRefs points the relative links and images in content, which
+// is from file, at their output paths relative to outDir. Linked files that
+// are not published sources are copied to the site.
+func (s *staticSite) replaceRelativeRefs(file string, outDir string, content string) (string, error) {
+	anchorHrefs, err := getAnchorHrefsFromHTML(content)
+	if err != nil {
+		return "", err
+	}
+	imageSrcs, err := getImageSrcsFromHTML(content)
+	if err != nil {
+		return "", err
+	}
+
+	replaced := map[string]bool{}
+	for _, ref := range append(anchorHrefs, imageSrcs...) {
+		// skip refs that are URLs
+		if _, err := url.ParseRequestURI(ref); err == nil {
+			continue
+		}
+
+		refPath, fragment := splitFragment(ref)
+		if refPath == "" || replaced[ref] {
+			continue
+		}
+		replaced[ref] = true
+
+		target := filepath.Join(filepath.Dir(file), refPath)
+
+		targetOut, ok := s.pages[target]
+		if !ok {
+			if _, err := s.fs.Stat(target); os.IsNotExist(err) {
+				fmt.Printf("warn: could not find file %s\n", target)
+				continue
+			}
+
+			targetOut, err = s.copy(target)
+			if err != nil {
+				return "", err
+			}
+		}
+
+		newRef := relURL(outDir, targetOut)
+		if fragment != "" {
+			newRef += "#" + fragment
+		}
+
+		content = strings.Replace(content, fmt.Sprintf(`href="%s"`, ref), fmt.Sprintf(`href="%s"`, newRef), -1)
+		content = strings.Replace(content, fmt.Sprintf(`src="%s"`, ref), fmt.Sprintf(`src="%s"`, newRef), -1)
+	}
+
+	return content, nil
+}
+
+// copy copies file into the site at the same path it has in the repo, and
+// returns that path.
+func (s *staticSite) copy(file string) (string, error) {
+	rel, err := filepath.Rel(s.repoRoot, file)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("%s is outside of the repo", file)
+	}
+
+	if s.copied[file] {
+		return rel, nil
+	}
+
+	in, err := s.fs.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return "", fmt.Errorf("can not link to directory %s in a static site", file)
+	}
+
+	dest := filepath.Join(s.outDir, rel)
+	if err := s.fs.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", err
+	}
+
+	out, err := s.fs.Create(dest)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return "", err
+	}
+	s.copied[file] = true
+
+	return rel, nil
+}
+
+// relURL returns a relative URL from a page in fromDir to target, both
+// relative to the root of the site.
+func relURL(fromDir string, target string) string {
+	rel, err := filepath.Rel(fromDir, target)
+	if err != nil {
+		return filepath.ToSlash(target)
+	}
+
+	return filepath.ToSlash(rel)
+}
@@ -0,0 +1,76 @@
+//go:build !windows
+// +build !windows
+
+package dox_test
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jesselang/dox/internal"
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+)
+
+func TestBuildStatic(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	viper.Set("title", "Docs")
+	viper.Set("browse_url_base", "https://git.example.com/repo/blob/main")
+
+	fs := afero.NewMemMapFs()
+	root := "/repo"
+	files := map[string]string{
+		"README.md":       "# Readme\n\nSee [install](docs/install.md#setup) and ![logo](logo.png)\n",
+		"docs/install.md": "# Install\n\n## Setup\n\nRun the installer.\n",
+		"logo.png":        "png",
+	}
+	var sources []string
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := afero.WriteFile(fs, path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Ext(name) == ".md" {
+			sources = append(sources, path)
+		}
+	}
+
+	// the site is written to the repo root, wherever dox runs
+	if err := dox.BuildStatic(fs, sources, root, "site", false); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(name string) string {
+		buf, err := afero.ReadFile(fs, filepath.Join(root, "site", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf)
+	}
+
+	readme := read("README.html")
+	for _, want := range []string{`href="docs/install.html#setup"`, `src="logo.png"`} {
+		if !strings.Contains(readme, want) {
+			t.Errorf("README.html does not contain %s:\n%s", want, readme)
+		}
+	}
+	// the notice is for readers of the wiki, and would be wrong here
+	for _, name := range []string{"README.html", "docs/install.html", "index.html"} {
+		if page := read(name); strings.Contains(page, "will be overwritten") {
+			t.Errorf("%s has the notice of published pages:\n%s", name, page)
+		}
+	}
+	if logo := read("logo.png"); logo != "png" {
+		t.Errorf("logo.png was copied as %q", logo)
+	}
+
+	// the site can be rendered again, but not over files dox did not write
+	if err := dox.BuildStatic(fs, sources, root, "site", false); err != nil {
+		t.Errorf("rendering the site again failed: %s", err)
+	}
+	if err := dox.BuildStatic(fs, sources, root, "docs", false); err == nil {
+		t.Error("rendering the site over docs succeeded")
+	}
+}
@@ -0,0 +1,91 @@
+package dox
+
+import (
+	"fmt"
+
+	"github.com/jesselang/dox/internal/source"
+	"github.com/spf13/afero"
+)
+
+// The states of a file in a status.
+const (
+	StatePublished = "published"
+	StateNew       = "new"
+	StateIgnored   = "ignored"
+	StateExcluded  = "excluded"
+	StateInvalid   = "invalid"
+)
+
+// FileStatus is whether a file in the repo is published, and why not if it
+// is not.
+type FileStatus struct {
+	// File is relative to the repo root.
+	File   string
+	State  string
+	ID     string
+	Reason string
+}
+
+func (s FileStatus) String() string {
+	switch {
+	case s.ID != "":
+		return fmt.Sprintf("%-10s %s (%s)", s.State, s.File, s.ID)
+	case s.Reason != "":
+		return fmt.Sprintf("%-10s %s: %s", s.State, s.File, s.Reason)
+	default:
+		return fmt.Sprintf("%-10s %s", s.State, s.File)
+	}
+}
+
+// Status returns the status of every markdown file of the project in config,
+// in the repo at path, and of every directory left out of discovery. Every
+// source of a static site is published, as it has no pages to have IDs.
+func Status(fs afero.Fs, path string) ([]FileStatus, error) {
+	opts, err := discoverOpts(fs, path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := Discover(fs, path, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []FileStatus
+	for _, e := range entries {
+		if e.Excluded != "" {
+			file := e.Path
+			if e.IsDir {
+				file += "/"
+			}
+			statuses = append(statuses, FileStatus{
+				File:   file,
+				State:  StateExcluded,
+				Reason: e.Excluded,
+			})
+			continue
+		}
+
+		s := FileStatus{File: e.Path}
+
+		src, err := source.New(e.File, sourceOpts(fs))
+		switch {
+		case err != nil:
+			s.State = StateInvalid
+			s.Reason = err.Error()
+		case src.Ignore():
+			s.State = StateIgnored
+			s.Reason = "ignore directive"
+		case IsStatic():
+			s.State = StatePublished
+		case src.ID() != "":
+			s.State = StatePublished
+			s.ID = src.ID()
+		default:
+			s.State = StateNew
+		}
+		statuses = append(statuses, s)
+	}
+
+	return statuses, nil
+}
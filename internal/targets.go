@@ -0,0 +1,128 @@
+package dox
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jesselang/dox/internal/source"
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+)
+
+// readTargets returns the settings of each target in config, by name, and
+// their names in the order they are listed.
+func readTargets() (map[string]map[string]interface{}, []string, error) {
+	var list []map[string]interface{}
+	if err := viper.UnmarshalKey("targets", &list); err != nil {
+		return nil, nil, fmt.Errorf("targets: %s", err)
+	}
+
+	targets := map[string]map[string]interface{}{}
+	var names []string
+	for i, settings := range list {
+		name, _ := settings["name"].(string)
+		if name == "" {
+			return nil, nil, fmt.Errorf("targets: target %d has no name", i+1)
+		}
+		if strings.ContainsAny(name, ":, ") {
+			return nil, nil, fmt.Errorf("targets: invalid target name %q", name)
+		}
+		if _, ok := targets[name]; ok {
+			return nil, nil, fmt.Errorf("targets: more than one target is named %s", name)
+		}
+		targets[name] = settings
+		names = append(names, name)
+	}
+
+	return targets, names, nil
+}
+
+// Targets returns the names of the targets to publish to: the target named,
+// or every target in config if name is empty. Without targets in config, it
+// returns a single empty name, standing for the wiki set by the rest of the
+// config.
+func Targets(name string) ([]string, error) {
+	targets, names, err := readTargets()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(names) == 0 {
+		if name != "" {
+			return nil, errors.New("no targets in config")
+		}
+		return []string{""}, nil
+	}
+
+	if name == "" {
+		return names, nil
+	}
+	if _, ok := targets[name]; !ok {
+		return nil, fmt.Errorf("no target named %s; use one of %s", name, strings.Join(names, ", "))
+	}
+
+	return []string{name}, nil
+}
+
+// UseTarget overlays the settings of the target named on the rest of the
+// config, until the returned function is called. Settings the target does not
+// have are taken from the rest of the config, except for root_id, since each
+// target has its own root page. The first target is the default, which keeps
+// the root page and pages published before targets were added, so it takes
+// root_id from the rest of the config unless it has its own. An empty name
+// leaves the config as it is.
+func UseTarget(name string) (func(), error) {
+	if name == "" {
+		return func() {}, nil
+	}
+
+	targets, names, err := readTargets()
+	if err != nil {
+		return nil, err
+	}
+	settings, ok := targets[name]
+	if !ok {
+		return nil, fmt.Errorf("no target named %s", name)
+	}
+
+	var keys []string
+	set := func(key string, value interface{}) {
+		viper.Set(key, value)
+		keys = append(keys, key)
+	}
+
+	isDefault := name == names[0]
+	if isDefault {
+		// overridden anyway, so that setting the root page ID of the
+		// target does not outlive it
+		set("root_id", viper.GetString("root_id"))
+	} else {
+		set("root_id", "")
+	}
+	for key, value := range settings {
+		if key != "name" {
+			set(key, value)
+		}
+	}
+	set("target", name)
+	set("target_default", isDefault)
+
+	return func() {
+		// setting nil removes the override, uncovering the rest of the
+		// config
+		for _, key := range keys {
+			viper.Set(key, nil)
+		}
+	}, nil
+}
+
+// sourceOpts returns the options to read sources from fs with, for the target
+// in use.
+func sourceOpts(fs afero.Fs) source.Opts {
+	return source.Opts{
+		Fs:            fs,
+		Target:        viper.GetString("target"),
+		DefaultTarget: viper.GetBool("target_default"),
+	}
+}
@@ -0,0 +1,281 @@
+package dox
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/jesselang/dox/internal/backend"
+	"github.com/spf13/afero"
+)
+
+// watchDebounce is how long the repo must be quiet after a change before the
+// affected sources are republished, so an editor saving several files at
+// once results in a single publish.
+const watchDebounce = 500 * time.Millisecond
+
+type watcher struct {
+	fs       afero.Fs
+	repoRoot string
+	verbose  bool
+	dryRun   bool
+
+	files   *repoWatcher
+	pending map[string]bool
+
+	// sums holds the checksum of each file as of the last publish, so the
+	// dox header written to a newly stubbed source does not trigger
+	// another publish.
+	sums map[string]string
+}
+
+// watchPublish publishes the sources affected by the changed files while
+// watching. Tests replace it to see each publish.
+var watchPublish = PublishChanged
+
+// Watch republishes sources as files in the repo change until an error
+// occurs watching the repo. Files ignored by discovery are not watched.
+// Errors publishing are reported, but do not stop the watch.
+func Watch(fs afero.Fs, repoRoot string, verbose bool, dryRun bool) error {
+	w, err := newWatcher(fs, repoRoot, verbose, dryRun)
+	if err != nil {
+		return err
+	}
+	defer w.files.Close()
+
+	fmt.Printf("watching %s for changes\n", w.files.root)
+
+	return w.run()
+}
+
+func newWatcher(fs afero.Fs, repoRoot string, verbose bool, dryRun bool) (*watcher, error) {
+	files, err := newRepoWatcher(fs, repoRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	return &watcher{
+		fs:       fs,
+		repoRoot: repoRoot,
+		verbose:  verbose,
+		dryRun:   dryRun,
+		files:    files,
+		pending:  map[string]bool{},
+		sums:     map[string]string{},
+	}, nil
+}
+
+// run publishes the files changed once the repo is quiet, until the repo
+// is no longer watched or an error occurs watching it.
+func (w *watcher) run() error {
+	timer := time.NewTimer(watchDebounce)
+	timer.Stop()
+
+	for {
+		select {
+		case event, ok := <-w.files.notify.Events:
+			if !ok {
+				return nil
+			}
+			changed, err := w.files.changed(event)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error: %s\n", err)
+			}
+			if len(changed) == 0 {
+				continue
+			}
+
+			for _, file := range changed {
+				w.pending[file] = true
+			}
+			timer.Reset(watchDebounce)
+		case err, ok := <-w.files.notify.Errors:
+			if !ok {
+				return nil
+			}
+			return err
+		case <-timer.C:
+			w.publish()
+		}
+	}
+}
+
+// repoWatcher watches the files of a repo, except those that discovery
+// ignores, such as dependencies and build output listed in .gitignore.
+type repoWatcher struct {
+	fs       afero.Fs
+	repoRoot string
+	opts     DiscoverOpts
+
+	// root is the directory watched, which is that of the project
+	root   string
+	ig     *ignorer
+	notify *fsnotify.Watcher
+}
+
+func newRepoWatcher(fs afero.Fs, repoRoot string) (*repoWatcher, error) {
+	opts, err := discoverOpts(fs, repoRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &repoWatcher{
+		fs:       fs,
+		repoRoot: repoRoot,
+		opts:     opts,
+	}
+	if err := w.reset(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// reset reads the ignore files afresh, and watches every directory they do
+// not ignore. The directories watched before are no longer watched, since
+// some may now be ignored.
+func (w *repoWatcher) reset() error {
+	ig, root, err := discoveryIgnorer(w.fs, w.repoRoot, w.opts)
+	if err != nil {
+		return err
+	}
+	notify, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	old := *w
+	w.root, w.ig, w.notify = root, ig, notify
+	if _, err := w.addDirs(root); err != nil {
+		notify.Close()
+		*w = old
+		return err
+	}
+	if old.notify != nil {
+		old.notify.Close()
+	}
+
+	return nil
+}
+
+// addDirs watches dir and every directory beneath it that is not ignored,
+// and returns the files in them that are not ignored. The directories above
+// dir must have been added already, so that their ignore files have been
+// read.
+func (w *repoWatcher) addDirs(dir string) ([]string, error) {
+	var files []string
+	err := afero.Walk(w.fs, dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			if w.ig.ignored(path, false) == "" {
+				files = append(files, path)
+			}
+			return nil
+		}
+		if info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if path != w.root && w.ig.ignored(path, true) != "" {
+			return filepath.SkipDir
+		}
+		if err := w.ig.enter(path); err != nil {
+			return err
+		}
+
+		return w.notify.Add(path)
+	})
+
+	return files, err
+}
+
+// changed returns the files changed by an event, if any. Changes to ignored
+// files, and to the mode of files, are left out. A directory created is
+// watched in turn, and the files already in it are returned. When an ignore
+// file changes, the ignore files are read again.
+func (w *repoWatcher) changed(event fsnotify.Event) ([]string, error) {
+	rel, err := filepath.Rel(w.repoRoot, event.Name)
+	if err != nil {
+		return nil, nil
+	}
+	for _, part := range strings.Split(filepath.ToSlash(rel), "/") {
+		if part == ".git" {
+			return nil, nil
+		}
+	}
+	if event.Op == fsnotify.Chmod {
+		return nil, nil
+	}
+
+	for _, name := range w.ig.files {
+		if filepath.Base(event.Name) == name {
+			// sources may be included or excluded by the change
+			return []string{event.Name}, w.reset()
+		}
+	}
+
+	if event.Op&fsnotify.Create == fsnotify.Create {
+		if info, err := w.fs.Stat(event.Name); err == nil && info.IsDir() {
+			if w.ig.ignored(event.Name, true) != "" {
+				return nil, nil
+			}
+			return w.addDirs(event.Name)
+		}
+	}
+	if w.ig.ignored(event.Name, false) != "" {
+		return nil, nil
+	}
+
+	return []string{event.Name}, nil
+}
+
+// Close stops watching the repo.
+func (w *repoWatcher) Close() error {
+	return w.notify.Close()
+}
+
+func (w *watcher) publish() {
+	var changed []string
+	for path := range w.pending {
+		sum, err := backend.FileSha256(w.fs, path)
+		if err == nil && sum == w.sums[path] {
+			continue
+		}
+		changed = append(changed, path)
+	}
+	w.pending = map[string]bool{}
+
+	if len(changed) == 0 {
+		return
+	}
+	sort.Strings(changed)
+
+	if w.verbose {
+		for _, path := range changed {
+			fmt.Printf("changed: %s\n", path)
+		}
+	}
+
+	files, err := FindAll(w.fs, w.repoRoot)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		return
+	}
+
+	if err := watchPublish(w.fs, files, changed, w.repoRoot, w.verbose, w.dryRun); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+	}
+
+	for _, path := range changed {
+		if sum, err := backend.FileSha256(w.fs, path); err == nil {
+			w.sums[path] = sum
+		} else {
+			delete(w.sums, path)
+		}
+	}
+}
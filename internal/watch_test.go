@@ -0,0 +1,184 @@
+//go:build !windows
+// +build !windows
+
+package dox_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jesselang/dox/internal"
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+)
+
+// watchRepo is the repo of newPublishRepo on disk, published once and then
+// watched.
+type watchRepo struct {
+	root      string
+	fake      *fakeBackend
+	published chan []string
+	stop      func() error
+}
+
+// newWatchRepo writes the files of newPublishRepo to a new repo, replacing
+// or adding to them with files, publishes it and watches it. Callers call
+// close when done.
+func newWatchRepo(t *testing.T, files map[string]string) *watchRepo {
+	root, err := ioutil.TempDir("", "dox-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, ".git", "objects"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := afero.NewOsFs()
+	sources, fake := writePublishRepo(t, fs, root)
+	writeFiles(t, root, files)
+	if err := dox.Publish(fs, sources, root, false, false); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &watchRepo{
+		root:      root,
+		fake:      fake,
+		published: make(chan []string, 10),
+	}
+	r.stop, err = dox.StartWatch(fs, root, func(changed []string, err error) {
+		if err != nil {
+			t.Errorf("publishing %v: %s", changed, err)
+		}
+		var rel []string
+		for _, file := range changed {
+			rel = append(rel, strings.TrimPrefix(file, root+"/"))
+		}
+		r.published <- rel
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return r
+}
+
+func (r *watchRepo) close(t *testing.T) {
+	if err := r.stop(); err != nil {
+		t.Error(err)
+	}
+	viper.Reset()
+	os.Unsetenv("DOX_PASSWORD")
+	os.RemoveAll(r.root)
+}
+
+// appendLine appends a line to the file at path, relative to the repo.
+func (r *watchRepo) appendLine(t *testing.T, path string, line string) {
+	f, err := os.OpenFile(filepath.Join(r.root, path), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintln(f, line); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// expectPublish waits for the next publish, which must be of the changed
+// files, relative to the repo.
+func (r *watchRepo) expectPublish(t *testing.T, changed ...string) {
+	select {
+	case got := <-r.published:
+		if !reflect.DeepEqual(got, changed) {
+			t.Fatalf("expected %v to be published, got %v", changed, got)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("expected %v to be published", changed)
+	}
+}
+
+// pageByTitle returns the page with the title in the fake backend.
+func (r *watchRepo) pageByTitle(t *testing.T, title string) string {
+	for _, page := range r.fake.pages {
+		if page.Title == title {
+			return page.ID
+		}
+	}
+	t.Fatalf("no page titled %q", title)
+	return ""
+}
+
+func TestWatchDebounce(t *testing.T) {
+	r := newWatchRepo(t, nil)
+	defer r.close(t)
+
+	for i := 0; i < 10; i++ {
+		r.appendLine(t, "docs/install.md", fmt.Sprintf("Step %d.", i))
+	}
+	r.expectPublish(t, "docs/install.md")
+	install := r.fake.pages[r.pageByTitle(t, "Install")]
+	if !strings.Contains(install.Body, "Step 9.") {
+		t.Errorf("expected the last change to be published, got %s", install.Body)
+	}
+
+	// had the writes been published more than once, this would not be
+	// the next publish
+	r.appendLine(t, "README.md", "More.")
+	r.expectPublish(t, "README.md")
+}
+
+func TestWatchIgnored(t *testing.T) {
+	r := newWatchRepo(t, map[string]string{
+		".gitignore": "*.draft.md\nbuild/\n",
+	})
+	defer r.close(t)
+
+	r.appendLine(t, "notes.draft.md", "Draft.")
+	if err := os.MkdirAll(filepath.Join(r.root, "build"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	r.appendLine(t, "build/page.md", "Built.")
+	r.appendLine(t, "README.md", "More.")
+	r.expectPublish(t, "README.md")
+}
+
+func TestWatchRepublishesLinks(t *testing.T) {
+	r := newWatchRepo(t, map[string]string{
+		"README.md":       "# Readme\n\nSee [usage](docs/install.md#usage) and ![logo](logo.png)\n",
+		"docs/install.md": "# Install\n\n## Usage\n\nRun the installer.\n",
+	})
+	defer r.close(t)
+	readme := r.pageByTitle(t, "Readme")
+
+	// the anchor of the link in README.md is made from the title of the
+	// page it links to
+	path := filepath.Join(r.root, "docs/install.md")
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf = []byte(strings.Replace(string(buf), "# Install\n", "# Installing\n", 1))
+	if err := ioutil.WriteFile(path, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	r.expectPublish(t, "docs/install.md")
+	if body := r.fake.pages[readme].Body; !strings.Contains(body, "Installing-Usage") {
+		t.Errorf("expected the link to the renamed page to be republished, got %s", body)
+	}
+
+	// logo.png is not a source, but README.md embeds it
+	r.appendLine(t, "logo.png", "new logo")
+	r.expectPublish(t, "logo.png")
+	if got := string(r.fake.attachments[readme+"/logo.png"]); got != "new logo\n" {
+		t.Errorf("expected logo.png to be uploaded again, got %q", got)
+	}
+}